@@ -0,0 +1,111 @@
+package response
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+
+	"github.com/ian-kent/service.go/handlers/proxy"
+)
+
+// PageParam and PerPageParam are the query parameters used in pagination links
+var (
+	PageParam    = "page"
+	PerPageParam = "per_page"
+)
+
+// TotalCountHeader is the header used to return the total number of items
+var TotalCountHeader = "X-Total-Count"
+
+// Page describes the current page of a paginated response
+type Page struct {
+	// Page is the current page, starting at 1
+	Page int
+	// PerPage is the number of items per page
+	PerPage int
+	// Total is the total number of items, or -1 if unknown
+	Total int
+}
+
+// PageFromRequest reads the page and per-page query parameters from
+// the request, using defaultPerPage and limiting it to maxPerPage
+func PageFromRequest(req *http.Request, defaultPerPage, maxPerPage int) Page {
+	q := req.URL.Query()
+
+	p := Page{Page: 1, PerPage: defaultPerPage, Total: -1}
+	if n, err := strconv.Atoi(q.Get(PageParam)); err == nil && n > 0 {
+		p.Page = n
+	}
+	if n, err := strconv.Atoi(q.Get(PerPageParam)); err == nil && n > 0 {
+		p.PerPage = n
+	}
+	if maxPerPage > 0 && p.PerPage > maxPerPage {
+		p.PerPage = maxPerPage
+	}
+
+	return p
+}
+
+// Offset returns the offset of the first item on the page
+func (p Page) Offset() int {
+	return (p.Page - 1) * p.PerPage
+}
+
+// LastPage returns the last page number, or 0 if the total is unknown
+func (p Page) LastPage() int {
+	if p.Total < 0 || p.PerPage <= 0 {
+		return 0
+	}
+	if p.Total == 0 {
+		return 1
+	}
+	return (p.Total + p.PerPage - 1) / p.PerPage
+}
+
+// Links returns the RFC 8288 Link header value for the page
+func (p Page) Links(u *url.URL) string {
+	var links []string
+
+	link := func(rel string, page int) {
+		lu := *u
+		q := lu.Query()
+		q.Set(PageParam, strconv.Itoa(page))
+		q.Set(PerPageParam, strconv.Itoa(p.PerPage))
+		lu.RawQuery = q.Encode()
+		links = append(links, fmt.Sprintf(`<%s>; rel="%s"`, lu.String(), rel))
+	}
+
+	last := p.LastPage()
+
+	link("first", 1)
+	if p.Page > 1 {
+		link("prev", p.Page-1)
+	}
+	if last == 0 || p.Page < last {
+		link("next", p.Page+1)
+	}
+	if last > 0 {
+		link("last", last)
+	}
+
+	return strings.Join(links, ", ")
+}
+
+// Paginate sets the Link and total count headers for the page
+//
+// Links are relative to the request URL, and include the scheme and
+// host requested by the client when they're known
+func Paginate(w http.ResponseWriter, req *http.Request, p Page) {
+	u := *req.URL
+	if info := proxy.Get(req); len(u.Host) == 0 && len(info.Host) > 0 {
+		u.Host = info.Host
+		u.Scheme = info.Scheme
+	}
+
+	w.Header().Set("Link", p.Links(&u))
+	if p.Total >= 0 {
+		w.Header().Set(TotalCountHeader, strconv.Itoa(p.Total))
+	}
+}
@@ -0,0 +1,126 @@
+package response
+
+import (
+	"encoding/json"
+	"encoding/xml"
+	"net/http"
+
+	"github.com/ian-kent/service.go/log"
+)
+
+// Problem is an RFC 7807 problem details object
+type Problem struct {
+	XMLName  xml.Name `json:"-" xml:"urn:ietf:rfc:7807 problem" yaml:"-"`
+	Type     string   `json:"type,omitempty" xml:"type,omitempty" yaml:"type,omitempty"`
+	Title    string   `json:"title,omitempty" xml:"title,omitempty" yaml:"title,omitempty"`
+	Status   int      `json:"status,omitempty" xml:"status,omitempty" yaml:"status,omitempty"`
+	Detail   string   `json:"detail,omitempty" xml:"detail,omitempty" yaml:"detail,omitempty"`
+	Instance string   `json:"instance,omitempty" xml:"instance,omitempty" yaml:"instance,omitempty"`
+
+	// Extensions are additional members of the problem object
+	//
+	// Extensions are written as top-level members in JSON and YAML,
+	// but are not included in XML output
+	Extensions map[string]interface{} `json:"-" xml:"-" yaml:",inline"`
+}
+
+// NewProblem returns a Problem for the status with the default title
+func NewProblem(status int, detail string) Problem {
+	return Problem{
+		Type:   "about:blank",
+		Title:  http.StatusText(status),
+		Status: status,
+		Detail: detail,
+	}
+}
+
+// With returns a copy of the Problem with an extension member set
+func (p Problem) With(key string, value interface{}) Problem {
+	ext := make(map[string]interface{}, len(p.Extensions)+1)
+	for k, v := range p.Extensions {
+		ext[k] = v
+	}
+	ext[key] = value
+	p.Extensions = ext
+	return p
+}
+
+// Error implements error
+func (p Problem) Error() string {
+	if len(p.Detail) > 0 {
+		return p.Title + ": " + p.Detail
+	}
+	return p.Title
+}
+
+// MarshalJSON implements json.Marshaler
+func (p Problem) MarshalJSON() ([]byte, error) {
+	m := make(map[string]interface{}, len(p.Extensions)+5)
+	for k, v := range p.Extensions {
+		m[k] = v
+	}
+	if len(p.Type) > 0 {
+		m["type"] = p.Type
+	}
+	if len(p.Title) > 0 {
+		m["title"] = p.Title
+	}
+	if p.Status > 0 {
+		m["status"] = p.Status
+	}
+	if len(p.Detail) > 0 {
+		m["detail"] = p.Detail
+	}
+	if len(p.Instance) > 0 {
+		m["instance"] = p.Instance
+	}
+	return json.Marshal(m)
+}
+
+// WriteProblem writes an RFC 7807 problem to w
+//
+// The problem is written as application/problem+json, application/problem+xml
+// or application/problem+yaml depending on the negotiated format.
+func WriteProblem(w http.ResponseWriter, req *http.Request, p Problem) {
+	if p.Status == 0 {
+		p.Status = http.StatusInternalServerError
+	}
+	if len(p.Title) == 0 {
+		p.Title = http.StatusText(p.Status)
+	}
+	if len(p.Instance) == 0 && req.URL != nil {
+		p.Instance = req.URL.Path
+	}
+
+	if p.Status >= 500 {
+		log.ErrorR(req, p, log.Data{"status": p.Status})
+	} else {
+		log.TraceR(req, "problem", log.Data{"status": p.Status, "detail": p.Detail})
+	}
+
+	f, _ := Negotiate(req)
+	WriteFormat(w, req, f, "application/problem+"+f.Suffix, p.Status, p)
+}
+
+// Error writes an RFC 7807 problem with the given status and detail to w
+func Error(w http.ResponseWriter, req *http.Request, status int, detail string) {
+	WriteProblem(w, req, NewProblem(status, detail))
+}
+
+// BadRequest writes a 400 problem to w
+func BadRequest(w http.ResponseWriter, req *http.Request, detail string) {
+	Error(w, req, http.StatusBadRequest, detail)
+}
+
+// NotFound writes a 404 problem to w
+func NotFound(w http.ResponseWriter, req *http.Request, detail string) {
+	Error(w, req, http.StatusNotFound, detail)
+}
+
+// InternalServerError logs err and writes a 500 problem to w
+//
+// The error is not included in the response body
+func InternalServerError(w http.ResponseWriter, req *http.Request, err error) {
+	log.ErrorR(req, err, nil)
+	WriteProblem(w, req, NewProblem(http.StatusInternalServerError, ""))
+}
@@ -0,0 +1,253 @@
+// Package response renders API responses using content negotiation
+package response
+
+import (
+	"encoding/json"
+	"encoding/xml"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/ian-kent/service.go/log"
+	"gopkg.in/yaml.v2"
+)
+
+// Format is a response format
+type Format struct {
+	// Name is a short name for the format, e.g. "json"
+	Name string
+	// ContentType is the Content-Type used when writing the format
+	ContentType string
+	// MediaTypes are the Accept media types matched by the format
+	MediaTypes []string
+	// Suffix is the structured syntax suffix, e.g. "json" for "+json"
+	Suffix string
+
+	Marshal       func(interface{}) ([]byte, error)
+	MarshalIndent func(interface{}) ([]byte, error)
+}
+
+// JSON is the JSON response format
+var JSON = Format{
+	Name:          "json",
+	ContentType:   "application/json",
+	MediaTypes:    []string{"application/json"},
+	Suffix:        "json",
+	Marshal:       json.Marshal,
+	MarshalIndent: func(v interface{}) ([]byte, error) { return json.MarshalIndent(v, "", "  ") },
+}
+
+// XML is the XML response format
+var XML = Format{
+	Name:          "xml",
+	ContentType:   "application/xml",
+	MediaTypes:    []string{"application/xml", "text/xml"},
+	Suffix:        "xml",
+	Marshal:       xml.Marshal,
+	MarshalIndent: func(v interface{}) ([]byte, error) { return xml.MarshalIndent(v, "", "  ") },
+}
+
+// YAML is the YAML response format
+var YAML = Format{
+	Name:          "yaml",
+	ContentType:   "application/yaml",
+	MediaTypes:    []string{"application/yaml", "text/x-yaml", "text/yaml"},
+	Suffix:        "yaml",
+	Marshal:       yaml.Marshal,
+	MarshalIndent: yaml.Marshal,
+}
+
+// Formats is the list of formats available for negotiation, in order of preference
+var Formats = []Format{JSON, XML, YAML}
+
+// DefaultFormat is used when the request has no Accept header, or
+// when none of the accepted media types are supported
+var DefaultFormat = JSON
+
+// PrettyParam is the query parameter which enables pretty-printing
+var PrettyParam = "pretty"
+
+type mediaRange struct {
+	typ, subtype string
+	q            float64
+	index        int
+}
+
+func parseAccept(accept string) []mediaRange {
+	var ranges []mediaRange
+
+	for i, part := range strings.Split(accept, ",") {
+		params := strings.Split(part, ";")
+		mt := strings.ToLower(strings.TrimSpace(params[0]))
+		if len(mt) == 0 {
+			continue
+		}
+
+		mr := mediaRange{q: 1, index: i}
+		if slash := strings.Index(mt, "/"); slash >= 0 {
+			mr.typ, mr.subtype = mt[:slash], mt[slash+1:]
+		} else {
+			mr.typ, mr.subtype = mt, "*"
+		}
+
+		for _, p := range params[1:] {
+			kv := strings.SplitN(strings.TrimSpace(p), "=", 2)
+			if len(kv) == 2 && strings.ToLower(kv[0]) == "q" {
+				if q, err := strconv.ParseFloat(kv[1], 64); err == nil {
+					mr.q = q
+				}
+			}
+		}
+
+		ranges = append(ranges, mr)
+	}
+
+	// more specific ranges first within the same quality
+	sort.SliceStable(ranges, func(i, j int) bool {
+		if ranges[i].q != ranges[j].q {
+			return ranges[i].q > ranges[j].q
+		}
+		return specificity(ranges[i]) > specificity(ranges[j])
+	})
+
+	return ranges
+}
+
+func specificity(mr mediaRange) int {
+	switch {
+	case mr.typ == "*":
+		return 0
+	case mr.subtype == "*":
+		return 1
+	}
+	return 2
+}
+
+func (f Format) matches(mr mediaRange) bool {
+	for _, mt := range f.MediaTypes {
+		parts := strings.SplitN(mt, "/", 2)
+		switch {
+		case mr.typ == "*":
+			return true
+		case mr.typ != parts[0]:
+			continue
+		case mr.subtype == "*",
+			mr.subtype == parts[1],
+			strings.HasSuffix(mr.subtype, "+"+f.Suffix):
+			return true
+		}
+	}
+	return false
+}
+
+// Negotiate returns the Format which best matches the request Accept header
+//
+// The second return value is false if no acceptable format was found,
+// in which case DefaultFormat is returned
+func Negotiate(req *http.Request) (Format, bool) {
+	accept := req.Header.Get("Accept")
+	if len(accept) == 0 {
+		return DefaultFormat, true
+	}
+
+	for _, mr := range parseAccept(accept) {
+		if mr.q <= 0 {
+			continue
+		}
+		for _, f := range Formats {
+			if f.matches(mr) {
+				return f, true
+			}
+		}
+	}
+
+	return DefaultFormat, false
+}
+
+// Pretty returns true if the request asked for pretty-printed output
+func Pretty(req *http.Request) bool {
+	q := req.URL.Query()
+	if _, ok := q[PrettyParam]; !ok {
+		return false
+	}
+	switch strings.ToLower(q.Get(PrettyParam)) {
+	case "0", "false", "no", "off":
+		return false
+	}
+	return true
+}
+
+// Write writes v to w with the given status, using the format
+// negotiated from the request Accept header
+func Write(w http.ResponseWriter, req *http.Request, status int, v interface{}) {
+	f, ok := Negotiate(req)
+	if !ok {
+		log.TraceR(req, "no acceptable format, using default", log.Data{"accept": req.Header.Get("Accept"), "format": f.Name})
+	}
+	WriteFormat(w, req, f, f.ContentType, status, v)
+}
+
+// WriteFormat writes v to w using the given format and content type
+func WriteFormat(w http.ResponseWriter, req *http.Request, f Format, contentType string, status int, v interface{}) {
+	marshal := f.Marshal
+	if Pretty(req) {
+		marshal = f.MarshalIndent
+	}
+
+	var b []byte
+	if v != nil {
+		var err error
+		b, err = marshal(v)
+		if err != nil {
+			log.ErrorR(req, err, log.Data{"format": f.Name})
+			writeMarshalError(w, req)
+			return
+		}
+	}
+
+	w.Header().Set("Content-Type", contentType)
+	w.Header().Add("Vary", "Accept")
+	w.WriteHeader(status)
+
+	if len(b) > 0 {
+		if _, err := w.Write(b); err != nil {
+			log.ErrorR(req, err, nil)
+		}
+	}
+}
+
+// writeMarshalError writes a 500 problem to w as JSON, since the
+// negotiated format may be the one which failed
+func writeMarshalError(w http.ResponseWriter, req *http.Request) {
+	p := NewProblem(http.StatusInternalServerError, "")
+	if req.URL != nil {
+		p.Instance = req.URL.Path
+	}
+	b, _ := json.Marshal(p)
+
+	w.Header().Set("Content-Type", "application/problem+json")
+	w.Header().Add("Vary", "Accept")
+	w.WriteHeader(p.Status)
+	if _, err := w.Write(b); err != nil {
+		log.ErrorR(req, err, nil)
+	}
+}
+
+// OK writes v to w with a 200 status
+func OK(w http.ResponseWriter, req *http.Request, v interface{}) {
+	Write(w, req, http.StatusOK, v)
+}
+
+// Created writes v to w with a 201 status and sets the Location header
+func Created(w http.ResponseWriter, req *http.Request, location string, v interface{}) {
+	if len(location) > 0 {
+		w.Header().Set("Location", location)
+	}
+	Write(w, req, http.StatusCreated, v)
+}
+
+// NoContent writes a 204 status
+func NoContent(w http.ResponseWriter) {
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,97 @@
+package response
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+func TestNegotiate(t *testing.T) {
+	tests := []struct {
+		accept string
+		format string
+		ok     bool
+	}{
+		{"", "json", true},
+		{"*/*", "json", true},
+		{"application/json", "json", true},
+		{"application/xml", "xml", true},
+		{"text/x-yaml", "yaml", true},
+		{"application/vnd.example+xml", "xml", true},
+		{"application/json;q=0.5, application/xml", "xml", true},
+		{"text/*, application/json;q=0.1", "xml", true},
+		{"*/*;q=0.1, application/yaml", "yaml", true},
+		{"image/png", "json", false},
+		{"application/json;q=0", "json", false},
+	}
+
+	for _, test := range tests {
+		req, _ := http.NewRequest("GET", "/", nil)
+		req.Header.Set("Accept", test.accept)
+		f, ok := Negotiate(req)
+		if f.Name != test.format || ok != test.ok {
+			t.Errorf("accept %q: expected %s/%t, got %s/%t", test.accept, test.format, test.ok, f.Name, ok)
+		}
+	}
+}
+
+func TestWriteProblem(t *testing.T) {
+	req, _ := http.NewRequest("GET", "/things/1?pretty", nil)
+	w := httptest.NewRecorder()
+
+	WriteProblem(w, req, NewProblem(http.StatusNotFound, "thing not found").With("id", 1))
+
+	if w.Code != http.StatusNotFound {
+		t.Errorf("expected status 404, got %d", w.Code)
+	}
+	if ct := w.Header().Get("Content-Type"); ct != "application/problem+json" {
+		t.Errorf("unexpected content type %q", ct)
+	}
+	for _, s := range []string{`"detail": "thing not found"`, `"id": 1`, `"instance": "/things/1"`, `"title": "Not Found"`} {
+		if !strings.Contains(w.Body.String(), s) {
+			t.Errorf("expected body to contain %s, got %s", s, w.Body.String())
+		}
+	}
+}
+
+func TestPageLinks(t *testing.T) {
+	u, _ := url.Parse("http://example.com/things?sort=name")
+
+	links := Page{Page: 2, PerPage: 10, Total: 35}.Links(u)
+	for _, s := range []string{
+		`<http://example.com/things?page=1&per_page=10&sort=name>; rel="first"`,
+		`<http://example.com/things?page=1&per_page=10&sort=name>; rel="prev"`,
+		`<http://example.com/things?page=3&per_page=10&sort=name>; rel="next"`,
+		`<http://example.com/things?page=4&per_page=10&sort=name>; rel="last"`,
+	} {
+		if !strings.Contains(links, s) {
+			t.Errorf("expected links to contain %s, got %s", s, links)
+		}
+	}
+
+	links = Page{Page: 4, PerPage: 10, Total: 35}.Links(u)
+	if strings.Contains(links, `rel="next"`) {
+		t.Errorf("unexpected next link on last page: %s", links)
+	}
+}
+
+func TestWriteMarshalError(t *testing.T) {
+	req, _ := http.NewRequest("GET", "/things", nil)
+	req.Header.Set("Accept", "application/xml")
+	w := httptest.NewRecorder()
+
+	// maps can't be marshalled as XML
+	OK(w, req, map[string]interface{}{"a": 1})
+
+	if w.Code != http.StatusInternalServerError {
+		t.Errorf("expected status 500, got %d", w.Code)
+	}
+	if ct := w.Header().Get("Content-Type"); ct != "application/problem+json" {
+		t.Errorf("unexpected content type %q", ct)
+	}
+	if !strings.Contains(w.Body.String(), `"instance":"/things"`) {
+		t.Errorf("expected problem body, got %s", w.Body.String())
+	}
+}
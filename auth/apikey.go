@@ -0,0 +1,83 @@
+package auth
+
+import (
+	"crypto/sha256"
+	"crypto/subtle"
+	"net/http"
+)
+
+// KeyStore looks up the principal for an API key
+//
+// Lookup returns ErrInvalidCredentials if the key isn't found
+type KeyStore interface {
+	Lookup(key string) (*Principal, error)
+}
+
+// KeyStoreFunc is a function which implements KeyStore
+type KeyStoreFunc func(key string) (*Principal, error)
+
+// Lookup implements KeyStore.Lookup
+func (f KeyStoreFunc) Lookup(key string) (*Principal, error) {
+	return f(key)
+}
+
+// MapKeyStore is an in-memory KeyStore
+type MapKeyStore map[string]Principal
+
+// Lookup implements KeyStore.Lookup
+func (m MapKeyStore) Lookup(key string) (*Principal, error) {
+	// compare hashes so the comparison takes the same time for every key
+	h := sha256.Sum256([]byte(key))
+
+	var found *Principal
+	for k, p := range m {
+		kh := sha256.Sum256([]byte(k))
+		if subtle.ConstantTimeCompare(h[:], kh[:]) == 1 {
+			p := p
+			found = &p
+		}
+	}
+
+	if found == nil {
+		return nil, ErrInvalidCredentials
+	}
+	return found, nil
+}
+
+// APIKey authenticates API keys
+//
+// Keys are read from Header, or from Basic credentials with an empty
+// password as sent by the http package Key type.
+type APIKey struct {
+	Store KeyStore
+	// Header is the header containing the API key, "X-Api-Key" if empty
+	Header string
+}
+
+// Authenticate implements Authenticator.Authenticate
+func (a *APIKey) Authenticate(req *http.Request) (*Principal, error) {
+	header := a.Header
+	if len(header) == 0 {
+		header = "X-Api-Key"
+	}
+
+	key := req.Header.Get(header)
+	if len(key) == 0 {
+		if user, pass, ok := req.BasicAuth(); ok && len(pass) == 0 {
+			key = user
+		}
+	}
+	if len(key) == 0 {
+		return nil, ErrNoCredentials
+	}
+
+	p, err := a.Store.Lookup(key)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(p.Method) == 0 {
+		p.Method = "apikey"
+	}
+	return p, nil
+}
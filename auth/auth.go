@@ -0,0 +1,261 @@
+// Package auth implements authentication middleware for HTTP services
+//
+// Authenticators verify the credentials sent by the http package
+// client: Token (JWT bearer tokens) and Key (API keys), as well as
+// Basic credentials.
+package auth
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"strings"
+	"sync"
+
+	"github.com/ian-kent/service.go/api/response"
+	"github.com/ian-kent/service.go/log"
+)
+
+// ErrNoCredentials is returned by an Authenticator if the request
+// doesn't contain credentials it can verify
+var ErrNoCredentials = errors.New("auth: no credentials")
+
+// ErrInvalidCredentials is returned by an Authenticator if the
+// request credentials are invalid
+var ErrInvalidCredentials = errors.New("auth: invalid credentials")
+
+// Principal is an authenticated user or client
+type Principal struct {
+	// ID identifies the principal, e.g. the JWT subject
+	ID string
+	// Method is the authentication method, e.g. "jwt", "apikey" or "basic"
+	Method string
+	// Scopes are the scopes granted to the principal
+	Scopes []string
+	// Roles are the roles granted to the principal
+	Roles []string
+	// Claims contains any additional claims about the principal
+	Claims map[string]interface{}
+}
+
+// HasScope returns true if the principal has the scope
+func (p *Principal) HasScope(scope string) bool {
+	return p != nil && contains(p.Scopes, scope)
+}
+
+// HasRole returns true if the principal has the role
+func (p *Principal) HasRole(role string) bool {
+	return p != nil && contains(p.Roles, role)
+}
+
+func contains(s []string, v string) bool {
+	for _, i := range s {
+		if i == v {
+			return true
+		}
+	}
+	return false
+}
+
+// Authenticator authenticates a request
+//
+// Authenticate returns ErrNoCredentials if the request doesn't contain
+// credentials the Authenticator can verify, so the next Authenticator
+// can be tried.
+type Authenticator interface {
+	Authenticate(req *http.Request) (*Principal, error)
+}
+
+// AuthenticatorFunc is a function which implements Authenticator
+type AuthenticatorFunc func(req *http.Request) (*Principal, error)
+
+// Authenticate implements Authenticator.Authenticate
+func (f AuthenticatorFunc) Authenticate(req *http.Request) (*Principal, error) {
+	return f(req)
+}
+
+type contextKey struct{}
+
+// NewContext returns a new context carrying the principal
+func NewContext(ctx context.Context, p *Principal) context.Context {
+	return context.WithValue(ctx, contextKey{}, p)
+}
+
+// FromContext returns the principal from a context, or nil if the
+// request wasn't authenticated
+func FromContext(ctx context.Context) *Principal {
+	p, _ := ctx.Value(contextKey{}).(*Principal)
+	return p
+}
+
+// Get returns the principal for a request, or nil if the request
+// wasn't authenticated
+func Get(req *http.Request) *Principal {
+	return FromContext(req.Context())
+}
+
+type recorderKey struct{}
+
+// Recorder returns a request which records the principal authenticated
+// by middleware it's passed to, and a function returning the principal
+//
+// It's used by middleware which runs before authentication, such as
+// access logging, and needs the principal once the request is handled.
+// The function is safe to call while the request is still being
+// handled, e.g. after the timeout middleware has given up on it.
+func Recorder(req *http.Request) (*http.Request, func() *Principal) {
+	if p := Get(req); p != nil {
+		return req, func() *Principal { return p }
+	}
+	r := &recorder{}
+	req = req.WithContext(context.WithValue(req.Context(), recorderKey{}, r))
+	return req, r.get
+}
+
+// recorder holds the principal recorded for Recorder
+type recorder struct {
+	mu sync.Mutex
+	p  *Principal
+}
+
+func (r *recorder) get() *Principal {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.p
+}
+
+// record records the principal for Recorder
+func record(req *http.Request, p *Principal) {
+	if r, ok := req.Context().Value(recorderKey{}).(*recorder); ok {
+		r.mu.Lock()
+		r.p = p
+		r.mu.Unlock()
+	}
+}
+
+// Config is the authentication middleware configuration
+type Config struct {
+	// Authenticators are tried in order until one finds credentials
+	Authenticators []Authenticator
+	// Required rejects requests without credentials
+	//
+	// If false, requests without credentials are passed on without
+	// a principal, and requests with invalid credentials are rejected.
+	Required bool
+	// Realm is the realm used in the WWW-Authenticate header
+	Realm string
+	// FailureHandler, if set, is called instead of writing a 401 problem
+	FailureHandler func(w http.ResponseWriter, req *http.Request, err error)
+}
+
+// Handler returns an authentication middleware using the config
+func Handler(cfg Config) func(http.Handler) http.Handler {
+	return func(h http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+			p, method, err := cfg.authenticate(req)
+
+			switch {
+			case err == ErrNoCredentials && !cfg.Required:
+				h.ServeHTTP(w, req)
+				return
+			case err != nil:
+				Audit(req, "authenticate", log.Data{"result": "failure", "auth_method": method, "reason": err.Error()})
+				cfg.fail(w, req, err)
+				return
+			}
+
+			Audit(req, "authenticate", log.Data{"result": "success", "auth_method": p.Method, "principal": p.ID})
+			record(req, p)
+			h.ServeHTTP(w, req.WithContext(NewContext(req.Context(), p)))
+		})
+	}
+}
+
+func (cfg Config) authenticate(req *http.Request) (*Principal, string, error) {
+	for _, a := range cfg.Authenticators {
+		p, err := a.Authenticate(req)
+		if err == ErrNoCredentials {
+			continue
+		}
+		if err != nil {
+			return nil, method(a), err
+		}
+		return p, p.Method, nil
+	}
+	return nil, "", ErrNoCredentials
+}
+
+// method returns the name of an authenticator for audit logging
+func method(a Authenticator) string {
+	switch a.(type) {
+	case *JWT:
+		return "jwt"
+	case *APIKey:
+		return "apikey"
+	case *Basic:
+		return "basic"
+	}
+	return ""
+}
+
+func (cfg Config) fail(w http.ResponseWriter, req *http.Request, err error) {
+	if cfg.FailureHandler != nil {
+		cfg.FailureHandler(w, req, err)
+		return
+	}
+
+	realm := cfg.Realm
+	if len(realm) == 0 {
+		realm = log.Namespace
+	}
+	for _, a := range cfg.Authenticators {
+		switch a.(type) {
+		case *JWT:
+			challenge := `Bearer realm="` + realm + `"`
+			if err != ErrNoCredentials {
+				challenge += `, error="invalid_token"`
+			}
+			w.Header().Add("WWW-Authenticate", challenge)
+		case *Basic:
+			w.Header().Add("WWW-Authenticate", `Basic realm="`+realm+`"`)
+		}
+	}
+
+	Unauthorized(w, req, err)
+}
+
+// Unauthorized writes a 401 problem
+func Unauthorized(w http.ResponseWriter, req *http.Request, err error) {
+	detail := "authentication required"
+	if err != nil && err != ErrNoCredentials {
+		detail = "invalid credentials"
+	}
+	response.Error(w, req, http.StatusUnauthorized, detail)
+}
+
+// Audit records an audit log event for the request
+func Audit(req *http.Request, action string, data log.Data) {
+	if data == nil {
+		data = log.Data{}
+	}
+	data["action"] = action
+	data["remote_addr"] = req.RemoteAddr
+	data["method"] = req.Method
+	data["path"] = req.URL.Path
+	if _, ok := data["principal"]; !ok {
+		if p := Get(req); p != nil {
+			data["principal"] = p.ID
+		}
+	}
+	log.Event("audit", log.Context(req), data)
+}
+
+// authorization returns the scheme and credentials from the
+// Authorization header
+func authorization(req *http.Request) (scheme, credentials string) {
+	hdr := strings.TrimSpace(req.Header.Get("Authorization"))
+	if i := strings.Index(hdr, " "); i >= 0 {
+		return strings.ToLower(hdr[:i]), strings.TrimSpace(hdr[i+1:])
+	}
+	return "", hdr
+}
@@ -0,0 +1,250 @@
+package auth
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gorilla/pat"
+)
+
+func sign(t *testing.T, alg string, key interface{}, claims Claims) string {
+	enc := base64.RawURLEncoding
+	hdr, _ := json.Marshal(map[string]string{"alg": alg, "typ": "JWT"})
+	body, _ := json.Marshal(claims)
+	signed := enc.EncodeToString(hdr) + "." + enc.EncodeToString(body)
+
+	digest := sha256.Sum256([]byte(signed))
+
+	var sig []byte
+	switch k := key.(type) {
+	case []byte:
+		mac := hmac.New(sha256.New, k)
+		mac.Write([]byte(signed))
+		sig = mac.Sum(nil)
+	case *rsa.PrivateKey:
+		var err error
+		sig, err = rsa.SignPKCS1v15(rand.Reader, k, crypto.SHA256, digest[:])
+		if err != nil {
+			t.Fatal(err)
+		}
+	case *ecdsa.PrivateKey:
+		r, s, err := ecdsa.Sign(rand.Reader, k, digest[:])
+		if err != nil {
+			t.Fatal(err)
+		}
+		sig = append(pad(r, 32), pad(s, 32)...)
+	}
+
+	return signed + "." + enc.EncodeToString(sig)
+}
+
+func pad(i *big.Int, size int) []byte {
+	b := i.Bytes()
+	return append(make([]byte, size-len(b)), b...)
+}
+
+func TestJWT(t *testing.T) {
+	rsaKey, _ := rsa.GenerateKey(rand.Reader, 2048)
+	ecKey, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	hmacKey := []byte("secret")
+
+	valid := Claims{"sub": "user1", "scope": "read write", "exp": float64(time.Now().Add(time.Hour).Unix()), "aud": "api"}
+	expired := Claims{"sub": "user1", "exp": float64(time.Now().Add(-time.Hour).Unix()), "aud": "api"}
+
+	tests := []struct {
+		name   string
+		alg    string
+		sign   interface{}
+		verify interface{}
+		claims Claims
+		ok     bool
+	}{
+		{"hmac", "HS256", hmacKey, hmacKey, valid, true},
+		{"hmac wrong key", "HS256", hmacKey, []byte("other"), valid, false},
+		{"rsa", "RS256", rsaKey, &rsaKey.PublicKey, valid, true},
+		{"ecdsa", "ES256", ecKey, &ecKey.PublicKey, valid, true},
+		{"expired", "HS256", hmacKey, hmacKey, expired, false},
+		{"wrong audience", "HS256", hmacKey, hmacKey, Claims{"sub": "user1", "aud": "other"}, false},
+		{"algorithm confusion", "HS256", hmacKey, &rsaKey.PublicKey, valid, false},
+	}
+
+	for _, test := range tests {
+		j := &JWT{Keys: StaticKey(test.verify), Audience: "api"}
+		token := sign(t, test.alg, test.sign, test.claims)
+
+		req, _ := http.NewRequest("GET", "/", nil)
+		req.Header.Set("Authorization", "Bearer "+token)
+
+		p, err := j.Authenticate(req)
+		if (err == nil) != test.ok {
+			t.Errorf("%s: unexpected error %v", test.name, err)
+			continue
+		}
+		if test.ok && (p.ID != "user1" || !p.HasScope("write")) {
+			t.Errorf("%s: unexpected principal %+v", test.name, p)
+		}
+	}
+}
+
+func TestHandler(t *testing.T) {
+	h := Handler(Config{
+		Authenticators: []Authenticator{
+			&APIKey{Store: MapKeyStore{"key1": {ID: "client1"}}},
+			&Basic{Store: Passwords{"user1": "pass1"}},
+		},
+		Required: true,
+	})(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.Write([]byte(Get(req).ID))
+	}))
+
+	tests := []struct {
+		user, pass string
+		status     int
+		principal  string
+	}{
+		{"key1", "", http.StatusOK, "client1"},
+		{"user1", "pass1", http.StatusOK, "user1"},
+		{"user1", "wrong", http.StatusUnauthorized, ""},
+		{"key2", "", http.StatusUnauthorized, ""},
+	}
+
+	for _, test := range tests {
+		w := httptest.NewRecorder()
+		req, _ := http.NewRequest("GET", "/", nil)
+		req.SetBasicAuth(test.user, test.pass)
+		h.ServeHTTP(w, req)
+
+		if w.Code != test.status {
+			t.Errorf("%s: expected status %d, got %d", test.user, test.status, w.Code)
+		}
+		if w.Code == http.StatusOK && w.Body.String() != test.principal {
+			t.Errorf("%s: expected principal %s, got %s", test.user, test.principal, w.Body.String())
+		}
+	}
+
+	w := httptest.NewRecorder()
+	req, _ := http.NewRequest("GET", "/", nil)
+	h.ServeHTTP(w, req)
+	if w.Code != http.StatusUnauthorized || len(w.Header().Get("WWW-Authenticate")) == 0 {
+		t.Errorf("expected 401 with challenge, got %d", w.Code)
+	}
+}
+
+func TestAuthorize(t *testing.T) {
+	r := pat.New()
+	reg := &Registry{}
+	reg.Protect(r.Post("/things", func(w http.ResponseWriter, req *http.Request) {}), RequireScopes("things:write"))
+	reg.Protect(r.Get("/admin", func(w http.ResponseWriter, req *http.Request) {}), RequireRoles("admin"))
+
+	tests := []struct {
+		method, path string
+		principal    *Principal
+		status       int
+	}{
+		{"POST", "/things", nil, http.StatusUnauthorized},
+		{"POST", "/things", &Principal{ID: "a", Scopes: []string{"things:read"}}, http.StatusForbidden},
+		{"POST", "/things", &Principal{ID: "a", Scopes: []string{"things:write"}}, http.StatusOK},
+		{"GET", "/admin", &Principal{ID: "a"}, http.StatusForbidden},
+		{"GET", "/admin", &Principal{ID: "a", Roles: []string{"admin"}}, http.StatusOK},
+	}
+
+	for _, test := range tests {
+		w := httptest.NewRecorder()
+		req, _ := http.NewRequest(test.method, test.path, nil)
+		if test.principal != nil {
+			req = req.WithContext(NewContext(req.Context(), test.principal))
+		}
+		r.ServeHTTP(w, req)
+
+		if w.Code != test.status {
+			t.Errorf("%s %s %+v: expected status %d, got %d", test.method, test.path, test.principal, test.status, w.Code)
+		}
+	}
+
+	rules := reg.Rules()
+	if len(rules) != 2 || rules[0].Path != "/admin" || rules[1].Scopes[0] != "things:write" {
+		t.Errorf("unexpected rules %+v", rules)
+	}
+}
+
+func TestJWKS(t *testing.T) {
+	var mu sync.Mutex
+	var fetches int
+	fail := false
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		mu.Lock()
+		fetches++
+		f := fail
+		mu.Unlock()
+		// slow enough for concurrent requests to overlap
+		time.Sleep(20 * time.Millisecond)
+		if f {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		w.Write([]byte(`{"keys":[{"kty":"oct","kid":"k1","k":"c2VjcmV0"}]}`))
+	}))
+	defer srv.Close()
+
+	count := func() int {
+		mu.Lock()
+		defer mu.Unlock()
+		return fetches
+	}
+
+	// the zero value uses the default TTL
+	j := &JWKS{Source: srv.URL}
+
+	var wg sync.WaitGroup
+	for i := 0; i < 5; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if _, err := j.Key("k1", "HS256"); err != nil {
+				t.Error(err)
+			}
+		}()
+	}
+	wg.Wait()
+	if _, err := j.Key("k1", "HS256"); err != nil {
+		t.Fatal(err)
+	}
+	if n := count(); n != 1 {
+		t.Errorf("expected keys to be fetched once, got %d", n)
+	}
+
+	// unknown keys only refresh once MinRefresh has passed
+	if _, err := j.Key("k2", "HS256"); err == nil {
+		t.Error("expected unknown key error")
+	}
+	if n := count(); n != 1 {
+		t.Errorf("expected refresh to be rate limited, got %d fetches", n)
+	}
+
+	// a failed first load isn't retried on every request
+	mu.Lock()
+	fail = true
+	mu.Unlock()
+	j = &JWKS{Source: srv.URL}
+	for i := 0; i < 3; i++ {
+		if _, err := j.Key("k1", "HS256"); err == nil {
+			t.Error("expected load error")
+		}
+	}
+	if n := count(); n != 2 {
+		t.Errorf("expected failed load to back off, got %d fetches", n)
+	}
+}
@@ -0,0 +1,179 @@
+package auth
+
+import (
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/gorilla/mux"
+	"github.com/gorilla/pat"
+	"github.com/ian-kent/service.go/api/response"
+	"github.com/ian-kent/service.go/log"
+)
+
+// Policy decides whether an authenticated principal can access a route
+type Policy func(req *http.Request, p *Principal) bool
+
+// Rule is an authorization rule for a route
+//
+// All conditions in a rule must be met. A zero Rule only requires
+// the request to be authenticated.
+type Rule struct {
+	// Scopes are required scopes, all of which the principal must have
+	Scopes []string `json:"scopes,omitempty" xml:"scope,omitempty" yaml:"scopes,omitempty"`
+	// Roles are allowed roles, one of which the principal must have
+	Roles []string `json:"roles,omitempty" xml:"role,omitempty" yaml:"roles,omitempty"`
+	// Policy is a custom policy function
+	Policy Policy `json:"-" xml:"-" yaml:"-"`
+	// PolicyName describes the custom policy for introspection
+	PolicyName string `json:"policy,omitempty" xml:"policy,omitempty" yaml:"policy,omitempty"`
+}
+
+// Authenticated returns a Rule which only requires the request to be authenticated
+func Authenticated() Rule {
+	return Rule{}
+}
+
+// RequireScopes returns a Rule requiring all of the scopes
+func RequireScopes(scopes ...string) Rule {
+	return Rule{Scopes: scopes}
+}
+
+// RequireRoles returns a Rule requiring any of the roles
+func RequireRoles(roles ...string) Rule {
+	return Rule{Roles: roles}
+}
+
+// RequirePolicy returns a Rule using a custom policy
+func RequirePolicy(name string, policy Policy) Rule {
+	return Rule{Policy: policy, PolicyName: name}
+}
+
+// missingScopes returns the scopes required by the rule which the principal doesn't have
+func (r Rule) missingScopes(p *Principal) []string {
+	var missing []string
+	for _, s := range r.Scopes {
+		if !p.HasScope(s) {
+			missing = append(missing, s)
+		}
+	}
+	return missing
+}
+
+func (r Rule) hasRole(p *Principal) bool {
+	if len(r.Roles) == 0 {
+		return true
+	}
+	for _, role := range r.Roles {
+		if p.HasRole(role) {
+			return true
+		}
+	}
+	return false
+}
+
+// Authorize returns a handler which checks the rule before calling h
+//
+// Unauthenticated requests receive a 401 problem, and authenticated
+// requests which don't meet the rule receive a 403 problem.
+func Authorize(rule Rule, h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		p := Get(req)
+		if p == nil {
+			Audit(req, "authorize", log.Data{"result": "failure", "reason": "unauthenticated"})
+			Unauthorized(w, req, ErrNoCredentials)
+			return
+		}
+
+		if missing := rule.missingScopes(p); len(missing) > 0 {
+			Audit(req, "authorize", log.Data{"result": "failure", "reason": "insufficient scope", "missing_scopes": missing})
+			if p.Method == "jwt" {
+				w.Header().Set("WWW-Authenticate", `Bearer error="insufficient_scope", scope="`+strings.Join(rule.Scopes, " ")+`"`)
+			}
+			response.WriteProblem(w, req, response.NewProblem(http.StatusForbidden, "insufficient scope").With("required_scopes", rule.Scopes))
+			return
+		}
+
+		if !rule.hasRole(p) {
+			Audit(req, "authorize", log.Data{"result": "failure", "reason": "missing role", "roles": rule.Roles})
+			response.WriteProblem(w, req, response.NewProblem(http.StatusForbidden, "missing role").With("required_roles", rule.Roles))
+			return
+		}
+
+		if rule.Policy != nil && !rule.Policy(req, p) {
+			Audit(req, "authorize", log.Data{"result": "failure", "reason": "policy", "policy": rule.PolicyName})
+			response.Error(w, req, http.StatusForbidden, "access denied")
+			return
+		}
+
+		h.ServeHTTP(w, req)
+	})
+}
+
+// RouteRule is an authorization rule registered for a route
+type RouteRule struct {
+	Methods []string `json:"methods,omitempty" xml:"method,omitempty" yaml:"methods,omitempty"`
+	Path    string   `json:"path" xml:"path" yaml:"path"`
+	Rule    `yaml:",inline"`
+}
+
+// Registry records route authorization rules for introspection
+type Registry struct {
+	mu    sync.Mutex
+	rules []RouteRule
+}
+
+// DefaultRegistry is the registry used by Protect
+var DefaultRegistry = &Registry{}
+
+// Protect wraps the route's handler with the rule and records the
+// rule in DefaultRegistry
+//
+// The route must already have a handler, for example:
+//
+//	auth.Protect(r.Post("/things", createThing), auth.RequireScopes("things:write"))
+func Protect(route *mux.Route, rule Rule) *mux.Route {
+	return DefaultRegistry.Protect(route, rule)
+}
+
+// Protect wraps the route's handler with the rule and records the rule
+func (reg *Registry) Protect(route *mux.Route, rule Rule) *mux.Route {
+	h := route.GetHandler()
+	if h == nil {
+		panic("auth: route has no handler")
+	}
+
+	rr := RouteRule{Rule: rule}
+	rr.Path, _ = route.GetPathTemplate()
+	rr.Methods, _ = route.GetMethods()
+
+	reg.mu.Lock()
+	reg.rules = append(reg.rules, rr)
+	reg.mu.Unlock()
+
+	return route.Handler(Authorize(rule, h))
+}
+
+// Rules returns the registered route rules, sorted by path
+func (reg *Registry) Rules() []RouteRule {
+	reg.mu.Lock()
+	defer reg.mu.Unlock()
+
+	rules := append([]RouteRule{}, reg.rules...)
+	sort.SliceStable(rules, func(i, j int) bool {
+		return rules[i].Path < rules[j].Path
+	})
+	return rules
+}
+
+// Register registers a route which lists the rules in DefaultRegistry
+//
+// The route can itself be protected, e.g.
+//
+//	auth.Protect(auth.Register(r, "/auth/routes"), auth.RequireRoles("security"))
+func Register(r *pat.Router, path string) *mux.Route {
+	return r.Path(path).Methods("GET").HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		response.OK(w, req, DefaultRegistry.Rules())
+	})
+}
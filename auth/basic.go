@@ -0,0 +1,65 @@
+package auth
+
+import (
+	"crypto/sha256"
+	"crypto/subtle"
+	"net/http"
+)
+
+// CredentialStore verifies a username and password
+//
+// Verify returns ErrInvalidCredentials if the credentials are invalid
+type CredentialStore interface {
+	Verify(username, password string) (*Principal, error)
+}
+
+// CredentialStoreFunc is a function which implements CredentialStore
+type CredentialStoreFunc func(username, password string) (*Principal, error)
+
+// Verify implements CredentialStore.Verify
+func (f CredentialStoreFunc) Verify(username, password string) (*Principal, error) {
+	return f(username, password)
+}
+
+// Passwords is an in-memory CredentialStore mapping usernames to passwords
+type Passwords map[string]string
+
+// Verify implements CredentialStore.Verify
+func (p Passwords) Verify(username, password string) (*Principal, error) {
+	expected, ok := p[username]
+
+	// compare hashes so the comparison takes the same time for every password
+	h := sha256.Sum256([]byte(password))
+	eh := sha256.Sum256([]byte(expected))
+	if subtle.ConstantTimeCompare(h[:], eh[:]) != 1 || !ok {
+		return nil, ErrInvalidCredentials
+	}
+
+	return &Principal{ID: username}, nil
+}
+
+// Basic authenticates Basic credentials
+//
+// Basic credentials with an empty password are ignored, so they
+// can be handled by APIKey.
+type Basic struct {
+	Store CredentialStore
+}
+
+// Authenticate implements Authenticator.Authenticate
+func (b *Basic) Authenticate(req *http.Request) (*Principal, error) {
+	user, pass, ok := req.BasicAuth()
+	if !ok || len(pass) == 0 {
+		return nil, ErrNoCredentials
+	}
+
+	p, err := b.Store.Verify(user, pass)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(p.Method) == 0 {
+		p.Method = "basic"
+	}
+	return p, nil
+}
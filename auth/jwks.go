@@ -0,0 +1,308 @@
+package auth
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/ian-kent/service.go/log"
+)
+
+// JWK is a JSON Web Key
+type JWK struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid"`
+	Alg string `json:"alg"`
+	Use string `json:"use"`
+
+	// RSA
+	N string `json:"n"`
+	E string `json:"e"`
+
+	// EC
+	Crv string `json:"crv"`
+	X   string `json:"x"`
+	Y   string `json:"y"`
+
+	// oct
+	K string `json:"k"`
+}
+
+// PublicKey returns the key in the form used by Keyset.Key
+func (k JWK) PublicKey() (interface{}, error) {
+	dec := base64.RawURLEncoding
+
+	switch k.Kty {
+	case "RSA":
+		n, err := dec.DecodeString(k.N)
+		if err != nil {
+			return nil, err
+		}
+		e, err := dec.DecodeString(k.E)
+		if err != nil {
+			return nil, err
+		}
+		return &rsa.PublicKey{
+			N: new(big.Int).SetBytes(n),
+			E: int(new(big.Int).SetBytes(e).Int64()),
+		}, nil
+	case "EC":
+		var curve elliptic.Curve
+		switch k.Crv {
+		case "P-256":
+			curve = elliptic.P256()
+		case "P-384":
+			curve = elliptic.P384()
+		case "P-521":
+			curve = elliptic.P521()
+		default:
+			return nil, fmt.Errorf("auth: unsupported curve: %s", k.Crv)
+		}
+		x, err := dec.DecodeString(k.X)
+		if err != nil {
+			return nil, err
+		}
+		y, err := dec.DecodeString(k.Y)
+		if err != nil {
+			return nil, err
+		}
+		return &ecdsa.PublicKey{
+			Curve: curve,
+			X:     new(big.Int).SetBytes(x),
+			Y:     new(big.Int).SetBytes(y),
+		}, nil
+	case "oct":
+		return dec.DecodeString(k.K)
+	}
+
+	return nil, fmt.Errorf("auth: unsupported key type: %s", k.Kty)
+}
+
+// JWKS is a Keyset loaded from a JSON Web Key Set file or URL
+//
+// Keys loaded from a URL are cached for TTL, and reloaded early
+// (at most once every MinRefresh) when a token uses an unknown key ID.
+// Only one request loads the keys at a time, and other requests wait
+// for it. After a failed load the previous keys are used, or requests
+// fail if there are none, and loading is retried with an exponential
+// backoff of up to MinRefresh.
+type JWKS struct {
+	// Source is a file path, or a http or https URL
+	Source string
+	// TTL is how long keys loaded from a URL are cached, DefaultJWKSTTL if zero
+	TTL time.Duration
+	// MinRefresh is the minimum time between reloads, DefaultJWKSMinRefresh if zero
+	MinRefresh time.Duration
+	// Client is the HTTP client used to load keys from a URL
+	Client *http.Client
+
+	mu        sync.Mutex
+	keys      map[string]JWK
+	err       error
+	loaded    time.Time
+	attempted time.Time
+	failures  int
+	retryAt   time.Time
+	// loading is closed when the load in progress finishes
+	loading chan struct{}
+}
+
+// DefaultJWKSTTL is the JWKS.TTL used if none is set
+var DefaultJWKSTTL = time.Hour
+
+// DefaultJWKSMinRefresh is the JWKS.MinRefresh used if none is set
+var DefaultJWKSMinRefresh = time.Minute
+
+// NewJWKS returns a JWKS Keyset for a file path or URL
+func NewJWKS(source string) *JWKS {
+	return &JWKS{
+		Source:     source,
+		TTL:        DefaultJWKSTTL,
+		MinRefresh: DefaultJWKSMinRefresh,
+		Client:     &http.Client{Timeout: 10 * time.Second},
+	}
+}
+
+// Key implements Keyset.Key
+func (j *JWKS) Key(kid, alg string) (interface{}, error) {
+	keys, err := j.keyset(false)
+	if keys == nil {
+		return nil, err
+	}
+
+	k, ok := find(keys, kid, alg)
+	if !ok && j.remote() {
+		// the keys may have been rotated
+		keys, _ = j.keyset(true)
+		k, ok = find(keys, kid, alg)
+	}
+	if !ok {
+		return nil, fmt.Errorf("auth: key not found: %s", kid)
+	}
+
+	return k.PublicKey()
+}
+
+func (j *JWKS) ttl() time.Duration {
+	if j.TTL > 0 {
+		return j.TTL
+	}
+	return DefaultJWKSTTL
+}
+
+func (j *JWKS) minRefresh() time.Duration {
+	if j.MinRefresh > 0 {
+		return j.MinRefresh
+	}
+	return DefaultJWKSMinRefresh
+}
+
+// keyset returns the keys, loading them first if they're stale, or
+// if refresh is true and they haven't been loaded recently
+func (j *JWKS) keyset(refresh bool) (map[string]JWK, error) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	if j.loading != nil {
+		// another request is loading the keys
+		loading := j.loading
+		j.mu.Unlock()
+		<-loading
+		j.mu.Lock()
+	} else if j.stale(refresh) {
+		loading := make(chan struct{})
+		j.loading = loading
+		j.mu.Unlock()
+
+		keys, err := j.load()
+
+		j.mu.Lock()
+		j.update(keys, err)
+		j.loading = nil
+		close(loading)
+	}
+
+	if j.keys == nil {
+		return nil, j.err
+	}
+	return j.keys, nil
+}
+
+// stale returns true if the keys should be loaded; j.mu must be held
+func (j *JWKS) stale(refresh bool) bool {
+	now := time.Now()
+	switch {
+	case now.Before(j.retryAt):
+		// backing off after a failure
+		return false
+	case j.keys == nil:
+		return true
+	case !j.remote():
+		return false
+	case now.Sub(j.loaded) > j.ttl():
+		return true
+	}
+	return refresh && now.Sub(j.attempted) > j.minRefresh()
+}
+
+// update records the result of loading the keys, keeping the previous
+// keys on error; j.mu must be held
+func (j *JWKS) update(keys map[string]JWK, err error) {
+	now := time.Now()
+	j.attempted = now
+
+	if err != nil {
+		j.err = err
+		j.failures++
+		backoff := j.minRefresh()
+		if j.failures < 16 {
+			if d := time.Second << uint(j.failures-1); d < backoff {
+				backoff = d
+			}
+		}
+		j.retryAt = now.Add(backoff)
+		log.Error(err, log.Data{"jwks": j.Source, "failures": j.failures, "retry_in": backoff.String()})
+		return
+	}
+
+	j.keys, j.err, j.loaded = keys, nil, now
+	j.failures, j.retryAt = 0, time.Time{}
+	log.Debug("loaded jwks", log.Data{"jwks": j.Source, "keys": len(keys)})
+}
+
+func find(keys map[string]JWK, kid, alg string) (JWK, bool) {
+	if len(kid) > 0 {
+		k, ok := keys[kid]
+		return k, ok && (len(k.Alg) == 0 || k.Alg == alg)
+	}
+	// without a key ID, only a single key can be used
+	if len(keys) == 1 {
+		for _, k := range keys {
+			return k, len(k.Alg) == 0 || k.Alg == alg
+		}
+	}
+	return JWK{}, false
+}
+
+func (j *JWKS) remote() bool {
+	return len(j.Source) > 7 && (j.Source[:7] == "http://" || j.Source[:8] == "https://")
+}
+
+// load reads and parses the key set
+func (j *JWKS) load() (map[string]JWK, error) {
+	var b []byte
+	var err error
+
+	if j.remote() {
+		b, err = j.fetch()
+	} else {
+		b, err = ioutil.ReadFile(j.Source)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var set struct {
+		Keys []JWK `json:"keys"`
+	}
+	if err := json.Unmarshal(b, &set); err != nil {
+		return nil, err
+	}
+
+	keys := make(map[string]JWK)
+	for _, k := range set.Keys {
+		if len(k.Use) > 0 && k.Use != "sig" {
+			continue
+		}
+		keys[k.Kid] = k
+	}
+	return keys, nil
+}
+
+func (j *JWKS) fetch() ([]byte, error) {
+	cli := j.Client
+	if cli == nil {
+		cli = http.DefaultClient
+	}
+
+	res, err := cli.Get(j.Source)
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode != http.StatusOK {
+		return nil, errors.New("auth: unexpected status loading jwks: " + res.Status)
+	}
+
+	return ioutil.ReadAll(res.Body)
+}
@@ -0,0 +1,291 @@
+package auth
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/hmac"
+	"crypto/rsa"
+	_ "crypto/sha256" // registers SHA-256 for crypto.Hash
+	_ "crypto/sha512" // registers SHA-384 and SHA-512 for crypto.Hash
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/big"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// Claims are the claims in a JWT
+type Claims map[string]interface{}
+
+// String returns a string claim
+func (c Claims) String(name string) string {
+	s, _ := c[name].(string)
+	return s
+}
+
+// Strings returns a claim which is either a space separated string
+// or an array of strings
+func (c Claims) Strings(name string) []string {
+	switch v := c[name].(type) {
+	case string:
+		return strings.Fields(v)
+	case []interface{}:
+		var s []string
+		for _, i := range v {
+			if str, ok := i.(string); ok {
+				s = append(s, str)
+			}
+		}
+		return s
+	}
+	return nil
+}
+
+// Time returns a NumericDate claim
+func (c Claims) Time(name string) (time.Time, bool) {
+	switch v := c[name].(type) {
+	case float64:
+		return time.Unix(int64(v), 0), true
+	case json.Number:
+		if n, err := v.Int64(); err == nil {
+			return time.Unix(n, 0), true
+		}
+	}
+	return time.Time{}, false
+}
+
+// Keyset resolves the key used to verify a JWT
+type Keyset interface {
+	// Key returns the key for the key ID and algorithm
+	//
+	// The key must be a []byte for HMAC algorithms, *rsa.PublicKey
+	// for RSA algorithms or *ecdsa.PublicKey for ECDSA algorithms.
+	Key(kid, alg string) (interface{}, error)
+}
+
+// KeysetFunc is a function which implements Keyset
+type KeysetFunc func(kid, alg string) (interface{}, error)
+
+// Key implements Keyset.Key
+func (f KeysetFunc) Key(kid, alg string) (interface{}, error) {
+	return f(kid, alg)
+}
+
+// StaticKey returns a Keyset with a single key used for all tokens
+func StaticKey(key interface{}) Keyset {
+	return KeysetFunc(func(kid, alg string) (interface{}, error) {
+		return key, nil
+	})
+}
+
+// JWT authenticates JWT bearer tokens
+type JWT struct {
+	// Keys resolves the keys used to verify tokens
+	Keys Keyset
+	// Algorithms restricts the accepted algorithms, e.g. "RS256"
+	//
+	// If empty, any supported algorithm matching the key type is accepted
+	Algorithms []string
+	// Issuer, if set, must match the iss claim
+	Issuer string
+	// Audience, if set, must be in the aud claim
+	Audience string
+	// Leeway allows for clock skew when validating exp and nbf
+	Leeway time.Duration
+	// ScopeClaim is the claim containing scopes, "scope" if empty
+	ScopeClaim string
+	// RoleClaim is the claim containing roles, "roles" if empty
+	RoleClaim string
+}
+
+// Authenticate implements Authenticator.Authenticate
+func (j *JWT) Authenticate(req *http.Request) (*Principal, error) {
+	scheme, token := authorization(req)
+	if scheme != "bearer" || len(token) == 0 {
+		return nil, ErrNoCredentials
+	}
+
+	claims, err := j.Verify(token)
+	if err != nil {
+		return nil, err
+	}
+
+	scopeClaim, roleClaim := j.ScopeClaim, j.RoleClaim
+	if len(scopeClaim) == 0 {
+		scopeClaim = "scope"
+	}
+	if len(roleClaim) == 0 {
+		roleClaim = "roles"
+	}
+
+	scopes := claims.Strings(scopeClaim)
+	if len(scopes) == 0 && len(j.ScopeClaim) == 0 {
+		scopes = claims.Strings("scp")
+	}
+
+	return &Principal{
+		ID:     claims.String("sub"),
+		Method: "jwt",
+		Scopes: scopes,
+		Roles:  claims.Strings(roleClaim),
+		Claims: claims,
+	}, nil
+}
+
+type jwtHeader struct {
+	Alg string `json:"alg"`
+	Kid string `json:"kid"`
+	Typ string `json:"typ"`
+}
+
+// Verify verifies a token and returns its claims
+func (j *JWT) Verify(token string) (Claims, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return nil, errors.New("auth: malformed token")
+	}
+
+	var hdr jwtHeader
+	if err := decodeSegment(parts[0], &hdr); err != nil {
+		return nil, fmt.Errorf("auth: invalid token header: %s", err)
+	}
+
+	if len(j.Algorithms) > 0 && !contains(j.Algorithms, hdr.Alg) {
+		return nil, fmt.Errorf("auth: algorithm not allowed: %s", hdr.Alg)
+	}
+
+	sig, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, fmt.Errorf("auth: invalid token signature: %s", err)
+	}
+
+	key, err := j.Keys.Key(hdr.Kid, hdr.Alg)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := verifySignature(hdr.Alg, key, []byte(parts[0]+"."+parts[1]), sig); err != nil {
+		return nil, err
+	}
+
+	var claims Claims
+	if err := decodeSegment(parts[1], &claims); err != nil {
+		return nil, fmt.Errorf("auth: invalid token claims: %s", err)
+	}
+
+	if err := j.validate(claims); err != nil {
+		return nil, err
+	}
+
+	return claims, nil
+}
+
+func (j *JWT) validate(claims Claims) error {
+	now := time.Now()
+
+	if exp, ok := claims.Time("exp"); ok && now.After(exp.Add(j.Leeway)) {
+		return errors.New("auth: token has expired")
+	}
+	if nbf, ok := claims.Time("nbf"); ok && now.Add(j.Leeway).Before(nbf) {
+		return errors.New("auth: token is not yet valid")
+	}
+	if len(j.Issuer) > 0 && claims.String("iss") != j.Issuer {
+		return errors.New("auth: invalid token issuer")
+	}
+	if len(j.Audience) > 0 && !contains(claims.Strings("aud"), j.Audience) {
+		return errors.New("auth: invalid token audience")
+	}
+
+	return nil
+}
+
+func decodeSegment(seg string, v interface{}) error {
+	b, err := base64.RawURLEncoding.DecodeString(seg)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(b, v)
+}
+
+var hashes = map[string]crypto.Hash{
+	"256": crypto.SHA256,
+	"384": crypto.SHA384,
+	"512": crypto.SHA512,
+}
+
+var curveBits = map[string]int{
+	"ES256": 256,
+	"ES384": 384,
+	"ES512": 521,
+}
+
+// verifySignature verifies the signature, ensuring the key type
+// matches the algorithm so keys can't be used with other algorithms
+func verifySignature(alg string, key interface{}, signed, sig []byte) error {
+	if len(alg) != 5 {
+		return fmt.Errorf("auth: unsupported algorithm: %s", alg)
+	}
+
+	hash, ok := hashes[alg[2:]]
+	if !ok {
+		return fmt.Errorf("auth: unsupported algorithm: %s", alg)
+	}
+
+	var digest []byte
+	if alg[:2] != "HS" {
+		h := hash.New()
+		h.Write(signed)
+		digest = h.Sum(nil)
+	}
+
+	switch alg[:2] {
+	case "HS":
+		k, ok := key.([]byte)
+		if !ok {
+			return errors.New("auth: invalid key type for HMAC")
+		}
+		mac := hmac.New(hash.New, k)
+		mac.Write(signed)
+		if !hmac.Equal(sig, mac.Sum(nil)) {
+			return ErrInvalidCredentials
+		}
+	case "RS", "PS":
+		k, ok := key.(*rsa.PublicKey)
+		if !ok {
+			return errors.New("auth: invalid key type for RSA")
+		}
+		var err error
+		if alg[:2] == "RS" {
+			err = rsa.VerifyPKCS1v15(k, hash, digest, sig)
+		} else {
+			err = rsa.VerifyPSS(k, hash, digest, sig, &rsa.PSSOptions{SaltLength: rsa.PSSSaltLengthEqualsHash})
+		}
+		if err != nil {
+			return ErrInvalidCredentials
+		}
+	case "ES":
+		k, ok := key.(*ecdsa.PublicKey)
+		if !ok {
+			return errors.New("auth: invalid key type for ECDSA")
+		}
+		if k.Curve.Params().BitSize != curveBits[alg] {
+			return errors.New("auth: invalid curve for " + alg)
+		}
+		size := (k.Curve.Params().BitSize + 7) / 8
+		if len(sig) != 2*size {
+			return ErrInvalidCredentials
+		}
+		r := new(big.Int).SetBytes(sig[:size])
+		s := new(big.Int).SetBytes(sig[size:])
+		if !ecdsa.Verify(k, digest, r, s) {
+			return ErrInvalidCredentials
+		}
+	default:
+		return fmt.Errorf("auth: unsupported algorithm: %s", alg)
+	}
+
+	return nil
+}
@@ -1,5 +1,14 @@
 package service
 
+import (
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/ian-kent/service.go/log"
+)
+
 // Config represents the configuration required for a service
 type Config interface {
 	Namespace() string
@@ -11,6 +20,35 @@ type HTTPConfig interface {
 	BindAddr() string
 	CertFile() string
 	KeyFile() string
+	// Timeout is the default request timeout
+	Timeout() time.Duration
+	// RouteTimeouts overrides the request timeout for routes, keyed
+	// by path prefix or method and path prefix, e.g. "POST /upload".
+	// A zero duration disables the timeout for the route.
+	RouteTimeouts() map[string]time.Duration
+	// ReadTimeout, ReadHeaderTimeout, WriteTimeout and IdleTimeout
+	// configure the http.Server timeouts
+	ReadTimeout() time.Duration
+	ReadHeaderTimeout() time.Duration
+	WriteTimeout() time.Duration
+	IdleTimeout() time.Duration
+	// ShutdownTimeout is how long the service waits for in-flight
+	// requests and shutdown functions when shutting down
+	ShutdownTimeout() time.Duration
+	// MaxHeaderBytes is the maximum size of the request headers
+	MaxHeaderBytes() int
+	// MaxBodySize is the default maximum request body size in bytes
+	MaxBodySize() int64
+	// RouteMaxBodySizes overrides the maximum request body size for
+	// routes, keyed by path prefix or method and path prefix.
+	// A zero size disables the limit for the route.
+	RouteMaxBodySizes() map[string]int64
+	// TrustedProxies are the CIDRs of proxies trusted to set the
+	// Forwarded and X-Forwarded-* headers
+	TrustedProxies() []string
+	// AccessLog is the access log format: "event", "common",
+	// "combined" or "off"
+	AccessLog() string
 }
 
 // APIConfig represents the configuration required for an API service
@@ -23,10 +61,166 @@ type WebConfig interface {
 	HTTPConfig
 }
 
+// DefaultTimeout is the request timeout used if none is configured
+var DefaultTimeout = 1 * time.Second
+
+// Default server timeouts used if none are configured
+//
+// WriteTimeout is disabled by default so long-lived streaming
+// responses aren't interrupted.
+var (
+	DefaultReadTimeout       = 30 * time.Second
+	DefaultReadHeaderTimeout = 10 * time.Second
+	DefaultWriteTimeout      = time.Duration(0)
+	DefaultIdleTimeout       = 120 * time.Second
+	DefaultShutdownTimeout   = 30 * time.Second
+)
+
+// DefaultMaxHeaderBytes is the maximum header size used if none is configured
+var DefaultMaxHeaderBytes = http.DefaultMaxHeaderBytes
+
+// DefaultMaxBodySize is the maximum request body size used if none is configured
+var DefaultMaxBodySize int64 = 10 << 20
+
 type defaultHTTPConfig struct {
-	BindAddr string `env:"BIND_ADDR" flag:"bind-addr" flagDesc:"Bind address"`
-	CertFile string `env:"CERT_FILE" flag:"cert-file" flagDesc:"Certificate file"`
-	KeyFile  string `env:"KEY_FILE" flag:"key-file" flagDesc:"Key file"`
+	BindAddr      string `env:"BIND_ADDR" flag:"bind-addr" flagDesc:"Bind address"`
+	CertFile      string `env:"CERT_FILE" flag:"cert-file" flagDesc:"Certificate file"`
+	KeyFile       string `env:"KEY_FILE" flag:"key-file" flagDesc:"Key file"`
+	Timeout       string `env:"TIMEOUT" flag:"timeout" flagDesc:"Request timeout, e.g. 5s"`
+	RouteTimeouts string `env:"ROUTE_TIMEOUTS" flag:"route-timeouts" flagDesc:"Route timeouts, e.g. /upload=30s,GET /events=0"`
+
+	ReadTimeout       string `env:"READ_TIMEOUT" flag:"read-timeout" flagDesc:"Server read timeout, e.g. 30s"`
+	ReadHeaderTimeout string `env:"READ_HEADER_TIMEOUT" flag:"read-header-timeout" flagDesc:"Server read header timeout, e.g. 10s"`
+	WriteTimeout      string `env:"WRITE_TIMEOUT" flag:"write-timeout" flagDesc:"Server write timeout, e.g. 60s"`
+	IdleTimeout       string `env:"IDLE_TIMEOUT" flag:"idle-timeout" flagDesc:"Server idle timeout, e.g. 120s"`
+	ShutdownTimeout   string `env:"SHUTDOWN_TIMEOUT" flag:"shutdown-timeout" flagDesc:"Graceful shutdown timeout, e.g. 30s"`
+	MaxHeaderBytes    string `env:"MAX_HEADER_BYTES" flag:"max-header-bytes" flagDesc:"Maximum request header size, e.g. 1MB"`
+
+	MaxBodySize       string `env:"MAX_BODY_SIZE" flag:"max-body-size" flagDesc:"Maximum request body size, e.g. 10MB"`
+	RouteMaxBodySizes string `env:"ROUTE_MAX_BODY_SIZES" flag:"route-max-body-sizes" flagDesc:"Route body sizes, e.g. /upload=100MB"`
+
+	TrustedProxies string `env:"TRUSTED_PROXIES" flag:"trusted-proxies" flagDesc:"Trusted proxy CIDRs, e.g. 10.0.0.0/8,127.0.0.1"`
+
+	AccessLog string `env:"ACCESS_LOG" flag:"access-log" flagDesc:"Access log format: event, common, combined or off"`
+}
+
+func (c defaultHTTPConfig) timeout() time.Duration {
+	return parseDuration(c.Timeout, DefaultTimeout)
+}
+
+func (c defaultHTTPConfig) routeTimeouts() map[string]time.Duration {
+	return parseDurations(c.RouteTimeouts)
+}
+
+func (c defaultHTTPConfig) maxHeaderBytes() int {
+	return int(parseSize(c.MaxHeaderBytes, int64(DefaultMaxHeaderBytes)))
+}
+
+func (c defaultHTTPConfig) maxBodySize() int64 {
+	return parseSize(c.MaxBodySize, DefaultMaxBodySize)
+}
+
+func (c defaultHTTPConfig) routeMaxBodySizes() map[string]int64 {
+	return parseSizes(c.RouteMaxBodySizes)
+}
+
+func (c defaultHTTPConfig) trustedProxies() []string {
+	var cidrs []string
+	for _, cidr := range strings.Split(c.TrustedProxies, ",") {
+		if cidr = strings.TrimSpace(cidr); len(cidr) > 0 {
+			cidrs = append(cidrs, cidr)
+		}
+	}
+	return cidrs
+}
+
+// parseDuration parses a duration, returning def if s is empty or invalid
+func parseDuration(s string, def time.Duration) time.Duration {
+	if len(s) == 0 {
+		return def
+	}
+	d, err := time.ParseDuration(s)
+	if err != nil {
+		log.Error(err, log.Data{"duration": s})
+		return def
+	}
+	return d
+}
+
+// parseDurations parses a comma separated list of key=duration pairs
+func parseDurations(s string) map[string]time.Duration {
+	m := make(map[string]time.Duration)
+	for _, kv := range strings.Split(s, ",") {
+		parts := strings.SplitN(kv, "=", 2)
+		if len(parts) != 2 {
+			continue
+		}
+		k, v := strings.TrimSpace(parts[0]), strings.TrimSpace(parts[1])
+		if v == "0" {
+			m[k] = 0
+			continue
+		}
+		d, err := time.ParseDuration(v)
+		if err != nil {
+			log.Error(err, log.Data{"key": k, "duration": v})
+			continue
+		}
+		m[k] = d
+	}
+	return m
+}
+
+var sizeSuffixes = []struct {
+	suffix string
+	size   int64
+}{
+	{"GB", 1 << 30}, {"MB", 1 << 20}, {"KB", 1 << 10}, {"B", 1},
+}
+
+// parseSize parses a size in bytes with an optional KB, MB or GB
+// suffix, returning def if s is empty or invalid
+func parseSize(s string, def int64) int64 {
+	if len(s) == 0 {
+		return def
+	}
+	n, err := parseBytes(s)
+	if err != nil {
+		log.Error(err, log.Data{"size": s})
+		return def
+	}
+	return n
+}
+
+func parseBytes(s string) (int64, error) {
+	s = strings.ToUpper(strings.TrimSpace(s))
+	mult := int64(1)
+	for _, sfx := range sizeSuffixes {
+		if strings.HasSuffix(s, sfx.suffix) {
+			s, mult = strings.TrimSpace(strings.TrimSuffix(s, sfx.suffix)), sfx.size
+			break
+		}
+	}
+	n, err := strconv.ParseInt(s, 10, 64)
+	return n * mult, err
+}
+
+// parseSizes parses a comma separated list of key=size pairs
+func parseSizes(s string) map[string]int64 {
+	m := make(map[string]int64)
+	for _, kv := range strings.Split(s, ",") {
+		parts := strings.SplitN(kv, "=", 2)
+		if len(parts) != 2 {
+			continue
+		}
+		k, v := strings.TrimSpace(parts[0]), strings.TrimSpace(parts[1])
+		n, err := parseBytes(v)
+		if err != nil {
+			log.Error(err, log.Data{"key": k, "size": v})
+			continue
+		}
+		m[k] = n
+	}
+	return m
 }
 
 // DefaultAPIConfig is a default APIConfig implementation
@@ -41,6 +235,56 @@ func (c DefaultAPIConfig) CertFile() string { return c.defaultHTTPConfig.CertFil
 // KeyFile implements HTTPConfig.KeyFile
 func (c DefaultAPIConfig) KeyFile() string { return c.defaultHTTPConfig.KeyFile }
 
+// Timeout implements HTTPConfig.Timeout
+func (c DefaultAPIConfig) Timeout() time.Duration { return c.defaultHTTPConfig.timeout() }
+
+// RouteTimeouts implements HTTPConfig.RouteTimeouts
+func (c DefaultAPIConfig) RouteTimeouts() map[string]time.Duration {
+	return c.defaultHTTPConfig.routeTimeouts()
+}
+
+// ReadTimeout implements HTTPConfig.ReadTimeout
+func (c DefaultAPIConfig) ReadTimeout() time.Duration {
+	return parseDuration(c.defaultHTTPConfig.ReadTimeout, DefaultReadTimeout)
+}
+
+// ReadHeaderTimeout implements HTTPConfig.ReadHeaderTimeout
+func (c DefaultAPIConfig) ReadHeaderTimeout() time.Duration {
+	return parseDuration(c.defaultHTTPConfig.ReadHeaderTimeout, DefaultReadHeaderTimeout)
+}
+
+// WriteTimeout implements HTTPConfig.WriteTimeout
+func (c DefaultAPIConfig) WriteTimeout() time.Duration {
+	return parseDuration(c.defaultHTTPConfig.WriteTimeout, DefaultWriteTimeout)
+}
+
+// IdleTimeout implements HTTPConfig.IdleTimeout
+func (c DefaultAPIConfig) IdleTimeout() time.Duration {
+	return parseDuration(c.defaultHTTPConfig.IdleTimeout, DefaultIdleTimeout)
+}
+
+// ShutdownTimeout implements HTTPConfig.ShutdownTimeout
+func (c DefaultAPIConfig) ShutdownTimeout() time.Duration {
+	return parseDuration(c.defaultHTTPConfig.ShutdownTimeout, DefaultShutdownTimeout)
+}
+
+// MaxHeaderBytes implements HTTPConfig.MaxHeaderBytes
+func (c DefaultAPIConfig) MaxHeaderBytes() int { return c.defaultHTTPConfig.maxHeaderBytes() }
+
+// MaxBodySize implements HTTPConfig.MaxBodySize
+func (c DefaultAPIConfig) MaxBodySize() int64 { return c.defaultHTTPConfig.maxBodySize() }
+
+// RouteMaxBodySizes implements HTTPConfig.RouteMaxBodySizes
+func (c DefaultAPIConfig) RouteMaxBodySizes() map[string]int64 {
+	return c.defaultHTTPConfig.routeMaxBodySizes()
+}
+
+// TrustedProxies implements HTTPConfig.TrustedProxies
+func (c DefaultAPIConfig) TrustedProxies() []string { return c.defaultHTTPConfig.trustedProxies() }
+
+// AccessLog implements HTTPConfig.AccessLog
+func (c DefaultAPIConfig) AccessLog() string { return c.defaultHTTPConfig.AccessLog }
+
 // DefaultWebConfig is a default WebConfig implementation
 type DefaultWebConfig struct {
 	defaultHTTPConfig
@@ -56,3 +300,53 @@ func (c DefaultWebConfig) CertFile() string { return c.defaultHTTPConfig.CertFil
 
 // KeyFile implements HTTPConfig.KeyFile
 func (c DefaultWebConfig) KeyFile() string { return c.defaultHTTPConfig.KeyFile }
+
+// Timeout implements HTTPConfig.Timeout
+func (c DefaultWebConfig) Timeout() time.Duration { return c.defaultHTTPConfig.timeout() }
+
+// RouteTimeouts implements HTTPConfig.RouteTimeouts
+func (c DefaultWebConfig) RouteTimeouts() map[string]time.Duration {
+	return c.defaultHTTPConfig.routeTimeouts()
+}
+
+// ReadTimeout implements HTTPConfig.ReadTimeout
+func (c DefaultWebConfig) ReadTimeout() time.Duration {
+	return parseDuration(c.defaultHTTPConfig.ReadTimeout, DefaultReadTimeout)
+}
+
+// ReadHeaderTimeout implements HTTPConfig.ReadHeaderTimeout
+func (c DefaultWebConfig) ReadHeaderTimeout() time.Duration {
+	return parseDuration(c.defaultHTTPConfig.ReadHeaderTimeout, DefaultReadHeaderTimeout)
+}
+
+// WriteTimeout implements HTTPConfig.WriteTimeout
+func (c DefaultWebConfig) WriteTimeout() time.Duration {
+	return parseDuration(c.defaultHTTPConfig.WriteTimeout, DefaultWriteTimeout)
+}
+
+// IdleTimeout implements HTTPConfig.IdleTimeout
+func (c DefaultWebConfig) IdleTimeout() time.Duration {
+	return parseDuration(c.defaultHTTPConfig.IdleTimeout, DefaultIdleTimeout)
+}
+
+// ShutdownTimeout implements HTTPConfig.ShutdownTimeout
+func (c DefaultWebConfig) ShutdownTimeout() time.Duration {
+	return parseDuration(c.defaultHTTPConfig.ShutdownTimeout, DefaultShutdownTimeout)
+}
+
+// MaxHeaderBytes implements HTTPConfig.MaxHeaderBytes
+func (c DefaultWebConfig) MaxHeaderBytes() int { return c.defaultHTTPConfig.maxHeaderBytes() }
+
+// MaxBodySize implements HTTPConfig.MaxBodySize
+func (c DefaultWebConfig) MaxBodySize() int64 { return c.defaultHTTPConfig.maxBodySize() }
+
+// RouteMaxBodySizes implements HTTPConfig.RouteMaxBodySizes
+func (c DefaultWebConfig) RouteMaxBodySizes() map[string]int64 {
+	return c.defaultHTTPConfig.routeMaxBodySizes()
+}
+
+// TrustedProxies implements HTTPConfig.TrustedProxies
+func (c DefaultWebConfig) TrustedProxies() []string { return c.defaultHTTPConfig.trustedProxies() }
+
+// AccessLog implements HTTPConfig.AccessLog
+func (c DefaultWebConfig) AccessLog() string { return c.defaultHTTPConfig.AccessLog }
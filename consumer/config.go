@@ -6,25 +6,38 @@ import (
 	"strings"
 	"time"
 
-	"github.com/Shopify/sarama"
+	"github.com/ian-kent/service.go/kafka"
+)
+
+// Offset is where a consumer group starts consuming a partition which
+// has no committed offset
+type Offset int
+
+// Initial offsets
+const (
+	// OffsetOldest starts from the oldest message in the partition
+	OffsetOldest Offset = iota
+	// OffsetNewest starts from the next message published to the partition
+	OffsetNewest
 )
 
 // Config represents the configuration required for a consumer service
 type Config interface {
 	ConsumerGroup() string
-	InitialOffset() int64
+	InitialOffset() Offset
 	ProcessingTimeout() time.Duration
-	ZookeeperURL() string
-	ZookeeperChroot() string
+	KafkaBrokers() []string
 	Topics() []string
+	Security() kafka.Security
 }
 
 type defaultConfig struct {
-	ZookeeperURL    string `env:"ZOOKEEPER_URL" flag:"zookeeper-url" flagDesc:"Zookeeper URL"`
-	Topics          string `env:"TOPICS" flag:"topics" flagDesc:"Topics"`
-	Timeout         int    `env:"TIMEOUT" flag:"timeout" flagDesc:"Timeout"`
-	ZookeeperChroot string `env:"ZOOKEEPER_CHROOT" flag:"zookeeper-chroot" flagDesc:"Zookeeper Chroot"`
-	ConsumerGroup   string `env:"CONSUMER_GROUP" flag:"consumer-group" flagDesc:"Consumer group"`
+	KafkaBrokers  string `env:"KAFKA_BROKERS" flag:"kafka-brokers" flagDesc:"Kafka brokers"`
+	Topics        string `env:"TOPICS" flag:"topics" flagDesc:"Topics"`
+	Timeout       int    `env:"TIMEOUT" flag:"timeout" flagDesc:"Timeout"`
+	ConsumerGroup string `env:"CONSUMER_GROUP" flag:"consumer-group" flagDesc:"Consumer group"`
+
+	kafka.SecurityConfig
 }
 
 // DefaultConsumerConfig is a default Config implementation
@@ -40,16 +53,22 @@ func (c DefaultConsumerConfig) ProcessingTimeout() time.Duration {
 	return time.Duration(c.defaultConfig.Timeout) * time.Second
 }
 
-// ZookeeperURL implements Config.ZookeeperURL
-func (c DefaultConsumerConfig) ZookeeperURL() string { return c.defaultConfig.ZookeeperURL }
+// KafkaBrokers implements Config.KafkaBrokers
+//
+// It uses the same KAFKA_BROKERS setting as producer.DefaultProducerConfig
+func (c DefaultConsumerConfig) KafkaBrokers() []string {
+	return strings.Split(c.defaultConfig.KafkaBrokers, ",")
+}
 
 // Topics implements Config.Topics
 func (c DefaultConsumerConfig) Topics() []string { return strings.Split(c.defaultConfig.Topics, ",") }
 
-// ZookeeperChroot implements Config.ZookeeperChroot
-func (c DefaultConsumerConfig) ZookeeperChroot() string {
-	return c.defaultConfig.ZookeeperChroot
-}
-
 // InitialOffset implements Config.InitialOffset
-func (c DefaultConsumerConfig) InitialOffset() int64 { return sarama.OffsetOldest }
+func (c DefaultConsumerConfig) InitialOffset() Offset { return OffsetOldest }
+
+// Security implements Config.Security
+//
+// It uses the same KAFKA_TLS* and KAFKA_SASL* settings as producer.DefaultProducerConfig
+func (c DefaultConsumerConfig) Security() kafka.Security {
+	return c.defaultConfig.SecurityConfig.Security()
+}
@@ -1,101 +1,290 @@
 package consumer
 
 import (
+	"context"
+	"errors"
 	"os"
-	"os/signal"
+	"sync"
 	"time"
 
-	golog "log"
-
-	"github.com/Shopify/sarama"
 	"github.com/ian-kent/service.go/log"
-	"github.com/wvanbergen/kafka/consumergroup"
-	"github.com/wvanbergen/kazoo-go"
+	"github.com/ian-kent/service.go/pubsub"
+	"github.com/twmb/franz-go/pkg/kgo"
 )
 
 var maxAttempts = 100
 var maxExp = 10000
 
-func init() {
-	sarama.Logger = golog.New(os.Stdout, "[Sarama] ", golog.LstdFlags)
-}
+// maxPollRecords is the maximum number of records fetched from the
+// client at once
+var maxPollRecords = 500
 
 // Consumer ...
-type Consumer interface {
-	Start() chan Message
-	Commit(to Message) error
-}
+//
+// It's implemented using Kafka by New, and in-process by the
+// pubsub/memory package.
+type Consumer = pubsub.Subscriber
 
 // Message ...
-type Message interface {
-	Key() []byte
-	Value() []byte
-	Partition() int32
-	Offset() int64
+type Message = pubsub.Message
+
+type kafkaMessage struct {
+	*kgo.Record
 }
 
-type saramaMessage struct {
-	*sarama.ConsumerMessage
+func (km kafkaMessage) Key() []byte      { return km.Record.Key }
+func (km kafkaMessage) Value() []byte    { return km.Record.Value }
+func (km kafkaMessage) Partition() int32 { return km.Record.Partition }
+func (km kafkaMessage) Offset() int64    { return km.Record.Offset }
+func (km kafkaMessage) Topic() string    { return km.Record.Topic }
+
+func (km kafkaMessage) Timestamp() time.Time { return km.Record.Timestamp }
+
+func (km kafkaMessage) Headers() map[string]string {
+	if len(km.Record.Headers) == 0 {
+		return nil
+	}
+	h := make(map[string]string, len(km.Record.Headers))
+	for _, rh := range km.Record.Headers {
+		h[rh.Key] = string(rh.Value)
+	}
+	return h
 }
 
-func (sm saramaMessage) Key() []byte      { return sm.ConsumerMessage.Key }
-func (sm saramaMessage) Value() []byte    { return sm.ConsumerMessage.Value }
-func (sm saramaMessage) Partition() int32 { return sm.ConsumerMessage.Partition }
-func (sm saramaMessage) Offset() int64    { return sm.ConsumerMessage.Offset }
+// Option configures a consumer
+type Option func(*kafkaConsumer)
+
+// OnAssigned sets a function called with the topics and partitions
+// newly assigned to the consumer by each rebalance
+func OnAssigned(f func(claims map[string][]int32)) Option {
+	return func(kc *kafkaConsumer) { kc.onAssigned = f }
+}
+
+// OnRevoked sets a function called with the topics and partitions
+// revoked from the consumer by each rebalance, or lost because the
+// consumer left the group
+//
+// Messages from revoked partitions which are committed after the
+// function returns aren't committed.
+func OnRevoked(f func(claims map[string][]int32)) Option {
+	return func(kc *kafkaConsumer) { kc.onRevoked = f }
+}
+
+// ErrNoSession is returned when committing a message from a partition
+// which isn't assigned to the consumer, for example because it was
+// revoked by a rebalance
+var ErrNoSession = errors.New("consumer: partition not assigned to consumer")
 
 type kafkaConsumer struct {
-	consumerGroup *consumergroup.ConsumerGroup
-	sigChan       chan os.Signal
+	client *kgo.Client
+	cancel context.CancelFunc
+	done   chan struct{}
+
+	mu       sync.Mutex
+	assigned map[pubsub.TopicPartition]bool
+	// pending are messages fetched but not yet delivered, held while
+	// their partition is paused
+	pending map[pubsub.TopicPartition][]*kgo.Record
+	marked  map[pubsub.TopicPartition]int64
+	hwm     map[pubsub.TopicPartition]int64
+	paused  map[pubsub.TopicPartition]bool
+	// changed is closed and replaced when partitions are paused or resumed
+	changed chan struct{}
+
+	onAssigned func(claims map[string][]int32)
+	onRevoked  func(claims map[string][]int32)
 
 	Config
 }
 
-// New ...
-func New(config Config) Consumer {
-	return &kafkaConsumer{
-		Config: config,
+// New returns a consumer using a Kafka consumer group
+//
+// Partitions are assigned using the cooperative sticky strategy, so a
+// rebalance only revokes the partitions which move to another consumer,
+// and the consumer continues to process its other partitions while the
+// group rebalances.
+func New(config Config, opts ...Option) Consumer {
+	kc := &kafkaConsumer{
+		Config:   config,
+		done:     make(chan struct{}),
+		assigned: make(map[pubsub.TopicPartition]bool),
+		pending:  make(map[pubsub.TopicPartition][]*kgo.Record),
+		marked:   make(map[pubsub.TopicPartition]int64),
+		hwm:      make(map[pubsub.TopicPartition]int64),
+		paused:   make(map[pubsub.TopicPartition]bool),
+		changed:  make(chan struct{}),
 	}
+	for _, opt := range opts {
+		opt(kc)
+	}
+	return kc
 }
 
 func (kc *kafkaConsumer) Commit(to Message) error {
-	return kc.consumerGroup.CommitUpto(to.(saramaMessage).ConsumerMessage)
+	km, ok := to.(kafkaMessage)
+	if !ok {
+		return errors.New("consumer: message wasn't consumed from kafka")
+	}
+
+	kc.mu.Lock()
+	defer kc.mu.Unlock()
+
+	tp := pubsub.TopicPartition{Topic: km.Topic(), Partition: km.Partition()}
+	if !kc.assigned[tp] {
+		return ErrNoSession
+	}
+	// marked offsets are committed periodically, and when partitions
+	// are revoked or the consumer is closed
+	kc.client.MarkCommitRecords(km.Record)
+
+	if km.Offset()+1 > kc.marked[tp] {
+		kc.marked[tp] = km.Offset() + 1
+	}
+	return nil
 }
 
-func (kc *kafkaConsumer) Start() chan Message {
-	kc.sigChan = make(chan os.Signal, 1)
-	msgChan := make(chan Message, 1)
+// Pause implements Consumer.Pause
+//
+// Paused partitions aren't fetched, and messages already fetched from
+// them are held until they're resumed, without affecting other
+// partitions. Paused partitions stay paused if they're reassigned by
+// a rebalance.
+func (kc *kafkaConsumer) Pause(partitions ...pubsub.TopicPartition) {
+	kc.mu.Lock()
+	defer kc.mu.Unlock()
 
-	signal.Notify(kc.sigChan, os.Interrupt)
-	go func() {
-		<-kc.sigChan
-		kc.consumerGroup.Close()
-		close(msgChan)
-	}()
+	if len(partitions) == 0 {
+		for tp := range kc.assigned {
+			partitions = append(partitions, tp)
+		}
+	}
+	for _, tp := range partitions {
+		kc.paused[tp] = true
+	}
+	if kc.client != nil {
+		kc.client.PauseFetchPartitions(topicPartitions(partitions))
+	}
+	kc.broadcast()
+}
+
+// Resume implements Consumer.Resume
+func (kc *kafkaConsumer) Resume(partitions ...pubsub.TopicPartition) {
+	kc.mu.Lock()
+	defer kc.mu.Unlock()
+
+	if len(partitions) == 0 {
+		for tp := range kc.paused {
+			partitions = append(partitions, tp)
+		}
+	}
+	for _, tp := range partitions {
+		delete(kc.paused, tp)
+	}
+	if kc.client != nil {
+		kc.client.ResumeFetchPartitions(topicPartitions(partitions))
+	}
+	kc.broadcast()
+}
+
+// broadcast wakes the poll loop when partitions are paused or resumed; kc.mu must be held
+func (kc *kafkaConsumer) broadcast() {
+	close(kc.changed)
+	kc.changed = make(chan struct{})
+}
+
+// Lag implements Consumer.Lag
+//
+// Partitions are only included once they've been fetched and the
+// committed offset is known, which may not be until a message has
+// been committed if the group has no committed offset.
+func (kc *kafkaConsumer) Lag() map[pubsub.TopicPartition]int64 {
+	kc.mu.Lock()
+	client := kc.client
+	kc.mu.Unlock()
+
+	// the client's lock is taken without holding kc.mu, which is held
+	// by rebalance callbacks
+	var committed map[string]map[int32]kgo.EpochOffset
+	if client != nil {
+		committed = client.CommittedOffsets()
+	}
+
+	kc.mu.Lock()
+	defer kc.mu.Unlock()
+
+	lag := make(map[pubsub.TopicPartition]int64, len(kc.assigned))
+	for tp := range kc.assigned {
+		hwm, ok := kc.hwm[tp]
+		if !ok {
+			continue
+		}
+		offset := int64(-1)
+		if eo, ok := committed[tp.Topic][tp.Partition]; ok {
+			offset = eo.Offset
+		}
+		if m, ok := kc.marked[tp]; ok && m > offset {
+			offset = m
+		}
+		if offset < 0 {
+			continue
+		}
+		l := hwm - offset
+		if l < 0 {
+			l = 0
+		}
+		lag[tp] = l
+	}
+	return lag
+}
+
+// Close leaves the consumer group, committing marked offsets
+func (kc *kafkaConsumer) Close() error {
+	if kc.cancel == nil {
+		return nil
+	}
+	kc.cancel()
+	<-kc.done
+	kc.client.Close()
+	return nil
+}
 
-	cfg := consumergroup.NewConfig()
+func (kc *kafkaConsumer) Start() chan Message {
+	msgChan := make(chan Message, 1)
 
-	cfg.Offsets.Initial = kc.Config.InitialOffset()
-	cfg.Offsets.ProcessingTimeout = kc.Config.ProcessingTimeout()
+	opts := []kgo.Opt{
+		kgo.SeedBrokers(kc.Config.KafkaBrokers()...),
+		kgo.ConsumerGroup(kc.Config.ConsumerGroup()),
+		kgo.ConsumeTopics(kc.Config.Topics()...),
+		kgo.Balancers(kgo.CooperativeStickyBalancer()),
+		kgo.ConsumeResetOffset(resetOffset(kc.Config.InitialOffset())),
+		kgo.AutoCommitMarks(),
+		kgo.OnPartitionsAssigned(kc.assign),
+		kgo.OnPartitionsRevoked(kc.revoke),
+		kgo.OnPartitionsLost(kc.lose),
+	}
+	if t := kc.Config.ProcessingTimeout(); t > 0 {
+		opts = append(opts, kgo.RebalanceTimeout(t))
+	}
+	security, err := kc.Config.Security().ClientOptions()
+	if err != nil {
+		log.Error(err, nil)
+		os.Exit(1)
+	}
+	opts = append(opts, security...)
 
-	var zookeeperNodes []string
-	url := kc.Config.ZookeeperURL()
-	if chroot := kc.Config.ZookeeperChroot(); len(chroot) > 0 {
-		url += "/" + chroot
+	client, err := kgo.NewClient(opts...)
+	if err != nil {
+		log.Error(err, nil)
+		os.Exit(1)
 	}
-	zookeeperNodes, cfg.Zookeeper.Chroot = kazoo.ParseConnectionString(url)
 
-	var cg *consumergroup.ConsumerGroup
-	var err error
 	var attempts, curExp int
 
 	for {
 		attempts++
-		cg, err = consumergroup.JoinConsumerGroup(
-			kc.Config.ConsumerGroup(),
-			kc.Config.Topics(),
-			zookeeperNodes,
-			cfg,
-		)
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		err = client.Ping(ctx)
+		cancel()
 		if err != nil {
 			log.Error(err, nil)
 			if attempts > maxAttempts {
@@ -116,21 +305,175 @@ func (kc *kafkaConsumer) Start() chan Message {
 		break
 	}
 
-	kc.consumerGroup = cg
+	kc.mu.Lock()
+	kc.client = client
+	// partitions paused before the consumer started
+	var paused []pubsub.TopicPartition
+	for tp := range kc.paused {
+		paused = append(paused, tp)
+	}
+	client.PauseFetchPartitions(topicPartitions(paused))
+	kc.mu.Unlock()
+
+	var ctx context.Context
+	ctx, kc.cancel = context.WithCancel(context.Background())
+
+	log.Debug("joining consumer group", log.Data{"group": kc.Config.ConsumerGroup(), "topics": kc.Config.Topics()})
 
 	go func() {
-		for err := range cg.Errors() {
-			log.Error(err, nil)
+		defer close(kc.done)
+		defer close(msgChan)
+
+		for {
+			if r := kc.next(); r != nil {
+				select {
+				case msgChan <- kafkaMessage{r}:
+				case <-ctx.Done():
+					return
+				}
+				continue
+			}
+			if !kc.poll(ctx) {
+				return
+			}
 		}
 	}()
 
+	return msgChan
+}
+
+// next returns the next fetched message from a partition which isn't
+// paused, or nil if there isn't one
+func (kc *kafkaConsumer) next() *kgo.Record {
+	kc.mu.Lock()
+	defer kc.mu.Unlock()
+
+	for tp, rs := range kc.pending {
+		if kc.paused[tp] {
+			continue
+		}
+		if len(rs) == 1 {
+			delete(kc.pending, tp)
+		} else {
+			kc.pending[tp] = rs[1:]
+		}
+		return rs[0]
+	}
+	return nil
+}
+
+// poll fetches messages until some are available, or partitions are
+// paused or resumed, and returns false once ctx is done
+func (kc *kafkaConsumer) poll(ctx context.Context) bool {
+	kc.mu.Lock()
+	changed := kc.changed
+	kc.mu.Unlock()
+
+	pctx, cancel := context.WithCancel(ctx)
+	defer cancel()
 	go func() {
-		log.Debug("waiting for messages", nil)
-		for m := range cg.Messages() {
-			log.Debug("message", log.Data{"msg": m})
-			msgChan <- saramaMessage{m}
+		select {
+		case <-changed:
+			cancel()
+		case <-pctx.Done():
 		}
 	}()
 
-	return msgChan
+	fetches := kc.client.PollRecords(pctx, maxPollRecords)
+	if ctx.Err() != nil || fetches.IsClientClosed() {
+		return false
+	}
+
+	fetches.EachError(func(topic string, partition int32, err error) {
+		if errors.Is(err, context.Canceled) {
+			return
+		}
+		log.Error(err, log.Data{"topic": topic, "partition": partition})
+	})
+
+	kc.mu.Lock()
+	defer kc.mu.Unlock()
+
+	fetches.EachPartition(func(p kgo.FetchTopicPartition) {
+		tp := pubsub.TopicPartition{Topic: p.Topic, Partition: p.Partition}
+		if !kc.assigned[tp] {
+			return
+		}
+		kc.hwm[tp] = p.HighWatermark
+		kc.pending[tp] = append(kc.pending[tp], p.Records...)
+	})
+	return true
+}
+
+func (kc *kafkaConsumer) assign(_ context.Context, _ *kgo.Client, assigned map[string][]int32) {
+	log.Debug("partitions assigned", log.Data{"claims": assigned})
+
+	kc.mu.Lock()
+	for topic, partitions := range assigned {
+		for _, p := range partitions {
+			kc.assigned[pubsub.TopicPartition{Topic: topic, Partition: p}] = true
+		}
+	}
+	kc.mu.Unlock()
+
+	if kc.onAssigned != nil {
+		kc.onAssigned(assigned)
+	}
+}
+
+func (kc *kafkaConsumer) revoke(ctx context.Context, client *kgo.Client, revoked map[string][]int32) {
+	log.Debug("partitions revoked", log.Data{"claims": revoked})
+	if kc.onRevoked != nil && len(revoked) > 0 {
+		kc.onRevoked(revoked)
+	}
+
+	kc.mu.Lock()
+	defer kc.mu.Unlock()
+
+	// the commit is made while holding the lock so no more messages
+	// are marked for the revoked partitions
+	if err := client.CommitMarkedOffsets(ctx); err != nil {
+		log.Error(err, nil)
+	}
+	kc.remove(revoked)
+}
+
+func (kc *kafkaConsumer) lose(_ context.Context, _ *kgo.Client, lost map[string][]int32) {
+	log.Debug("partitions lost", log.Data{"claims": lost})
+	if kc.onRevoked != nil && len(lost) > 0 {
+		kc.onRevoked(lost)
+	}
+
+	kc.mu.Lock()
+	defer kc.mu.Unlock()
+	kc.remove(lost)
+}
+
+// remove forgets partitions which are no longer assigned; kc.mu must be held
+func (kc *kafkaConsumer) remove(partitions map[string][]int32) {
+	for topic, ps := range partitions {
+		for _, p := range ps {
+			tp := pubsub.TopicPartition{Topic: topic, Partition: p}
+			delete(kc.assigned, tp)
+			delete(kc.pending, tp)
+			delete(kc.marked, tp)
+			delete(kc.hwm, tp)
+		}
+	}
+}
+
+func topicPartitions(partitions []pubsub.TopicPartition) map[string][]int32 {
+	m := make(map[string][]int32)
+	for _, tp := range partitions {
+		m[tp.Topic] = append(m[tp.Topic], tp.Partition)
+	}
+	return m
+}
+
+// resetOffset converts Config.InitialOffset to a client offset
+func resetOffset(offset Offset) kgo.Offset {
+	if offset == OffsetNewest {
+		return kgo.NewOffset().AtEnd()
+	}
+	return kgo.NewOffset().AtStart()
 }
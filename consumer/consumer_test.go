@@ -1,27 +1,48 @@
 package consumer
 
 import (
-	"log"
-	"os"
+	"context"
 	"testing"
+	"time"
 
-	"github.com/Shopify/sarama"
+	"github.com/ian-kent/service.go/producer"
+	"github.com/ian-kent/service.go/pubsub/memory"
 )
 
 func TestConsumer(t *testing.T) {
-	sarama.Logger = log.New(os.Stdout, "", log.LstdFlags)
-
-	cfg := defaultConfig{
-		ZookeeperURL:    "localhost",
-		Topics:          []string{"ikent-test"},
-		Timeout:         60,
-		ZookeeperChroot: "kafka",
-		ConsumerGroup:   "ikent-test",
+	broker := memory.NewBroker()
+	broker.CreateTopic("ikent-test", 2)
+
+	for _, v := range []string{"a", "b", "c", "d"} {
+		if _, _, err := broker.Send(producer.NewStringMessage("ikent-test", v, v)); err != nil {
+			t.Fatal(err)
+		}
 	}
-	consumer := New(DefaultConfig{cfg})
 
-	for event := range consumer.Start() {
-		log.Printf("%+v", event)
-		log.Printf("%+v", event.Value)
+	c := broker.Subscriber("ikent-test", "ikent-test")
+	defer c.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	var events []Message
+	Handle(ctx, c, func(ctx context.Context, msg Message) error {
+		events = append(events, msg)
+		if len(events) == 4 {
+			cancel()
+		}
+		return nil
+	}, HandleOptions{})
+
+	if len(events) != 4 {
+		t.Fatalf("expected 4 events, got %d", len(events))
+	}
+
+	var committed int64
+	for p := int32(0); p < 2; p++ {
+		committed += broker.Committed("ikent-test", "ikent-test", p)
+	}
+	if committed != 4 {
+		t.Errorf("expected all messages to be committed, got %d", committed)
 	}
 }
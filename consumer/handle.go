@@ -0,0 +1,316 @@
+package consumer
+
+import (
+	"context"
+	"hash/fnv"
+	"sync"
+	"time"
+
+	"github.com/ian-kent/service.go/handlers/requestID"
+	"github.com/ian-kent/service.go/log"
+	"github.com/ian-kent/service.go/metrics"
+	"github.com/ian-kent/service.go/pubsub"
+)
+
+// Handler processes a message
+//
+// Returning an error doesn't stop the consumer. The error is logged
+// and the message is committed, so handlers which need messages to be
+// retried should be wrapped, for example using Retry.
+type Handler func(ctx context.Context, msg Message) error
+
+// Ordering determines which messages are processed in order
+type Ordering int
+
+const (
+	// ByPartition processes messages from the same partition in order
+	ByPartition Ordering = iota
+	// ByKey processes messages with the same key in order, allowing
+	// messages with different keys in the same partition to be
+	// processed concurrently
+	ByKey
+)
+
+// HandleOptions configures Handle
+type HandleOptions struct {
+	// Concurrency is the number of messages processed at once, 1 if zero
+	Concurrency int
+	// Ordering determines which messages are processed in order
+	Ordering Ordering
+	// QueueSize is the number of messages buffered for each worker, 1 if zero
+	//
+	// When a worker's queue is full, the partition of the next message
+	// for it is paused until the queue has space.
+	QueueSize int
+	// DrainTimeout is how long queued and in-flight messages are
+	// processed for once Handle is stopping, DefaultDrainTimeout if zero
+	DrainTimeout time.Duration
+}
+
+// DefaultDrainTimeout is the drain timeout used if HandleOptions.DrainTimeout is zero
+var DefaultDrainTimeout = 10 * time.Second
+
+// Handle starts the consumer and calls h for each message
+//
+// The request ID and trace context propagated in the message headers
+// are restored into the context passed to h.
+//
+// Messages are processed concurrently, but messages from the same
+// partition (or with the same key) are processed in order. Offsets are
+// only committed once all earlier messages in the partition have been
+// processed.
+//
+// Messages for workers whose queues are full are held back, and their
+// partitions are paused, so other partitions continue to be consumed.
+//
+// Handle returns when ctx is cancelled or the consumer is closed, once
+// queued and in-flight messages have been processed. The context passed
+// to h isn't cancelled with ctx, so messages can be processed while
+// draining, but it is cancelled once DrainTimeout has passed. Messages
+// which haven't been processed by then aren't committed, and will be
+// consumed again.
+func Handle(ctx context.Context, c Consumer, h Handler, opts HandleOptions) error {
+	if opts.Concurrency < 1 {
+		opts.Concurrency = 1
+	}
+	if opts.QueueSize < 1 {
+		opts.QueueSize = 1
+	}
+	if opts.DrainTimeout <= 0 {
+		opts.DrainTimeout = DefaultDrainTimeout
+	}
+
+	// hctx is passed to the handler, and is only cancelled once the
+	// drain timeout has passed after Handle starts stopping
+	hctx, hcancel := context.WithCancel(context.WithoutCancel(ctx))
+	defer hcancel()
+
+	tracker := newCommitTracker(c)
+	// ready is signalled when a worker takes a message from its queue
+	ready := make(chan struct{}, 1)
+
+	var wg sync.WaitGroup
+	queues := make([]chan *tracked, opts.Concurrency)
+	for i := range queues {
+		queues[i] = make(chan *tracked, opts.QueueSize)
+		wg.Add(1)
+		go func(q chan *tracked) {
+			defer wg.Done()
+			for t := range q {
+				select {
+				case ready <- struct{}{}:
+				default:
+				}
+				if hctx.Err() != nil {
+					// drain timed out, the message will be consumed again
+					continue
+				}
+				mctx := pubsub.Extract(hctx, t.msg)
+				err := h(mctx, t.msg)
+				if err != nil {
+					if hctx.Err() != nil {
+						continue
+					}
+					log.ErrorC(requestID.FromContext(mctx), err, log.Data{"topic": t.msg.Topic(), "partition": t.msg.Partition(), "offset": t.msg.Offset()})
+				}
+				tracker.done(t)
+			}
+		}(queues[i])
+	}
+
+	defer func() {
+		drain := time.AfterFunc(opts.DrainTimeout, hcancel)
+		defer drain.Stop()
+		for _, q := range queues {
+			close(q)
+		}
+		wg.Wait()
+	}()
+
+	bp := newBackpressure(c, queues)
+
+	msgs := c.Start()
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-ready:
+			bp.drain()
+		case msg, ok := <-msgs:
+			if !ok {
+				bp.flush(ctx)
+				return nil
+			}
+			t := tracker.add(msg)
+			bp.queue(worker(msg, opts, len(queues)), t)
+		}
+	}
+}
+
+// PausedMetricName is the name of the metric incremented each time
+// Handle pauses a partition because a worker's queue is full
+var PausedMetricName = "consumer_partitions_paused"
+
+// backpressure holds messages for workers whose queues are full, and
+// pauses their partitions until the held messages have been queued
+type backpressure struct {
+	consumer Consumer
+	queues   []chan *tracked
+	held     [][]*tracked
+	// pausedBy are the partitions paused for each worker, and paused
+	// counts the workers each partition is paused for
+	pausedBy []map[pubsub.TopicPartition]bool
+	paused   map[pubsub.TopicPartition]int
+}
+
+func newBackpressure(c Consumer, queues []chan *tracked) *backpressure {
+	bp := &backpressure{
+		consumer: c,
+		queues:   queues,
+		held:     make([][]*tracked, len(queues)),
+		pausedBy: make([]map[pubsub.TopicPartition]bool, len(queues)),
+		paused:   make(map[pubsub.TopicPartition]int),
+	}
+	for i := range bp.pausedBy {
+		bp.pausedBy[i] = make(map[pubsub.TopicPartition]bool)
+	}
+	return bp
+}
+
+// queue queues the message for worker w, or holds it and pauses its
+// partition if the worker's queue is full
+func (bp *backpressure) queue(w int, t *tracked) {
+	// held messages are queued first to keep them in order
+	if len(bp.held[w]) == 0 {
+		select {
+		case bp.queues[w] <- t:
+			return
+		default:
+		}
+	}
+	bp.held[w] = append(bp.held[w], t)
+
+	tp := pubsub.TopicPartition{Topic: t.msg.Topic(), Partition: t.msg.Partition()}
+	if bp.pausedBy[w][tp] {
+		return
+	}
+	bp.pausedBy[w][tp] = true
+	bp.paused[tp]++
+	if bp.paused[tp] == 1 {
+		log.Debug("pausing partition, worker queue is full", log.Data{"partition": tp.String()})
+		metrics.Incr(PausedMetricName)
+		bp.consumer.Pause(tp)
+	}
+}
+
+// drain queues held messages while the workers' queues have space,
+// and resumes partitions once all messages held for them are queued
+func (bp *backpressure) drain() {
+	for w := range bp.held {
+	queue:
+		for len(bp.held[w]) > 0 {
+			select {
+			case bp.queues[w] <- bp.held[w][0]:
+				bp.held[w] = bp.held[w][1:]
+			default:
+				break queue
+			}
+		}
+		if len(bp.held[w]) > 0 {
+			continue
+		}
+
+		for tp := range bp.pausedBy[w] {
+			delete(bp.pausedBy[w], tp)
+			bp.paused[tp]--
+			if bp.paused[tp] == 0 {
+				delete(bp.paused, tp)
+				log.Debug("resuming partition", log.Data{"partition": tp.String()})
+				bp.consumer.Resume(tp)
+			}
+		}
+	}
+}
+
+// flush queues all held messages, waiting for space in the queues
+func (bp *backpressure) flush(ctx context.Context) {
+	for w := range bp.held {
+		for _, t := range bp.held[w] {
+			select {
+			case bp.queues[w] <- t:
+			case <-ctx.Done():
+				return
+			}
+		}
+		bp.held[w] = nil
+	}
+}
+
+// worker returns the worker which processes the message
+func worker(msg Message, opts HandleOptions, n int) int {
+	if n == 1 {
+		return 0
+	}
+	h := fnv.New32a()
+	if opts.Ordering == ByKey {
+		h.Write(msg.Key())
+	} else {
+		p := msg.Partition()
+		h.Write([]byte{byte(p >> 24), byte(p >> 16), byte(p >> 8), byte(p)})
+	}
+	return int(h.Sum32() % uint32(n))
+}
+
+type tracked struct {
+	msg  Message
+	done bool
+}
+
+// commitTracker commits the highest offset in each partition for
+// which all earlier messages have been processed
+type commitTracker struct {
+	mu         sync.Mutex
+	consumer   Consumer
+	partitions map[pubsub.TopicPartition][]*tracked
+}
+
+func newCommitTracker(c Consumer) *commitTracker {
+	return &commitTracker{
+		consumer:   c,
+		partitions: make(map[pubsub.TopicPartition][]*tracked),
+	}
+}
+
+func (ct *commitTracker) add(msg Message) *tracked {
+	ct.mu.Lock()
+	defer ct.mu.Unlock()
+
+	t := &tracked{msg: msg}
+	tp := pubsub.TopicPartition{Topic: msg.Topic(), Partition: msg.Partition()}
+	ct.partitions[tp] = append(ct.partitions[tp], t)
+	return t
+}
+
+func (ct *commitTracker) done(t *tracked) {
+	ct.mu.Lock()
+	defer ct.mu.Unlock()
+
+	t.done = true
+
+	p := pubsub.TopicPartition{Topic: t.msg.Topic(), Partition: t.msg.Partition()}
+	pending := ct.partitions[p]
+
+	var commit *tracked
+	for len(pending) > 0 && pending[0].done {
+		commit, pending = pending[0], pending[1:]
+	}
+	ct.partitions[p] = pending
+
+	if commit == nil {
+		return
+	}
+	// commits are made while holding the lock so they're never out of order
+	if err := ct.consumer.Commit(commit.msg); err != nil {
+		log.Error(err, log.Data{"partition": p.String(), "offset": commit.msg.Offset()})
+	}
+}
@@ -0,0 +1,216 @@
+package consumer
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/ian-kent/service.go/pubsub"
+)
+
+type testMessage struct {
+	key       string
+	partition int32
+	offset    int64
+}
+
+func (m testMessage) Key() []byte      { return []byte(m.key) }
+func (m testMessage) Value() []byte    { return nil }
+func (m testMessage) Partition() int32 { return m.partition }
+func (m testMessage) Offset() int64    { return m.offset }
+func (m testMessage) Topic() string    { return "test" }
+
+func (m testMessage) Headers() map[string]string { return nil }
+func (m testMessage) Timestamp() time.Time       { return time.Time{} }
+
+type testConsumer struct {
+	msgs chan Message
+
+	mu      sync.Mutex
+	commits map[int32][]int64
+	paused  []pubsub.TopicPartition
+	resumed []pubsub.TopicPartition
+}
+
+func (c *testConsumer) Start() chan Message { return c.msgs }
+
+func (c *testConsumer) Close() error { return nil }
+
+func (c *testConsumer) Pause(tps ...pubsub.TopicPartition) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.paused = append(c.paused, tps...)
+}
+
+func (c *testConsumer) Resume(tps ...pubsub.TopicPartition) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.resumed = append(c.resumed, tps...)
+}
+
+func (c *testConsumer) Lag() map[pubsub.TopicPartition]int64 { return nil }
+
+func (c *testConsumer) Commit(m Message) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.commits[m.Partition()] = append(c.commits[m.Partition()], m.Offset())
+	return nil
+}
+
+func TestHandleOrderedCommits(t *testing.T) {
+	c := &testConsumer{msgs: make(chan Message, 10), commits: make(map[int32][]int64)}
+	for i := int64(0); i < 4; i++ {
+		c.msgs <- testMessage{key: string(rune('a' + i)), partition: 0, offset: i}
+	}
+	close(c.msgs)
+
+	var mu sync.Mutex
+	var order []int64
+
+	Handle(context.Background(), c, func(ctx context.Context, msg Message) error {
+		// the first message finishes last
+		if msg.Offset() == 0 {
+			time.Sleep(50 * time.Millisecond)
+		}
+		mu.Lock()
+		order = append(order, msg.Offset())
+		mu.Unlock()
+		return nil
+	}, HandleOptions{Concurrency: 4, Ordering: ByKey})
+
+	if len(order) != 4 || order[len(order)-1] != 0 {
+		t.Errorf("expected messages to be processed concurrently, got %v", order)
+	}
+
+	commits := c.commits[0]
+	if len(commits) == 0 || commits[len(commits)-1] != 3 {
+		t.Fatalf("expected offset 3 to be committed, got %v", commits)
+	}
+	for i := 1; i < len(commits); i++ {
+		if commits[i] < commits[i-1] {
+			t.Errorf("commits out of order: %v", commits)
+		}
+	}
+	if commits[0] < 3 {
+		t.Errorf("expected no commits before offset 0 was processed, got %v", commits)
+	}
+}
+
+func TestHandlePausesWhenQueueFull(t *testing.T) {
+	c := &testConsumer{msgs: make(chan Message), commits: make(map[int32][]int64)}
+	release := make(chan struct{})
+	handled := make(chan int64, 4)
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		Handle(context.Background(), c, func(ctx context.Context, msg Message) error {
+			<-release
+			handled <- msg.Offset()
+			return nil
+		}, HandleOptions{Concurrency: 1, QueueSize: 1})
+	}()
+
+	// the first message is being handled and the second is queued,
+	// so the third is held back and its partition paused
+	for i := int64(0); i < 3; i++ {
+		c.msgs <- testMessage{partition: 1, offset: i}
+	}
+	for i := 0; i < 100; i++ {
+		c.mu.Lock()
+		n := len(c.paused)
+		c.mu.Unlock()
+		if n > 0 {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	c.mu.Lock()
+	if len(c.paused) != 1 || c.paused[0] != (pubsub.TopicPartition{Topic: "test", Partition: 1}) {
+		t.Errorf("expected partition to be paused, got %v", c.paused)
+	}
+	c.mu.Unlock()
+
+	close(release)
+	for i := int64(0); i < 3; i++ {
+		if o := <-handled; o != i {
+			t.Errorf("expected offset %d, got %d", i, o)
+		}
+	}
+	close(c.msgs)
+	<-done
+
+	if len(c.resumed) != 1 || c.resumed[0] != c.paused[0] {
+		t.Errorf("expected partition to be resumed, got %v", c.resumed)
+	}
+}
+
+func TestHandleDrains(t *testing.T) {
+	c := &testConsumer{msgs: make(chan Message), commits: make(map[int32][]int64)}
+	ctx, cancel := context.WithCancel(context.Background())
+	started := make(chan struct{}, 2)
+	release := make(chan struct{})
+
+	var mu sync.Mutex
+	var errs []error
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		Handle(ctx, c, func(hctx context.Context, msg Message) error {
+			started <- struct{}{}
+			<-release
+			mu.Lock()
+			errs = append(errs, hctx.Err())
+			mu.Unlock()
+			return nil
+		}, HandleOptions{Concurrency: 1, QueueSize: 1})
+	}()
+
+	// the first message is in-flight and the second is queued
+	c.msgs <- testMessage{partition: 0, offset: 0}
+	<-started
+	c.msgs <- testMessage{partition: 0, offset: 1}
+
+	cancel()
+	close(release)
+	<-done
+
+	if len(errs) != 2 || errs[0] != nil || errs[1] != nil {
+		t.Errorf("expected both messages to be handled without cancellation, got %v", errs)
+	}
+	if commits := c.commits[0]; len(commits) == 0 || commits[len(commits)-1] != 1 {
+		t.Errorf("expected drained messages to be committed, got %v", commits)
+	}
+}
+
+func TestHandleDrainTimeout(t *testing.T) {
+	c := &testConsumer{msgs: make(chan Message), commits: make(map[int32][]int64)}
+	ctx, cancel := context.WithCancel(context.Background())
+	started := make(chan struct{})
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		Handle(ctx, c, func(hctx context.Context, msg Message) error {
+			close(started)
+			<-hctx.Done()
+			return hctx.Err()
+		}, HandleOptions{DrainTimeout: 10 * time.Millisecond})
+	}()
+
+	c.msgs <- testMessage{partition: 0, offset: 0}
+	<-started
+	cancel()
+
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("expected Handle to return after the drain timeout")
+	}
+	if len(c.commits[0]) > 0 {
+		t.Errorf("expected unfinished message not to be committed, got %v", c.commits[0])
+	}
+}
@@ -0,0 +1,86 @@
+package consumer
+
+import (
+	"context"
+	"expvar"
+	"time"
+
+	"github.com/ian-kent/service.go/log"
+	"github.com/ian-kent/service.go/metrics"
+)
+
+// LagMetricName is the name of the map metric holding the lag of each
+// assigned partition, keyed by topic/partition
+var LagMetricName = "consumer_lag"
+
+// MaxLagMetricName is the name of the gauge holding the highest lag
+// of any assigned partition
+var MaxLagMetricName = "consumer_lag_max"
+
+// RecordLag sets the lag metrics for the consumer's assigned
+// partitions, and returns the highest lag
+func RecordLag(c Consumer) int64 {
+	lag := c.Lag()
+
+	m := metrics.Map(LagMetricName)
+
+	var max int64
+	assigned := make(map[string]bool, len(lag))
+	for tp, l := range lag {
+		assigned[tp.String()] = true
+		v := new(expvar.Int)
+		v.Set(l)
+		m.Set(tp.String(), v)
+		if l > max {
+			max = l
+		}
+	}
+
+	// partitions may have been revoked since the last update, remove
+	// them without clearing the map so scrapes always see the others
+	var revoked []string
+	m.Do(func(kv expvar.KeyValue) {
+		if !assigned[kv.Key] {
+			revoked = append(revoked, kv.Key)
+		}
+	})
+	for _, k := range revoked {
+		m.Delete(k)
+	}
+	metrics.Set(MaxLagMetricName, max)
+
+	return max
+}
+
+// MonitorLag records the consumer's lag every interval until ctx is done
+func MonitorLag(ctx context.Context, c Consumer, interval time.Duration) {
+	t := time.NewTicker(interval)
+	defer t.Stop()
+
+	for {
+		RecordLag(c)
+		select {
+		case <-ctx.Done():
+			return
+		case <-t.C:
+		}
+	}
+}
+
+// LagHealthy returns a healthcheck function which reports the consumer
+// as unhealthy while the lag of any assigned partition is above threshold
+//
+// For example:
+//
+//	healthcheck.Register(svc.Router(), "/healthcheck", consumer.LagHealthy(c, 10000))
+func LagHealthy(c Consumer, threshold int64) func() bool {
+	return func() bool {
+		for tp, l := range c.Lag() {
+			if l > threshold {
+				log.Debug("consumer lag above threshold", log.Data{"partition": tp.String(), "lag": l, "threshold": threshold})
+				return false
+			}
+		}
+		return true
+	}
+}
@@ -0,0 +1,54 @@
+package consumer
+
+import (
+	"expvar"
+	"testing"
+
+	"github.com/ian-kent/service.go/metrics"
+	"github.com/ian-kent/service.go/producer"
+	"github.com/ian-kent/service.go/pubsub/memory"
+)
+
+func TestLag(t *testing.T) {
+	broker := memory.NewBroker()
+	broker.CreateTopic("lag-test", 1)
+	for _, v := range []string{"a", "b", "c", "d"} {
+		broker.Send(producer.NewStringMessage("lag-test", "", v))
+	}
+
+	c := broker.Subscriber("lag-test", "lag-test")
+	defer c.Close()
+	msgs := c.Start()
+
+	healthy := LagHealthy(c, 3)
+	if healthy() {
+		t.Error("expected lag of 4 to be unhealthy")
+	}
+	if max := RecordLag(c); max != 4 {
+		t.Errorf("expected max lag of 4, got %d", max)
+	}
+
+	<-msgs
+	c.Commit(<-msgs)
+
+	if !healthy() {
+		t.Error("expected lag of 2 to be healthy")
+	}
+	RecordLag(c)
+	if v := metrics.Map(LagMetricName).Get("lag-test/0"); v == nil || v.String() != "2" {
+		t.Errorf("expected lag metric of 2, got %v", v)
+	}
+	if v := metrics.Int(MaxLagMetricName).Value(); v != 2 {
+		t.Errorf("expected max lag metric of 2, got %d", v)
+	}
+
+	// revoked partitions are removed
+	metrics.Map(LagMetricName).Set("revoked/0", new(expvar.Int))
+	RecordLag(c)
+	if v := metrics.Map(LagMetricName).Get("revoked/0"); v != nil {
+		t.Errorf("expected revoked partition to be removed, got %v", v)
+	}
+	if v := metrics.Map(LagMetricName).Get("lag-test/0"); v == nil {
+		t.Error("expected assigned partition to be kept")
+	}
+}
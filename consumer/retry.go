@@ -0,0 +1,201 @@
+package consumer
+
+import (
+	"context"
+	"errors"
+	"strconv"
+	"time"
+
+	"github.com/ian-kent/service.go/log"
+	"github.com/ian-kent/service.go/metrics"
+	"github.com/ian-kent/service.go/producer"
+	"github.com/ian-kent/service.go/pubsub"
+)
+
+// Headers set on messages published to retry and dead-letter topics
+var (
+	// AttemptHeader is the number of times the message has been processed
+	AttemptHeader = "retry-attempt"
+	// StageHeader is the number of retry topics the message has been through
+	StageHeader = "retry-stage"
+	// NotBeforeHeader is the time, in Unix milliseconds, before which
+	// the message shouldn't be processed
+	NotBeforeHeader = "retry-not-before"
+	// ErrorHeader is the error from the last attempt
+	ErrorHeader = "retry-error"
+	// OriginalTopicHeader, OriginalPartitionHeader and OriginalOffsetHeader
+	// identify the message when it was first consumed
+	OriginalTopicHeader     = "retry-original-topic"
+	OriginalPartitionHeader = "retry-original-partition"
+	OriginalOffsetHeader    = "retry-original-offset"
+)
+
+// Metric names incremented by Retry
+var (
+	RetriedMetricName      = "consumer_retried"
+	DeadLetteredMetricName = "consumer_dead_lettered"
+)
+
+// RetryTopic is a topic used to retry messages after a delay
+//
+// The consumer must be subscribed to retry topics as well as the
+// original topics. Messages are held until the delay has passed, so
+// retry topics are best consumed by a separate consumer.
+type RetryTopic struct {
+	Topic string
+	Delay time.Duration
+}
+
+// RetryPolicy configures Retry
+type RetryPolicy struct {
+	// Attempts is the number of times a message is processed before
+	// it's published to the next retry topic, 1 if zero
+	Attempts int
+	// Backoff returns the delay before an attempt, starting from 1,
+	// ExponentialBackoff(100ms, 10s) if nil
+	Backoff func(attempt int) time.Duration
+	// Topics are retry topics, used in order
+	Topics []RetryTopic
+	// DeadLetterTopic receives messages which fail every retry
+	//
+	// If empty, messages which fail every retry are logged and committed.
+	DeadLetterTopic string
+	// Producer publishes messages to retry and dead-letter topics
+	Producer producer.Producer
+}
+
+// ExponentialBackoff returns a backoff function which doubles from min to max
+func ExponentialBackoff(min, max time.Duration) func(attempt int) time.Duration {
+	return func(attempt int) time.Duration {
+		d := min
+		for i := 1; i < attempt && d < max; i++ {
+			d *= 2
+		}
+		if d > max {
+			d = max
+		}
+		return d
+	}
+}
+
+type permanentError struct{ error }
+
+// Permanent wraps an error so the message isn't retried, and is
+// published straight to the dead-letter topic
+func Permanent(err error) error {
+	return permanentError{err}
+}
+
+// IsPermanent returns true if err was wrapped using Permanent
+func IsPermanent(err error) bool {
+	var pe permanentError
+	return errors.As(err, &pe)
+}
+
+// Retry wraps a handler, retrying messages which fail
+//
+// Failed messages are retried in-process with backoff, then published
+// to each retry topic in turn, and finally to the dead-letter topic.
+// Published messages record the attempt count, the last error and the
+// original topic, partition and offset in headers.
+func Retry(policy RetryPolicy, h Handler) Handler {
+	if policy.Attempts < 1 {
+		policy.Attempts = 1
+	}
+	if policy.Backoff == nil {
+		policy.Backoff = ExponentialBackoff(100*time.Millisecond, 10*time.Second)
+	}
+
+	return func(ctx context.Context, msg Message) error {
+		hdr := msg.Headers()
+		stage, _ := strconv.Atoi(hdr[StageHeader])
+		attempt, _ := strconv.Atoi(hdr[AttemptHeader])
+
+		if nb, err := strconv.ParseInt(hdr[NotBeforeHeader], 10, 64); err == nil {
+			if err := sleep(ctx, time.Until(time.Unix(0, nb*int64(time.Millisecond)))); err != nil {
+				return err
+			}
+		}
+
+		var err error
+		for i := 0; i < policy.Attempts; i++ {
+			if i > 0 {
+				if err := sleep(ctx, policy.Backoff(i)); err != nil {
+					return err
+				}
+			}
+			attempt++
+			if err = h(ctx, msg); err == nil {
+				return nil
+			}
+			if ctx.Err() != nil || IsPermanent(err) {
+				break
+			}
+			log.Debug("message failed", log.Data{"topic": msg.Topic(), "partition": msg.Partition(), "offset": msg.Offset(), "attempt": attempt, "error": err.Error()})
+		}
+		if ctx.Err() != nil {
+			return err
+		}
+
+		headers := make(map[string]string, len(hdr)+7)
+		for k, v := range hdr {
+			headers[k] = v
+		}
+		headers[AttemptHeader] = strconv.Itoa(attempt)
+		headers[ErrorHeader] = err.Error()
+		if _, ok := headers[OriginalTopicHeader]; !ok {
+			headers[OriginalTopicHeader] = msg.Topic()
+			headers[OriginalPartitionHeader] = strconv.Itoa(int(msg.Partition()))
+			headers[OriginalOffsetHeader] = strconv.FormatInt(msg.Offset(), 10)
+		}
+		delete(headers, NotBeforeHeader)
+
+		topic, metric := policy.DeadLetterTopic, DeadLetteredMetricName
+		if !IsPermanent(err) && stage < len(policy.Topics) {
+			rt := policy.Topics[stage]
+			topic, metric = rt.Topic, RetriedMetricName
+			headers[StageHeader] = strconv.Itoa(stage + 1)
+			headers[NotBeforeHeader] = strconv.FormatInt(time.Now().Add(rt.Delay).UnixNano()/int64(time.Millisecond), 10)
+		}
+		if len(topic) == 0 || policy.Producer == nil {
+			return err
+		}
+
+		var key pubsub.Encoder
+		if msg.Key() != nil {
+			key = pubsub.ByteEncoder(msg.Key())
+		}
+		out := producer.NewMessage(topic, key, pubsub.ByteEncoder(msg.Value()), headers)
+
+		// the message is only committed once it's been published
+		for i := 1; ; i++ {
+			_, _, perr := policy.Producer.Send(out)
+			if perr == nil {
+				break
+			}
+			log.Error(perr, log.Data{"topic": topic})
+			if err := sleep(ctx, policy.Backoff(i)); err != nil {
+				return err
+			}
+		}
+
+		metrics.Incr(metric)
+		log.Debug("message republished", log.Data{"topic": topic, "attempt": attempt, "error": err.Error()})
+		return nil
+	}
+}
+
+// sleep waits for d, returning an error if ctx is done first
+func sleep(ctx context.Context, d time.Duration) error {
+	if d <= 0 {
+		return ctx.Err()
+	}
+	t := time.NewTimer(d)
+	defer t.Stop()
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-t.C:
+		return nil
+	}
+}
@@ -0,0 +1,96 @@
+package consumer
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/ian-kent/service.go/producer"
+)
+
+type testProducer struct {
+	sent []producer.Message
+}
+
+func (p *testProducer) Send(m producer.Message) (int32, int64, error) {
+	p.sent = append(p.sent, m)
+	return 0, int64(len(p.sent)), nil
+}
+
+func (p *testProducer) SendContext(ctx context.Context, m producer.Message) (int32, int64, error) {
+	return p.Send(m)
+}
+
+type headerMessage struct {
+	testMessage
+	headers map[string]string
+}
+
+func (m headerMessage) Headers() map[string]string { return m.headers }
+
+func TestRetry(t *testing.T) {
+	p := &testProducer{}
+	var calls int
+
+	h := Retry(RetryPolicy{
+		Attempts:        2,
+		Backoff:         func(int) time.Duration { return time.Millisecond },
+		Topics:          []RetryTopic{{Topic: "retry-1m", Delay: time.Minute}},
+		DeadLetterTopic: "dlq",
+		Producer:        p,
+	}, func(ctx context.Context, msg Message) error {
+		calls++
+		return errors.New("failed")
+	})
+
+	msg := testMessage{partition: 2, offset: 10}
+	if err := h(context.Background(), msg); err != nil {
+		t.Fatal(err)
+	}
+	if calls != 2 || len(p.sent) != 1 {
+		t.Fatalf("expected 2 attempts and 1 message sent, got %d and %d", calls, len(p.sent))
+	}
+
+	sent := p.sent[0]
+	hdr := sent.Headers()
+	if sent.Topic() != "retry-1m" || hdr[AttemptHeader] != "2" || hdr[StageHeader] != "1" || hdr[ErrorHeader] != "failed" {
+		t.Errorf("unexpected retry message: %s %v", sent.Topic(), hdr)
+	}
+	if hdr[OriginalTopicHeader] != "test" || hdr[OriginalPartitionHeader] != "2" || hdr[OriginalOffsetHeader] != "10" {
+		t.Errorf("unexpected original headers: %v", hdr)
+	}
+
+	// the retried message fails again and goes to the dead-letter topic
+	hdr[NotBeforeHeader] = "0"
+	if err := h(context.Background(), headerMessage{testMessage{partition: 0, offset: 1}, hdr}); err != nil {
+		t.Fatal(err)
+	}
+	dlq := p.sent[1]
+	if dlq.Topic() != "dlq" || dlq.Headers()[AttemptHeader] != "4" || dlq.Headers()[OriginalOffsetHeader] != "10" {
+		t.Errorf("unexpected dead-letter message: %s %v", dlq.Topic(), dlq.Headers())
+	}
+	if _, ok := dlq.Headers()[NotBeforeHeader]; ok {
+		t.Error("expected no not-before header on dead-letter message")
+	}
+}
+
+func TestRetryPermanent(t *testing.T) {
+	p := &testProducer{}
+	var calls int
+
+	h := Retry(RetryPolicy{
+		Attempts:        3,
+		Topics:          []RetryTopic{{Topic: "retry", Delay: time.Minute}},
+		DeadLetterTopic: "dlq",
+		Producer:        p,
+	}, func(ctx context.Context, msg Message) error {
+		calls++
+		return Permanent(errors.New("invalid"))
+	})
+
+	h(context.Background(), testMessage{})
+	if calls != 1 || len(p.sent) != 1 || p.sent[0].Topic() != "dlq" {
+		t.Errorf("expected permanent error to go straight to the dead-letter topic")
+	}
+}
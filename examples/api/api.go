@@ -1,9 +1,13 @@
 package main
 
 import (
+	"encoding/xml"
 	"net/http"
 
 	"github.com/ian-kent/service.go"
+	"github.com/ian-kent/service.go/api/response"
+	"github.com/ian-kent/service.go/handlers/compress"
+	"github.com/ian-kent/service.go/handlers/etag"
 	"github.com/ian-kent/service.go/handlers/healthcheck"
 	"github.com/ian-kent/service.go/log"
 )
@@ -11,6 +15,8 @@ import (
 func main() {
 	svc := service.API(configure())
 
+	svc.Chain(compress.DefaultHandler)
+	svc.Chain(etag.DefaultHandler)
 	svc.Chain(exampleMiddleware)
 
 	healthcheck.Register(svc.Router(), "/healthcheck", func() bool {
@@ -22,9 +28,13 @@ func main() {
 	svc.Start()
 }
 
+type example struct {
+	XMLName xml.Name `json:"-" xml:"example" yaml:"-"`
+	Message string   `json:"message" xml:"message" yaml:"message"`
+}
+
 func exampleHandler(w http.ResponseWriter, req *http.Request) {
-	w.WriteHeader(200)
-	w.Write([]byte(`{}`))
+	response.OK(w, req, example{Message: "hello"})
 }
 
 func exampleMiddleware(f http.Handler) http.Handler {
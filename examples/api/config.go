@@ -18,6 +18,14 @@ type config struct {
 
 func (c config) Namespace() string { return "service-namespace" }
 
+// AccessLog defaults to Combined Log Format for the example
+func (c config) AccessLog() string {
+	if f := c.DefaultAPIConfig.AccessLog(); len(f) > 0 {
+		return f
+	}
+	return "combined"
+}
+
 func configure() config {
 	if cfg != nil {
 		return *cfg
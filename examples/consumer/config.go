@@ -11,7 +11,7 @@ import (
 var cfg *config
 
 type config struct {
-	consumer.DefaultConfig
+	consumer.DefaultConsumerConfig
 }
 
 func (c config) Namespace() string { return "service-namespace" }
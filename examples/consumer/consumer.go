@@ -1,19 +1,33 @@
 package main
 
 import (
+	"context"
+	"os"
+	"os/signal"
+	"time"
+
 	"github.com/ian-kent/service.go/consumer"
 	"github.com/ian-kent/service.go/log"
 )
 
 func main() {
-	consumer := consumer.New(configure())
+	ctx, cancel := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer cancel()
+
+	c := consumer.New(configure(),
+		consumer.OnAssigned(func(claims map[string][]int32) {
+			log.Debug("assigned", log.Data{"claims": claims})
+		}),
+	)
+	defer c.Close()
 
-	for event := range consumer.Start() {
-		log.Debug("event", log.Data{"event": event})
+	go consumer.MonitorLag(ctx, c, 10*time.Second)
 
-		err := consumer.Commit(event)
-		if err != nil {
-			log.Error(err, nil)
-		}
+	err := consumer.Handle(ctx, c, func(ctx context.Context, msg consumer.Message) error {
+		log.Debug("message", log.Data{"partition": msg.Partition(), "offset": msg.Offset()})
+		return nil
+	}, consumer.HandleOptions{Concurrency: 4})
+	if err != nil {
+		log.Error(err, nil)
 	}
 }
@@ -5,7 +5,9 @@ import (
 
 	"github.com/ian-kent/service.go"
 	"github.com/ian-kent/service.go/handlers/healthcheck"
+	"github.com/ian-kent/service.go/handlers/recovery"
 	"github.com/ian-kent/service.go/log"
+	"github.com/ian-kent/service.go/web/handlers/security"
 	"github.com/ian-kent/service.go/web/handlers/static"
 	"github.com/ian-kent/service.go/web/render"
 	"github.com/ian-kent/service.go/web/session"
@@ -19,6 +21,13 @@ func main() {
 	session.Init(cfg)
 	static.Register(cfg, svc.Router())
 
+	recovery.FailureHandler = render.ErrorHandler(http.StatusInternalServerError, "Internal server error")
+
+	security.Register(svc.Router(), "/csp-report")
+	securityConfig := security.DefaultConfig
+	securityConfig.ReportURI = "/csp-report"
+
+	svc.Chain(security.Handler(securityConfig))
 	svc.Chain(render.WithCsrfHandler)
 	svc.Chain(exampleMiddleware)
 
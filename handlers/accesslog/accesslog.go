@@ -0,0 +1,331 @@
+// Package accesslog implements an access log middleware
+package accesslog
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/gorilla/pat"
+	"github.com/ian-kent/service.go/auth"
+	"github.com/ian-kent/service.go/handlers/proxy"
+	"github.com/ian-kent/service.go/handlers/requestID"
+	"github.com/ian-kent/service.go/log"
+)
+
+// Format is an access log format
+type Format int
+
+const (
+	// Event logs each request as a structured "access" log event
+	Event Format = iota
+	// Common writes each request in Apache Common Log Format
+	Common
+	// Combined writes each request in Apache Combined Log Format
+	Combined
+	// Off disables access logging
+	Off
+)
+
+// ParseFormat parses a format name: "event", "common", "combined" or "off"
+func ParseFormat(s string) (Format, error) {
+	switch strings.ToLower(s) {
+	case "event":
+		return Event, nil
+	case "common":
+		return Common, nil
+	case "combined":
+		return Combined, nil
+	case "off", "":
+		return Off, nil
+	}
+	return Off, fmt.Errorf("accesslog: invalid format: %s", s)
+}
+
+// Config is the access log configuration
+type Config struct {
+	// Format is the access log format
+	Format Format
+	// Output is where Common and Combined logs are written, os.Stdout if nil
+	Output io.Writer
+	// RemoteAddr returns the client address, proxy.ClientIP if nil
+	RemoteAddr func(req *http.Request) string
+	// Router, if set, is used to log the matched route pattern
+	Router *pat.Router
+}
+
+// DefaultConfig is the configuration used by DefaultHandler
+//
+// Services copy it and set Format and Router from the HTTPConfig.
+var DefaultConfig = Config{
+	Format: Off,
+}
+
+// DefaultHandler is an access log middleware using DefaultConfig
+//
+// It's part of service.DefaultMiddleware, outside the recovery and
+// timeout middleware, so requests which panic or time out are logged
+// with the response the client received.
+func DefaultHandler(h http.Handler) http.Handler {
+	return Handler(DefaultConfig)(h)
+}
+
+// Handler returns an access log middleware using the config
+//
+// The user logged is the ID of the principal authenticated by the
+// auth middleware, and never the credentials sent with the request.
+func Handler(cfg Config) func(http.Handler) http.Handler {
+	if cfg.Format == Off {
+		return func(h http.Handler) http.Handler { return h }
+	}
+
+	l := &logger{Config: cfg, out: cfg.Output}
+	if l.out == nil {
+		l.out = os.Stdout
+	}
+
+	return func(h http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+			rc := &responseCapture{ResponseWriter: w}
+
+			// the route is matched before the request is handled,
+			// since handlers may modify the request
+			route := cfg.route(req)
+
+			req, principal := auth.Recorder(req)
+
+			s := time.Now()
+			defer func() {
+				// the response is logged even if the handler panics
+				p := recover()
+				if p != nil && rc.status == 0 {
+					rc.status = http.StatusInternalServerError
+				}
+				l.log(req, rc, route, principal(), s)
+				if p != nil {
+					panic(p)
+				}
+			}()
+
+			h.ServeHTTP(rc, req)
+		})
+	}
+}
+
+// logger writes access log entries
+type logger struct {
+	Config
+	mu  sync.Mutex
+	out io.Writer
+}
+
+func (l *logger) log(req *http.Request, rc *responseCapture, route string, p *auth.Principal, s time.Time) {
+	d := time.Since(s)
+
+	if rc.status == 0 {
+		rc.status = http.StatusOK
+	}
+
+	var user string
+	if p != nil {
+		user = p.ID
+	}
+
+	e := entry{
+		start:     s,
+		duration:  d,
+		remote:    l.remoteAddr(req),
+		user:      user,
+		method:    req.Method,
+		uri:       req.RequestURI,
+		proto:     req.Proto,
+		status:    rc.status,
+		bytes:     rc.bytes,
+		referer:   req.Referer(),
+		userAgent: req.UserAgent(),
+		route:     route,
+		requestID: requestID.Get(req),
+	}
+	if len(e.uri) == 0 {
+		e.uri = req.URL.RequestURI()
+	}
+
+	if l.Format == Event {
+		e.event()
+		return
+	}
+
+	line := e.common()
+	if l.Format == Combined {
+		line += ` "` + escape(orDash(e.referer)) + `" "` + escape(orDash(e.userAgent)) + `"`
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if _, err := io.WriteString(l.out, line+"\n"); err != nil {
+		log.ErrorR(req, err, nil)
+	}
+}
+
+func (cfg Config) remoteAddr(req *http.Request) string {
+	if cfg.RemoteAddr != nil {
+		return cfg.RemoteAddr(req)
+	}
+	return proxy.ClientIP(req)
+}
+
+func (cfg Config) route(req *http.Request) string {
+	if cfg.Router == nil {
+		return ""
+	}
+	var match mux.RouteMatch
+	if !cfg.Router.Match(req, &match) || match.Route == nil {
+		return ""
+	}
+	tpl, _ := match.Route.GetPathTemplate()
+	return tpl
+}
+
+type entry struct {
+	start     time.Time
+	duration  time.Duration
+	remote    string
+	user      string
+	method    string
+	uri       string
+	proto     string
+	status    int
+	bytes     int64
+	referer   string
+	userAgent string
+	route     string
+	requestID string
+}
+
+func (e entry) event() {
+	data := log.Data{
+		"start":       e.start,
+		"duration":    e.duration,
+		"remote_addr": e.remote,
+		"method":      e.method,
+		"uri":         e.uri,
+		"proto":       e.proto,
+		"status":      e.status,
+		"bytes":       e.bytes,
+	}
+	if len(e.user) > 0 {
+		data["user"] = e.user
+	}
+	if len(e.referer) > 0 {
+		data["referer"] = e.referer
+	}
+	if len(e.userAgent) > 0 {
+		data["user_agent"] = e.userAgent
+	}
+	if len(e.route) > 0 {
+		data["route"] = e.route
+	}
+	log.Event("access", e.requestID, data)
+}
+
+// common returns the entry in Common Log Format
+func (e entry) common() string {
+	bytes := "-"
+	if e.bytes > 0 {
+		bytes = strconv.FormatInt(e.bytes, 10)
+	}
+	return fmt.Sprintf(`%s - %s [%s] "%s %s %s" %d %s`,
+		escapeField(orDash(e.remote)),
+		escapeField(orDash(e.user)),
+		e.start.Format("02/Jan/2006:15:04:05 -0700"),
+		escape(e.method), escape(e.uri), escape(e.proto),
+		e.status, bytes,
+	)
+}
+
+// escape escapes a value taken from the request for a quoted Common
+// Log Format field, so it can't end the field or inject log lines
+//
+// Quotes and backslashes are escaped with a backslash, and control
+// and non-ASCII bytes as \xhh, as Apache does.
+func escape(s string) string {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		switch {
+		case c == '"' || c == '\\':
+			b.WriteByte('\\')
+			b.WriteByte(c)
+		case c < 0x20 || c >= 0x7f:
+			fmt.Fprintf(&b, "\\x%02x", c)
+		default:
+			b.WriteByte(c)
+		}
+	}
+	return b.String()
+}
+
+// escapeField escapes a value for an unquoted field, which also
+// can't contain spaces
+func escapeField(s string) string {
+	return strings.Replace(escape(s), " ", "\\x20", -1)
+}
+
+func orDash(s string) string {
+	if len(s) == 0 {
+		return "-"
+	}
+	return s
+}
+
+type responseCapture struct {
+	http.ResponseWriter
+	status int
+	bytes  int64
+}
+
+func (r *responseCapture) WriteHeader(status int) {
+	if r.status == 0 {
+		r.status = status
+	}
+	r.ResponseWriter.WriteHeader(status)
+}
+
+func (r *responseCapture) Write(b []byte) (int, error) {
+	if r.status == 0 {
+		r.status = http.StatusOK
+	}
+	n, err := r.ResponseWriter.Write(b)
+	r.bytes += int64(n)
+	return n, err
+}
+
+func (r *responseCapture) Flush() {
+	if f, ok := r.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+func (r *responseCapture) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	if hj, ok := r.ResponseWriter.(http.Hijacker); ok {
+		r.status = http.StatusSwitchingProtocols
+		return hj.Hijack()
+	}
+	return nil, nil, errors.New("accesslog: ResponseWriter does not implement http.Hijacker")
+}
+
+func (r *responseCapture) Push(target string, opts *http.PushOptions) error {
+	if p, ok := r.ResponseWriter.(http.Pusher); ok {
+		return p.Push(target, opts)
+	}
+	return http.ErrNotSupported
+}
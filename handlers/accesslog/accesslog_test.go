@@ -0,0 +1,165 @@
+package accesslog
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"testing"
+	"time"
+
+	"github.com/gorilla/pat"
+	"github.com/ian-kent/service.go/auth"
+	"github.com/ian-kent/service.go/handlers/recovery"
+	"github.com/ian-kent/service.go/handlers/timeout"
+)
+
+func TestCombined(t *testing.T) {
+	var buf bytes.Buffer
+
+	r := pat.New()
+	r.Get("/things/{id}", func(w http.ResponseWriter, req *http.Request) {
+		w.WriteHeader(http.StatusCreated)
+		w.Write([]byte("hello"))
+	})
+
+	// the principal is logged, not the credentials
+	a := auth.Handler(auth.Config{Authenticators: []auth.Authenticator{
+		auth.AuthenticatorFunc(func(req *http.Request) (*auth.Principal, error) {
+			if u, _, ok := req.BasicAuth(); ok && u == "secret-key" {
+				return &auth.Principal{ID: "alice"}, nil
+			}
+			return nil, auth.ErrNoCredentials
+		}),
+	}})
+	h := Handler(Config{Format: Combined, Output: &buf, Router: r})(a(r))
+
+	req := httptest.NewRequest("GET", "/things/1?a=b", nil)
+	req.RemoteAddr = "10.0.0.1:1234"
+	req.Header.Set("Referer", "http://example.com/")
+	req.Header.Set("User-Agent", "test-agent")
+	req.SetBasicAuth("secret-key", "")
+	h.ServeHTTP(httptest.NewRecorder(), req)
+
+	re := regexp.MustCompile(`^10\.0\.0\.1 - alice \[[^\]]+\] "GET /things/1\?a=b HTTP/1\.1" 201 5 "http://example\.com/" "test-agent"\n$`)
+	if !re.MatchString(buf.String()) {
+		t.Errorf("unexpected log line: %q", buf.String())
+	}
+
+	if route := (Config{Router: r}).route(httptest.NewRequest("GET", "/things/2", nil)); route != "/things/{id}" {
+		t.Errorf("expected route pattern, got %q", route)
+	}
+}
+
+func TestCommonEmpty(t *testing.T) {
+	var buf bytes.Buffer
+
+	h := Handler(Config{Format: Common, Output: &buf})(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {}))
+
+	req := httptest.NewRequest("HEAD", "/", nil)
+	req.RemoteAddr = "10.0.0.1:1234"
+	h.ServeHTTP(httptest.NewRecorder(), req)
+
+	re := regexp.MustCompile(`^10\.0\.0\.1 - - \[[^\]]+\] "HEAD / HTTP/1\.1" 200 -\n$`)
+	if !re.MatchString(buf.String()) {
+		t.Errorf("unexpected log line: %q", buf.String())
+	}
+}
+
+func TestEscaping(t *testing.T) {
+	var buf bytes.Buffer
+
+	h := Handler(Config{Format: Combined, Output: &buf})(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {}))
+
+	req := httptest.NewRequest("GET", "/", nil)
+	req.RemoteAddr = "10.0.0.1:1234"
+	req.RequestURI = "/a\"b\n10.0.0.2 - - [x] \"GET /"
+	req.Header.Set("User-Agent", "agent\r\nfake")
+	req.SetBasicAuth("key\nfake", "")
+	h.ServeHTTP(httptest.NewRecorder(), req)
+
+	line := buf.String()
+	if bytes.Count(buf.Bytes(), []byte("\n")) != 1 {
+		t.Fatalf("expected a single log line, got %q", line)
+	}
+	re := regexp.MustCompile(`^10\.0\.0\.1 - - \[[^\]]+\] "GET /a\\"b\\x0a10\.0\.0\.2 - - \[x\] \\"GET / HTTP/1\.1" 200 - "-" "agent\\x0d\\x0afake"\n$`)
+	if !re.MatchString(line) {
+		t.Errorf("unexpected log line: %q", line)
+	}
+}
+
+func TestPanicLogged(t *testing.T) {
+	var buf bytes.Buffer
+
+	// as in service.DefaultMiddleware, the access log is outside recovery
+	h := Handler(Config{Format: Common, Output: &buf})(recovery.DefaultHandler(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		panic("oops")
+	})))
+
+	req := httptest.NewRequest("GET", "/", nil)
+	req.RemoteAddr = "10.0.0.1:1234"
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, req)
+
+	re := regexp.MustCompile(`^10\.0\.0\.1 - - \[[^\]]+\] "GET / HTTP/1\.1" 500 -\n$`)
+	if rec.Code != 500 || !re.MatchString(buf.String()) {
+		t.Errorf("expected panic to be logged as a 500, got %d %q", rec.Code, buf.String())
+	}
+
+	// without recovery, the panic is logged and propagated
+	buf.Reset()
+	h = Handler(Config{Format: Common, Output: &buf})(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		panic("oops")
+	}))
+	func() {
+		defer func() {
+			if recover() == nil {
+				t.Error("expected panic to propagate")
+			}
+		}()
+		h.ServeHTTP(httptest.NewRecorder(), req)
+	}()
+	if !re.MatchString(buf.String()) {
+		t.Errorf("unexpected log line: %q", buf.String())
+	}
+}
+
+func TestAuthenticatedAfterTimeout(t *testing.T) {
+	var buf bytes.Buffer
+
+	a := auth.Handler(auth.Config{Authenticators: []auth.Authenticator{
+		auth.AuthenticatorFunc(func(req *http.Request) (*auth.Principal, error) {
+			return &auth.Principal{ID: "alice"}, nil
+		}),
+	}})
+
+	// the request is authenticated by the handler goroutine after the
+	// timeout middleware has returned and the access log is written
+	done := make(chan struct{})
+	slow := http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		defer close(done)
+		<-req.Context().Done()
+		a(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {})).ServeHTTP(w, req)
+	})
+	h := Handler(Config{Format: Common, Output: &buf})(timeout.Handler(slow, 10*time.Millisecond, timeout.DefaultFailureHandler))
+
+	req := httptest.NewRequest("GET", "/", nil)
+	req.RemoteAddr = "10.0.0.1:1234"
+	h.ServeHTTP(httptest.NewRecorder(), req)
+	<-done
+
+	if !regexp.MustCompile(`" 408 `).MatchString(buf.String()) {
+		t.Errorf("expected timed out request to be logged, got %q", buf.String())
+	}
+}
+
+func TestParseFormat(t *testing.T) {
+	for s, f := range map[string]Format{"": Off, "off": Off, "event": Event, "Common": Common, "combined": Combined} {
+		if got, err := ParseFormat(s); err != nil || got != f {
+			t.Errorf("%q: expected %d, got %d %v", s, f, got, err)
+		}
+	}
+	if _, err := ParseFormat("nope"); err == nil {
+		t.Error("expected error")
+	}
+}
@@ -0,0 +1,93 @@
+// Package bodylimit implements a middleware which limits the request body size
+package bodylimit
+
+import (
+	"context"
+	"net/http"
+
+	"github.com/ian-kent/service.go/api/response"
+	"github.com/ian-kent/service.go/handlers/route"
+	"github.com/ian-kent/service.go/log"
+)
+
+// Config is the body size configuration used by DefaultHandler
+type Config struct {
+	// MaxSize is the default maximum body size in bytes
+	MaxSize int64
+	// Routes overrides MaxSize for individual routes
+	//
+	// Keys are either a path prefix, e.g. "/upload", or a method and
+	// path prefix, e.g. "POST /upload", matched as described by
+	// route.Score. The most specific matching key is used.
+	// A zero size disables the limit for the route.
+	Routes map[string]int64
+}
+
+// DefaultConfig is the configuration used by DefaultHandler
+//
+// Services copy it and set MaxSize and Routes from the HTTPConfig
+var DefaultConfig = Config{
+	MaxSize: 10 << 20,
+}
+
+// DefaultFailureHandler is the failure handler used by DefaultHandler
+var DefaultFailureHandler http.Handler = http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+	response.Error(w, req, http.StatusRequestEntityTooLarge, "request body too large")
+})
+
+// For returns the maximum body size for a request, or zero if the
+// body size isn't limited
+func (c Config) For(req *http.Request) int64 {
+	size, n := c.MaxSize, -1
+	for key, s := range c.Routes {
+		if score := route.Score(req, key); score > n {
+			size, n = s, score
+		}
+	}
+	return size
+}
+
+// FromContext returns the body size limit applied to a request by
+// the middleware, which is zero if the body size isn't limited
+func FromContext(ctx context.Context) (int64, bool) {
+	max, ok := ctx.Value(contextKey{}).(int64)
+	return max, ok
+}
+
+type contextKey struct{}
+
+// DefaultHandler returns a Handler using DefaultConfig and DefaultFailureHandler
+func DefaultHandler(h http.Handler) http.Handler {
+	return Handler(DefaultConfig, DefaultFailureHandler)(h)
+}
+
+// Handler returns a middleware which limits the request body size
+//
+// Requests with a Content-Length over the limit are rejected by
+// calling fh. Otherwise the body is wrapped with http.MaxBytesReader,
+// and reads past the limit return an error. The limit is stored in the
+// request context, see FromContext.
+func Handler(cfg Config, fh http.Handler) func(http.Handler) http.Handler {
+	return func(h http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+			max := cfg.For(req)
+			if max < 0 {
+				max = 0
+			}
+			req = req.WithContext(context.WithValue(req.Context(), contextKey{}, max))
+			if max == 0 || req.Body == nil {
+				h.ServeHTTP(w, req)
+				return
+			}
+
+			if req.ContentLength > max {
+				log.DebugR(req, "request body too large", log.Data{"content_length": req.ContentLength, "max": max})
+				fh.ServeHTTP(w, req)
+				return
+			}
+
+			req.Body = http.MaxBytesReader(w, req.Body, max)
+			h.ServeHTTP(w, req)
+		})
+	}
+}
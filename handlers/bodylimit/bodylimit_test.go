@@ -0,0 +1,83 @@
+package bodylimit
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestConfigFor(t *testing.T) {
+	cfg := Config{
+		MaxSize: 10,
+		Routes: map[string]int64{
+			"/upload":      100,
+			"POST /upload": 1000,
+			"/stream":      0,
+		},
+	}
+
+	tests := []struct {
+		method, path string
+		want         int64
+	}{
+		{"POST", "/", 10},
+		{"PUT", "/upload/file", 100},
+		{"POST", "/upload/file", 1000},
+		{"POST", "/stream", 0},
+	}
+	for _, tt := range tests {
+		if got := cfg.For(httptest.NewRequest(tt.method, tt.path, nil)); got != tt.want {
+			t.Errorf("%s %s: expected %d, got %d", tt.method, tt.path, tt.want, got)
+		}
+	}
+}
+
+func TestHandler(t *testing.T) {
+	cfg := Config{MaxSize: 5, Routes: map[string]int64{"/upload": 20}}
+
+	var readErr error
+	var limit int64
+	h := Handler(cfg, DefaultFailureHandler)(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		limit, _ = FromContext(req.Context())
+		_, readErr = ioutil.ReadAll(req.Body)
+		if readErr != nil {
+			w.WriteHeader(http.StatusRequestEntityTooLarge)
+		}
+	}))
+
+	tests := []struct {
+		path, body string
+		chunked    bool
+		status     int
+		limit      int64
+	}{
+		{"/", "small", false, http.StatusOK, 5},
+		// rejected using the Content-Length before the handler is called
+		{"/", "too large", false, http.StatusRequestEntityTooLarge, 0},
+		// read past the limit without a Content-Length
+		{"/", "too large", true, http.StatusRequestEntityTooLarge, 5},
+		{"/upload", "too large", false, http.StatusOK, 20},
+		{"/upload", strings.Repeat("x", 21), true, http.StatusRequestEntityTooLarge, 20},
+	}
+
+	for i, tt := range tests {
+		readErr, limit = nil, 0
+		req := httptest.NewRequest("POST", tt.path, strings.NewReader(tt.body))
+		if tt.chunked {
+			req.ContentLength = -1
+		}
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, req)
+		if w.Code != tt.status {
+			t.Errorf("test %d: expected %d, got %d", i, tt.status, w.Code)
+		}
+		if tt.chunked && tt.status != http.StatusOK && readErr == nil {
+			t.Errorf("test %d: expected read error", i)
+		}
+		if limit != tt.limit {
+			t.Errorf("test %d: expected limit %d in context, got %d", i, tt.limit, limit)
+		}
+	}
+}
@@ -0,0 +1,323 @@
+// Package compress implements a response compression middleware
+package compress
+
+import (
+	"bufio"
+	"compress/flate"
+	"compress/gzip"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/andybalholm/brotli"
+	"github.com/ian-kent/service.go/log"
+)
+
+// Config is the compression middleware configuration
+type Config struct {
+	// Encodings are the supported encodings in order of preference
+	Encodings []string
+	// MinSize is the minimum response size to compress
+	//
+	// Responses are buffered until MinSize bytes have been written,
+	// or the response is flushed
+	MinSize int
+	// Level is the gzip and deflate compression level
+	Level int
+	// BrotliLevel is the brotli compression level
+	BrotliLevel int
+	// SkipTypes are content type prefixes which aren't compressed,
+	// usually because they are already compressed
+	SkipTypes []string
+}
+
+// DefaultConfig is the configuration used by DefaultHandler
+var DefaultConfig = Config{
+	Encodings:   []string{"br", "gzip", "deflate"},
+	MinSize:     1024,
+	Level:       gzip.DefaultCompression,
+	BrotliLevel: brotli.DefaultCompression,
+	SkipTypes: []string{
+		"image/png", "image/jpeg", "image/gif", "image/webp", "image/avif",
+		"video/", "audio/", "font/woff", "application/zip", "application/gzip",
+		"application/x-gzip", "application/pdf", "application/octet-stream",
+	},
+}
+
+// DefaultHandler is a compression middleware using DefaultConfig
+func DefaultHandler(h http.Handler) http.Handler {
+	return Handler(DefaultConfig)(h)
+}
+
+type compressor interface {
+	io.WriteCloser
+	Flush() error
+	Reset(io.Writer)
+}
+
+// Handler returns a compression middleware using the config
+//
+// Strong ETags on compressed responses are made weak, so caches don't
+// treat the compressed and identity responses as byte-for-byte equal.
+func Handler(cfg Config) func(http.Handler) http.Handler {
+	pools := map[string]*sync.Pool{
+		"gzip": {New: func() interface{} {
+			w, _ := gzip.NewWriterLevel(nil, cfg.Level)
+			return w
+		}},
+		"deflate": {New: func() interface{} {
+			w, _ := flate.NewWriter(nil, cfg.Level)
+			return w
+		}},
+		"br": {New: func() interface{} {
+			return brotli.NewWriterLevel(nil, cfg.BrotliLevel)
+		}},
+	}
+
+	return func(h http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+			addVary(w.Header(), "Accept-Encoding")
+
+			encoding := Negotiate(req.Header.Get("Accept-Encoding"), cfg.Encodings)
+			pool, ok := pools[encoding]
+			if !ok || req.Method == "HEAD" || len(req.Header.Get("Range")) > 0 {
+				h.ServeHTTP(w, req)
+				return
+			}
+
+			cw := &writer{
+				ResponseWriter: w,
+				req:            req,
+				cfg:            cfg,
+				encoding:       encoding,
+				pool:           pool,
+			}
+			h.ServeHTTP(cw, req)
+
+			// not deferred, so a panic doesn't write a partial response
+			// before it can be recovered
+			cw.close()
+		})
+	}
+}
+
+// Negotiate returns the supported encoding preferred by the
+// Accept-Encoding header, or an empty string if none are acceptable
+func Negotiate(acceptEncoding string, supported []string) string {
+	accepted := make(map[string]float64)
+	for _, part := range strings.Split(acceptEncoding, ",") {
+		params := strings.Split(part, ";")
+		enc := strings.ToLower(strings.TrimSpace(params[0]))
+		if len(enc) == 0 {
+			continue
+		}
+		q := 1.0
+		for _, p := range params[1:] {
+			kv := strings.SplitN(strings.TrimSpace(p), "=", 2)
+			if len(kv) == 2 && strings.ToLower(kv[0]) == "q" {
+				if v, err := strconv.ParseFloat(kv[1], 64); err == nil {
+					q = v
+				}
+			}
+		}
+		accepted[enc] = q
+	}
+
+	var best string
+	var bestQ float64
+	for _, s := range supported {
+		q, ok := accepted[s]
+		if !ok {
+			q = accepted["*"]
+		}
+		// supported is in order of preference, so only replace on a higher quality
+		if q > bestQ {
+			best, bestQ = s, q
+		}
+	}
+
+	return best
+}
+
+func addVary(h http.Header, value string) {
+	for _, v := range h["Vary"] {
+		for _, s := range strings.Split(v, ",") {
+			if strings.EqualFold(strings.TrimSpace(s), value) {
+				return
+			}
+		}
+	}
+	h.Add("Vary", value)
+}
+
+// ErrHijacked is returned when writing to a hijacked connection
+var ErrHijacked = errors.New("compress: connection has been hijacked")
+
+type writer struct {
+	http.ResponseWriter
+	req      *http.Request
+	cfg      Config
+	encoding string
+	pool     *sync.Pool
+
+	status      int
+	wroteHeader bool
+	started     bool
+	hijacked    bool
+	buf         []byte
+	cw          compressor
+}
+
+func (w *writer) WriteHeader(status int) {
+	if w.wroteHeader || w.hijacked {
+		return
+	}
+	if status < 200 {
+		// informational responses are written immediately
+		w.ResponseWriter.WriteHeader(status)
+		return
+	}
+	w.status = status
+	w.wroteHeader = true
+
+	if status == http.StatusNoContent || status == http.StatusNotModified || status == http.StatusPartialContent {
+		w.start(false)
+	}
+}
+
+func (w *writer) Write(b []byte) (int, error) {
+	if w.hijacked {
+		return 0, ErrHijacked
+	}
+	if !w.wroteHeader {
+		w.WriteHeader(http.StatusOK)
+	}
+	if w.started {
+		if w.cw != nil {
+			return w.cw.Write(b)
+		}
+		return w.ResponseWriter.Write(b)
+	}
+
+	w.buf = append(w.buf, b...)
+	if len(w.buf) >= w.cfg.MinSize {
+		if err := w.start(true); err != nil {
+			return 0, err
+		}
+	}
+	return len(b), nil
+}
+
+// start writes the response header, deciding whether to compress
+// the response, and writes any buffered data
+func (w *writer) start(compress bool) error {
+	w.started = true
+	hdr := w.Header()
+
+	if compress && len(w.buf) > 0 && len(hdr.Get("Content-Type")) == 0 {
+		// sniff the content type before it's compressed
+		hdr.Set("Content-Type", http.DetectContentType(w.buf))
+	}
+
+	if compress && w.compressible() {
+		hdr.Set("Content-Encoding", w.encoding)
+		hdr.Del("Content-Length")
+		// the compressed bytes differ from the identity response, so
+		// they can't share a strong ETag
+		if tag := hdr.Get("ETag"); len(tag) > 0 && !strings.HasPrefix(tag, "W/") {
+			hdr.Set("ETag", "W/"+tag)
+		}
+		w.cw = w.pool.Get().(compressor)
+		w.cw.Reset(w.ResponseWriter)
+	}
+
+	w.ResponseWriter.WriteHeader(w.status)
+
+	if len(w.buf) == 0 {
+		return nil
+	}
+
+	var err error
+	if w.cw != nil {
+		_, err = w.cw.Write(w.buf)
+	} else {
+		_, err = w.ResponseWriter.Write(w.buf)
+	}
+	w.buf = nil
+	return err
+}
+
+func (w *writer) compressible() bool {
+	hdr := w.Header()
+	if len(hdr.Get("Content-Encoding")) > 0 {
+		return false
+	}
+	ct := strings.ToLower(hdr.Get("Content-Type"))
+	for _, t := range w.cfg.SkipTypes {
+		if strings.HasPrefix(ct, t) {
+			return false
+		}
+	}
+	return true
+}
+
+func (w *writer) close() {
+	if w.hijacked {
+		return
+	}
+	if !w.started && w.wroteHeader {
+		// the response is smaller than MinSize
+		w.start(false)
+	}
+	if w.cw != nil {
+		if err := w.cw.Close(); err != nil {
+			log.ErrorR(w.req, err, log.Data{"encoding": w.encoding})
+		}
+		w.cw.Reset(nil)
+		w.pool.Put(w.cw)
+		w.cw = nil
+	}
+}
+
+func (w *writer) Flush() {
+	if w.hijacked {
+		return
+	}
+	if !w.wroteHeader {
+		w.WriteHeader(http.StatusOK)
+	}
+	if !w.started {
+		w.start(true)
+	}
+	if w.cw != nil {
+		if err := w.cw.Flush(); err != nil {
+			log.ErrorR(w.req, err, log.Data{"encoding": w.encoding})
+		}
+	}
+	if f, ok := w.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+func (w *writer) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	if w.started {
+		return nil, nil, errors.New("compress: cannot hijack after the response has started")
+	}
+	hj, ok := w.ResponseWriter.(http.Hijacker)
+	if !ok {
+		return nil, nil, errors.New("compress: ResponseWriter does not implement http.Hijacker")
+	}
+	w.hijacked = true
+	return hj.Hijack()
+}
+
+func (w *writer) Push(target string, opts *http.PushOptions) error {
+	if p, ok := w.ResponseWriter.(http.Pusher); ok {
+		return p.Push(target, opts)
+	}
+	return http.ErrNotSupported
+}
@@ -0,0 +1,144 @@
+package compress
+
+import (
+	"compress/gzip"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/ian-kent/service.go/handlers/etag"
+)
+
+func TestNegotiate(t *testing.T) {
+	supported := []string{"br", "gzip", "deflate"}
+	tests := map[string]string{
+		"":                      "",
+		"identity":              "",
+		"gzip":                  "gzip",
+		"gzip, deflate, br":     "br",
+		"gzip;q=1, br;q=0.5":    "gzip",
+		"*":                     "br",
+		"*, br;q=0":             "gzip",
+		"deflate, gzip;q=0":     "deflate",
+		"GZIP":                  "gzip",
+		"compress, x-something": "",
+	}
+
+	for accept, expected := range tests {
+		if enc := Negotiate(accept, supported); enc != expected {
+			t.Errorf("%q: expected %q, got %q", accept, expected, enc)
+		}
+	}
+}
+
+func serve(h http.HandlerFunc, acceptEncoding string) *httptest.ResponseRecorder {
+	w := httptest.NewRecorder()
+	req, _ := http.NewRequest("GET", "/", nil)
+	req.Header.Set("Accept-Encoding", acceptEncoding)
+	DefaultHandler(h).ServeHTTP(w, req)
+	return w
+}
+
+func TestHandler(t *testing.T) {
+	body := strings.Repeat("compress me ", 200)
+
+	w := serve(func(w http.ResponseWriter, req *http.Request) {
+		w.Header().Set("Content-Type", "text/plain")
+		w.Write([]byte(body))
+	}, "gzip")
+
+	if enc := w.Header().Get("Content-Encoding"); enc != "gzip" {
+		t.Fatalf("expected gzip encoding, got %q", enc)
+	}
+	if v := w.Header().Get("Vary"); v != "Accept-Encoding" {
+		t.Errorf("expected Vary header, got %q", v)
+	}
+
+	gr, err := gzip.NewReader(w.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := ioutil.ReadAll(gr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(b) != body {
+		t.Error("unexpected decompressed body")
+	}
+}
+
+func TestHandlerSkips(t *testing.T) {
+	tests := map[string]http.HandlerFunc{
+		"small body": func(w http.ResponseWriter, req *http.Request) {
+			w.Write([]byte("small"))
+		},
+		"compressed type": func(w http.ResponseWriter, req *http.Request) {
+			w.Header().Set("Content-Type", "image/png")
+			w.Write(make([]byte, 4096))
+		},
+		"already encoded": func(w http.ResponseWriter, req *http.Request) {
+			w.Header().Set("Content-Encoding", "gzip")
+			w.Write(make([]byte, 4096))
+		},
+	}
+
+	for name, h := range tests {
+		w := serve(h, "gzip")
+		if enc := w.Header().Get("Content-Encoding"); enc == "gzip" && name != "already encoded" || enc == "" && name == "already encoded" {
+			t.Errorf("%s: unexpected encoding %q", name, enc)
+		}
+		if w.Code != http.StatusOK {
+			t.Errorf("%s: expected status 200, got %d", name, w.Code)
+		}
+	}
+}
+
+func TestHandlerFlush(t *testing.T) {
+	w := serve(func(w http.ResponseWriter, req *http.Request) {
+		w.Header().Set("Content-Type", "text/event-stream")
+		w.Write([]byte("data: 1\n\n"))
+		w.(http.Flusher).Flush()
+	}, "gzip")
+
+	if enc := w.Header().Get("Content-Encoding"); enc != "gzip" {
+		t.Errorf("expected gzip encoding, got %q", enc)
+	}
+	if !w.Flushed {
+		t.Error("expected response to be flushed")
+	}
+}
+
+func TestHandlerETag(t *testing.T) {
+	body := strings.Repeat("a", 2048)
+	h := DefaultHandler(etag.DefaultHandler(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.Header().Set("Content-Type", "text/plain")
+		w.Write([]byte(body))
+	})))
+
+	get := func(acceptEncoding, ifNoneMatch string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		req, _ := http.NewRequest("GET", "/", nil)
+		req.Header.Set("Accept-Encoding", acceptEncoding)
+		if len(ifNoneMatch) > 0 {
+			req.Header.Set("If-None-Match", ifNoneMatch)
+		}
+		h.ServeHTTP(w, req)
+		return w
+	}
+
+	identity, gz := get("", ""), get("gzip", "")
+	if gz.Header().Get("Content-Encoding") != "gzip" {
+		t.Fatal("expected gzip response")
+	}
+	it, gt := identity.Header().Get("ETag"), gz.Header().Get("ETag")
+	if strings.HasPrefix(it, "W/") || gt != "W/"+it {
+		t.Errorf("expected strong identity ETag and weak gzip ETag, got %q and %q", it, gt)
+	}
+
+	// the weak ETag still validates the cached response
+	if w := get("gzip", gt); w.Code != http.StatusNotModified {
+		t.Errorf("expected 304, got %d", w.Code)
+	}
+}
@@ -0,0 +1,250 @@
+// Package cors implements a Cross-Origin Resource Sharing middleware
+package cors
+
+import (
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/gorilla/pat"
+	"github.com/ian-kent/service.go/handlers/route"
+	"github.com/ian-kent/service.go/log"
+)
+
+// DefaultMethods are the methods allowed if a policy doesn't set any
+var DefaultMethods = []string{"GET", "HEAD", "POST"}
+
+// DefaultHeaders are the request headers allowed if a policy doesn't set any
+var DefaultHeaders = []string{"Accept", "Content-Type", "X-Requested-With"}
+
+// Policy is a CORS policy
+type Policy struct {
+	// AllowedOrigins is a list of allowed origins
+	//
+	// Origins can be exact, e.g. "https://example.com", a wildcard
+	// subdomain, e.g. "https://*.example.com", or "*" to allow any origin.
+	AllowedOrigins []string
+	// AllowedOriginPatterns is a list of regular expressions matching allowed origins
+	AllowedOriginPatterns []*regexp.Regexp
+	// AllowedMethods is a list of methods allowed in preflight requests
+	AllowedMethods []string
+	// AllowedHeaders is a list of request headers allowed in preflight
+	// requests, or "*" to allow any header
+	AllowedHeaders []string
+	// ExposedHeaders is a list of response headers exposed to the client
+	ExposedHeaders []string
+	// AllowCredentials allows requests with credentials
+	//
+	// Credentials can't be allowed for any origin, so AllowedOrigins
+	// can't contain "*" if AllowCredentials is set.
+	AllowCredentials bool
+	// MaxAge is how long preflight responses can be cached by the client
+	MaxAge time.Duration
+}
+
+// Config is the CORS middleware configuration
+type Config struct {
+	// Policy is the default policy
+	Policy
+	// Routes overrides Policy for individual routes
+	//
+	// Keys are a path prefix, e.g. "/public", and the most specific
+	// matching key is used, as described by route.Score.
+	Routes map[string]Policy
+	// Router, if set, is used to limit the methods allowed in preflight
+	// requests to those with a route registered for the request path
+	Router *pat.Router
+}
+
+// Handler returns a CORS middleware using the config
+//
+// Handler panics if a policy allows credentials for any origin.
+func Handler(cfg Config) func(http.Handler) http.Handler {
+	cfg.Policy.validate("")
+	for key, p := range cfg.Routes {
+		p.validate(key)
+	}
+
+	return func(h http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+			origin := req.Header.Get("Origin")
+			w.Header().Add("Vary", "Origin")
+
+			if len(origin) == 0 {
+				h.ServeHTTP(w, req)
+				return
+			}
+
+			p := cfg.policy(req)
+
+			if req.Method == "OPTIONS" && len(req.Header.Get("Access-Control-Request-Method")) > 0 {
+				cfg.preflight(w, req, p, origin)
+				return
+			}
+
+			if p.allowOrigin(origin) {
+				p.setOrigin(w, origin)
+				if len(p.ExposedHeaders) > 0 {
+					w.Header().Set("Access-Control-Expose-Headers", strings.Join(p.ExposedHeaders, ", "))
+				}
+			} else {
+				log.TraceR(req, "cors origin not allowed", log.Data{"origin": origin})
+			}
+
+			h.ServeHTTP(w, req)
+		})
+	}
+}
+
+func (cfg Config) policy(req *http.Request) Policy {
+	p, n := cfg.Policy, -1
+	for key, rp := range cfg.Routes {
+		if score := route.Score(req, key); score > n {
+			p, n = rp, score
+		}
+	}
+	return p
+}
+
+// validate panics if the policy allows credentials for any origin,
+// which would let any website make credentialed requests
+func (p Policy) validate(route string) {
+	if p.AllowCredentials && contains(p.AllowedOrigins, "*") {
+		if len(route) > 0 {
+			panic("cors: policy for " + route + " allows credentials for any origin")
+		}
+		panic("cors: policy allows credentials for any origin")
+	}
+}
+
+func (cfg Config) preflight(w http.ResponseWriter, req *http.Request, p Policy, origin string) {
+	w.Header().Add("Vary", "Access-Control-Request-Method")
+	w.Header().Add("Vary", "Access-Control-Request-Headers")
+
+	if !p.allowOrigin(origin) {
+		log.TraceR(req, "cors preflight origin not allowed", log.Data{"origin": origin})
+		w.WriteHeader(http.StatusForbidden)
+		return
+	}
+
+	methods := cfg.methods(req, p)
+	if len(methods) == 0 {
+		log.TraceR(req, "cors preflight for unknown route", nil)
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+
+	method := strings.ToUpper(req.Header.Get("Access-Control-Request-Method"))
+	if !contains(methods, method) {
+		log.TraceR(req, "cors preflight method not allowed", log.Data{"method": method, "allowed": methods})
+		w.WriteHeader(http.StatusForbidden)
+		return
+	}
+
+	var headers []string
+	for _, hdr := range strings.Split(req.Header.Get("Access-Control-Request-Headers"), ",") {
+		hdr = strings.TrimSpace(hdr)
+		if len(hdr) == 0 {
+			continue
+		}
+		if !p.allowHeader(hdr) {
+			log.TraceR(req, "cors preflight header not allowed", log.Data{"header": hdr})
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+		headers = append(headers, hdr)
+	}
+
+	p.setOrigin(w, origin)
+	w.Header().Set("Access-Control-Allow-Methods", strings.Join(methods, ", "))
+	if len(headers) > 0 {
+		w.Header().Set("Access-Control-Allow-Headers", strings.Join(headers, ", "))
+	}
+	if p.MaxAge > 0 {
+		w.Header().Set("Access-Control-Max-Age", strconv.Itoa(int(p.MaxAge/time.Second)))
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// methods returns the methods allowed for the request path
+func (cfg Config) methods(req *http.Request, p Policy) []string {
+	allowed := p.AllowedMethods
+	if len(allowed) == 0 {
+		allowed = DefaultMethods
+	}
+	if cfg.Router == nil {
+		return allowed
+	}
+
+	var methods []string
+	for _, m := range allowed {
+		r := req.Clone(req.Context())
+		r.Method = m
+		var match mux.RouteMatch
+		if cfg.Router.Match(r, &match) {
+			methods = append(methods, m)
+		}
+	}
+	return methods
+}
+
+func (p Policy) allowOrigin(origin string) bool {
+	lc := strings.ToLower(origin)
+	for _, o := range p.AllowedOrigins {
+		o = strings.ToLower(o)
+		switch {
+		case o == "*", o == lc:
+			return true
+		case strings.Contains(o, "://*."):
+			// wildcard subdomain, e.g. https://*.example.com
+			i := strings.Index(o, "*")
+			prefix, suffix := o[:i], o[i+1:]
+			if strings.HasPrefix(lc, prefix) && strings.HasSuffix(lc, suffix) &&
+				len(lc) > len(prefix)+len(suffix) {
+				return true
+			}
+		}
+	}
+	for _, re := range p.AllowedOriginPatterns {
+		if re.MatchString(origin) {
+			return true
+		}
+	}
+	return false
+}
+
+func (p Policy) allowHeader(hdr string) bool {
+	allowed := p.AllowedHeaders
+	if len(allowed) == 0 {
+		allowed = DefaultHeaders
+	}
+	for _, h := range allowed {
+		if h == "*" || strings.EqualFold(h, hdr) {
+			return true
+		}
+	}
+	return false
+}
+
+func (p Policy) setOrigin(w http.ResponseWriter, origin string) {
+	if contains(p.AllowedOrigins, "*") {
+		w.Header().Set("Access-Control-Allow-Origin", "*")
+	} else {
+		w.Header().Set("Access-Control-Allow-Origin", origin)
+	}
+	if p.AllowCredentials {
+		w.Header().Set("Access-Control-Allow-Credentials", "true")
+	}
+}
+
+func contains(s []string, v string) bool {
+	for _, i := range s {
+		if i == v {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,121 @@
+package cors
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"testing"
+	"time"
+
+	"github.com/gorilla/pat"
+)
+
+func TestAllowOrigin(t *testing.T) {
+	p := Policy{
+		AllowedOrigins:        []string{"https://example.com", "https://*.example.org"},
+		AllowedOriginPatterns: []*regexp.Regexp{regexp.MustCompile(`^http://localhost:\d+$`)},
+	}
+
+	tests := map[string]bool{
+		"https://example.com":       true,
+		"https://EXAMPLE.com":       true,
+		"http://example.com":        false,
+		"https://a.example.org":     true,
+		"https://a.b.example.org":   true,
+		"https://example.org":       false,
+		"https://evilexample.org":   false,
+		"http://localhost:8080":     true,
+		"http://localhost.evil.com": false,
+	}
+
+	for origin, ok := range tests {
+		if p.allowOrigin(origin) != ok {
+			t.Errorf("%s: expected %t", origin, ok)
+		}
+	}
+}
+
+func TestPreflight(t *testing.T) {
+	r := pat.New()
+	r.Get("/things", func(w http.ResponseWriter, req *http.Request) {})
+	r.Post("/things", func(w http.ResponseWriter, req *http.Request) {})
+
+	h := Handler(Config{
+		Policy: Policy{
+			AllowedOrigins:   []string{"https://example.com"},
+			AllowedMethods:   []string{"GET", "POST", "DELETE"},
+			AllowedHeaders:   []string{"Content-Type", "Authorization"},
+			AllowCredentials: true,
+			MaxAge:           time.Hour,
+		},
+		Router: r,
+	})(r)
+
+	tests := []struct {
+		method, headers string
+		status          int
+		allowMethods    string
+	}{
+		{"POST", "content-type", http.StatusNoContent, "GET, POST"},
+		{"DELETE", "", http.StatusForbidden, ""},
+		{"POST", "X-Other", http.StatusForbidden, ""},
+	}
+
+	for _, test := range tests {
+		w := httptest.NewRecorder()
+		req, _ := http.NewRequest("OPTIONS", "/things", nil)
+		req.Header.Set("Origin", "https://example.com")
+		req.Header.Set("Access-Control-Request-Method", test.method)
+		req.Header.Set("Access-Control-Request-Headers", test.headers)
+		h.ServeHTTP(w, req)
+
+		if w.Code != test.status {
+			t.Errorf("%s: expected status %d, got %d", test.method, test.status, w.Code)
+		}
+		if m := w.Header().Get("Access-Control-Allow-Methods"); m != test.allowMethods {
+			t.Errorf("%s: expected allowed methods %q, got %q", test.method, test.allowMethods, m)
+		}
+		if test.status == http.StatusNoContent {
+			if o := w.Header().Get("Access-Control-Allow-Origin"); o != "https://example.com" {
+				t.Errorf("unexpected allowed origin %q", o)
+			}
+			if a := w.Header().Get("Access-Control-Max-Age"); a != "3600" {
+				t.Errorf("unexpected max age %q", a)
+			}
+		}
+	}
+}
+
+func TestRoutePolicy(t *testing.T) {
+	h := Handler(Config{
+		Policy: Policy{AllowedOrigins: []string{"https://example.com"}},
+		Routes: map[string]Policy{"/public": {AllowedOrigins: []string{"*"}}},
+	})(http.NotFoundHandler())
+
+	for path, origin := range map[string]string{"/private": "", "/public/thing": "*"} {
+		w := httptest.NewRecorder()
+		req, _ := http.NewRequest("GET", path, nil)
+		req.Header.Set("Origin", "https://other.com")
+		h.ServeHTTP(w, req)
+
+		if o := w.Header().Get("Access-Control-Allow-Origin"); o != origin {
+			t.Errorf("%s: expected allowed origin %q, got %q", path, origin, o)
+		}
+	}
+}
+
+func TestCredentialsWithAnyOrigin(t *testing.T) {
+	for name, cfg := range map[string]Config{
+		"policy": {Policy: Policy{AllowedOrigins: []string{"*"}, AllowCredentials: true}},
+		"route":  {Routes: map[string]Policy{"/public": {AllowedOrigins: []string{"*"}, AllowCredentials: true}}},
+	} {
+		func() {
+			defer func() {
+				if recover() == nil {
+					t.Errorf("%s: expected panic for credentials with any origin", name)
+				}
+			}()
+			Handler(cfg)
+		}()
+	}
+}
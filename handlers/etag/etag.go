@@ -0,0 +1,280 @@
+// Package etag implements a middleware which adds ETags to responses
+// and handles conditional requests
+package etag
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/ian-kent/service.go/api/response"
+)
+
+// Config is the ETag middleware configuration
+type Config struct {
+	// Weak generates weak ETags
+	//
+	// If-Match uses strong comparison, so weak ETags can't be used
+	// for preconditions on unsafe requests.
+	Weak bool
+	// MaxSize is the largest response which is buffered to generate
+	// an ETag, 1MB if zero. Larger responses are streamed without one.
+	MaxSize int
+	// Current returns the current ETag and modification time of the
+	// resource for preconditions on PUT, PATCH and DELETE requests
+	//
+	// An empty ETag and zero time with a nil error means the resource
+	// doesn't exist. If nil, preconditions aren't evaluated by the
+	// middleware and handlers should use Precondition.
+	Current func(req *http.Request) (etag string, modified time.Time, err error)
+}
+
+// DefaultConfig is the configuration used by DefaultHandler
+var DefaultConfig = Config{}
+
+// DefaultHandler is an ETag middleware using DefaultConfig
+func DefaultHandler(h http.Handler) http.Handler {
+	return Handler(DefaultConfig)(h)
+}
+
+// Compute returns an ETag for the body
+func Compute(body []byte, weak bool) string {
+	sum := sha256.Sum256(body)
+	tag := `"` + hex.EncodeToString(sum[:16]) + `"`
+	if weak {
+		return "W/" + tag
+	}
+	return tag
+}
+
+// Handler returns an ETag middleware using the config
+//
+// GET and HEAD responses are buffered and given an ETag, unless the
+// handler sets one. Requests with a matching If-None-Match, or with an
+// If-Modified-Since no earlier than the Last-Modified header, receive a
+// 304 response. PUT, PATCH and DELETE requests with an If-Match or
+// If-Unmodified-Since precondition which fails receive a 412 problem,
+// if the config has a Current function.
+//
+// Preconditions are checked before the handler runs, so two concurrent
+// writes can both pass. Handlers get the ETag which was checked from
+// FromContext, and should only apply the write if it's still current.
+func Handler(cfg Config) func(http.Handler) http.Handler {
+	if cfg.MaxSize == 0 {
+		cfg.MaxSize = 1 << 20
+	}
+
+	return func(h http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+			switch req.Method {
+			case "GET", "HEAD":
+				cfg.serveConditional(w, req, h)
+			case "PUT", "PATCH", "DELETE":
+				if cfg.Current == nil || len(req.Header.Get("If-Match")) == 0 && len(req.Header.Get("If-Unmodified-Since")) == 0 {
+					h.ServeHTTP(w, req)
+					return
+				}
+				tag, modified, err := cfg.Current(req)
+				if err != nil {
+					response.InternalServerError(w, req, err)
+					return
+				}
+				if !Precondition(req, tag, modified) {
+					response.Error(w, req, http.StatusPreconditionFailed, "precondition failed")
+					return
+				}
+				h.ServeHTTP(w, req.WithContext(context.WithValue(req.Context(), contextKey{}, tag)))
+			default:
+				h.ServeHTTP(w, req)
+			}
+		})
+	}
+}
+
+func (cfg Config) serveConditional(w http.ResponseWriter, req *http.Request, h http.Handler) {
+	bw := &bufferedWriter{ResponseWriter: w, max: cfg.MaxSize}
+	h.ServeHTTP(bw, req)
+	if bw.streaming {
+		return
+	}
+	if bw.status == 0 {
+		bw.status = http.StatusOK
+	}
+
+	hdr := w.Header()
+	if bw.status == http.StatusOK {
+		tag := hdr.Get("ETag")
+		if len(tag) == 0 && (bw.buf.Len() > 0 || req.Method == "GET") {
+			tag = Compute(bw.buf.Bytes(), cfg.Weak)
+			hdr.Set("ETag", tag)
+		}
+
+		if notModified(req, tag, hdr.Get("Last-Modified")) {
+			for _, k := range []string{"Content-Type", "Content-Length", "Content-Encoding"} {
+				hdr.Del(k)
+			}
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+	}
+
+	w.WriteHeader(bw.status)
+	w.Write(bw.buf.Bytes())
+}
+
+// notModified evaluates If-None-Match and If-Modified-Since
+func notModified(req *http.Request, tag, lastModified string) bool {
+	if inm := req.Header.Get("If-None-Match"); len(inm) > 0 {
+		return len(tag) > 0 && match(inm, tag, false)
+	}
+
+	ims, err := http.ParseTime(req.Header.Get("If-Modified-Since"))
+	if err != nil {
+		return false
+	}
+	lm, err := http.ParseTime(lastModified)
+	if err != nil {
+		return false
+	}
+	return !lm.After(ims)
+}
+
+type contextKey struct{}
+
+// FromContext returns the current ETag of the resource which the
+// request's preconditions were evaluated against
+//
+// The check and the write aren't atomic, so the update should only be
+// applied if the stored ETag still matches, for example with
+// UPDATE ... WHERE etag = ?, and fail with a 412 otherwise.
+func FromContext(ctx context.Context) (string, bool) {
+	tag, ok := ctx.Value(contextKey{}).(string)
+	return tag, ok
+}
+
+// Precondition evaluates the If-Match and If-Unmodified-Since headers
+// of the request against the current ETag and modification time of
+// the resource, and returns false if the request should fail with a 412
+//
+// An empty tag means the resource doesn't exist.
+func Precondition(req *http.Request, tag string, modified time.Time) bool {
+	if im := req.Header.Get("If-Match"); len(im) > 0 {
+		if len(tag) == 0 {
+			return false
+		}
+		return strings.TrimSpace(im) == "*" || match(im, tag, true)
+	}
+
+	ius, err := http.ParseTime(req.Header.Get("If-Unmodified-Since"))
+	if err != nil || modified.IsZero() {
+		// the precondition is ignored if it can't be evaluated
+		return true
+	}
+	return !modified.After(ius)
+}
+
+// match reports whether the tag matches any entity tag in the header,
+// using strong or weak comparison
+func match(header, tag string, strong bool) bool {
+	if strong && strings.HasPrefix(tag, "W/") {
+		return false
+	}
+	tag = strings.TrimPrefix(tag, "W/")
+
+	for _, t := range strings.Split(header, ",") {
+		t = strings.TrimSpace(t)
+		if t == "*" {
+			return true
+		}
+		if strings.HasPrefix(t, "W/") {
+			if strong {
+				continue
+			}
+			t = t[2:]
+		}
+		if t == tag {
+			return true
+		}
+	}
+	return false
+}
+
+// bufferedWriter buffers the response until it exceeds max, or the
+// handler flushes or hijacks the connection
+type bufferedWriter struct {
+	http.ResponseWriter
+	max       int
+	status    int
+	buf       bytes.Buffer
+	streaming bool
+}
+
+func (b *bufferedWriter) WriteHeader(status int) {
+	if b.streaming {
+		b.ResponseWriter.WriteHeader(status)
+		return
+	}
+	if b.status == 0 {
+		b.status = status
+	}
+}
+
+func (b *bufferedWriter) Write(p []byte) (int, error) {
+	if b.streaming {
+		return b.ResponseWriter.Write(p)
+	}
+	if b.status == 0 {
+		b.status = http.StatusOK
+	}
+	if b.buf.Len()+len(p) > b.max {
+		if err := b.stream(); err != nil {
+			return 0, err
+		}
+		return b.ResponseWriter.Write(p)
+	}
+	return b.buf.Write(p)
+}
+
+// stream writes the buffered response and stops buffering
+func (b *bufferedWriter) stream() error {
+	if b.streaming {
+		return nil
+	}
+	b.streaming = true
+	if b.status == 0 {
+		return nil
+	}
+	b.ResponseWriter.WriteHeader(b.status)
+	_, err := b.ResponseWriter.Write(b.buf.Bytes())
+	b.buf.Reset()
+	return err
+}
+
+func (b *bufferedWriter) Flush() {
+	if f, ok := b.ResponseWriter.(http.Flusher); ok {
+		b.stream()
+		f.Flush()
+	}
+}
+
+func (b *bufferedWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	if hj, ok := b.ResponseWriter.(http.Hijacker); ok {
+		b.streaming = true
+		return hj.Hijack()
+	}
+	return nil, nil, errors.New("etag: ResponseWriter does not implement http.Hijacker")
+}
+
+func (b *bufferedWriter) Push(target string, opts *http.PushOptions) error {
+	if p, ok := b.ResponseWriter.(http.Pusher); ok {
+		return p.Push(target, opts)
+	}
+	return http.ErrNotSupported
+}
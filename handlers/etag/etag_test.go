@@ -0,0 +1,157 @@
+package etag
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestConditionalGet(t *testing.T) {
+	h := DefaultHandler(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.Header().Set("Content-Type", "text/plain")
+		w.Write([]byte("hello"))
+	}))
+
+	rr := httptest.NewRecorder()
+	h.ServeHTTP(rr, httptest.NewRequest("GET", "/", nil))
+	tag := rr.Header().Get("ETag")
+	if rr.Code != http.StatusOK || rr.Body.String() != "hello" || len(tag) == 0 {
+		t.Fatalf("unexpected response: %d %q %q", rr.Code, rr.Body.String(), tag)
+	}
+
+	req := httptest.NewRequest("GET", "/", nil)
+	req.Header.Set("If-None-Match", `"other", W/`+tag)
+	rr = httptest.NewRecorder()
+	h.ServeHTTP(rr, req)
+	if rr.Code != http.StatusNotModified || rr.Body.Len() > 0 {
+		t.Errorf("expected 304, got %d %q", rr.Code, rr.Body.String())
+	}
+}
+
+// thing is a resource whose updates compare and swap its ETag
+type thing struct {
+	mu  sync.Mutex
+	tag string
+}
+
+func (th *thing) current(req *http.Request) (string, time.Time, error) {
+	th.mu.Lock()
+	defer th.mu.Unlock()
+	return th.tag, time.Time{}, nil
+}
+
+func (th *thing) handler(updated *int32) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		expected, _ := FromContext(req.Context())
+		th.mu.Lock()
+		defer th.mu.Unlock()
+		if th.tag != expected {
+			w.WriteHeader(http.StatusPreconditionFailed)
+			return
+		}
+		n := atomic.AddInt32(updated, 1)
+		th.tag = `"v` + strconv.Itoa(int(n)+1) + `"`
+		w.WriteHeader(http.StatusNoContent)
+	})
+}
+
+func TestIfMatch(t *testing.T) {
+	tests := []struct {
+		ifMatch string
+		status  int
+	}{
+		{`"v0"`, http.StatusPreconditionFailed},
+		{`W/"v1"`, http.StatusPreconditionFailed},
+		{`"v0", "v1"`, http.StatusNoContent},
+		{`*`, http.StatusNoContent},
+	}
+
+	for _, tt := range tests {
+		var updated int32
+		th := &thing{tag: `"v1"`}
+		h := Handler(Config{Current: th.current})(th.handler(&updated))
+
+		req := httptest.NewRequest("PUT", "/thing", nil)
+		req.Header.Set("If-Match", tt.ifMatch)
+		rr := httptest.NewRecorder()
+		h.ServeHTTP(rr, req)
+		if rr.Code != tt.status {
+			t.Errorf("If-Match %s: expected %d, got %d", tt.ifMatch, tt.status, rr.Code)
+		}
+		if (updated == 1) != (tt.status == http.StatusNoContent) {
+			t.Errorf("If-Match %s: unexpected update", tt.ifMatch)
+		}
+	}
+}
+
+func TestIfMatchConcurrent(t *testing.T) {
+	var updated int32
+	th := &thing{tag: `"v1"`}
+	h := Handler(Config{Current: th.current})(th.handler(&updated))
+
+	var wg sync.WaitGroup
+	codes := make(chan int, 10)
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			req := httptest.NewRequest("PUT", "/thing", nil)
+			req.Header.Set("If-Match", `"v1"`)
+			rr := httptest.NewRecorder()
+			h.ServeHTTP(rr, req)
+			codes <- rr.Code
+		}()
+	}
+	wg.Wait()
+	close(codes)
+
+	var ok int
+	for c := range codes {
+		switch c {
+		case http.StatusNoContent:
+			ok++
+		case http.StatusPreconditionFailed:
+		default:
+			t.Errorf("unexpected status %d", c)
+		}
+	}
+	if ok != 1 || updated != 1 {
+		t.Errorf("expected exactly one write to succeed, got %d responses and %d updates", ok, updated)
+	}
+}
+
+func TestHandlerETag(t *testing.T) {
+	var calls int
+	h := DefaultHandler(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		calls++
+		w.Header().Set("ETag", `"v1"`)
+		w.Write([]byte("thing"))
+	}))
+
+	rr := httptest.NewRecorder()
+	h.ServeHTTP(rr, httptest.NewRequest("GET", "/thing", nil))
+	if tag := rr.Header().Get("ETag"); tag != `"v1"` {
+		t.Errorf("expected handler ETag, got %q", tag)
+	}
+
+	req := httptest.NewRequest("GET", "/thing", nil)
+	req.Header.Set("If-None-Match", `"v1"`)
+	rr = httptest.NewRecorder()
+	h.ServeHTTP(rr, req)
+	if rr.Code != http.StatusNotModified {
+		t.Errorf("expected 304, got %d", rr.Code)
+	}
+
+	// without Current, preconditions are left to the handler
+	req = httptest.NewRequest("PUT", "/thing", nil)
+	req.Header.Set("If-Match", `"v0"`)
+	rr = httptest.NewRecorder()
+	h.ServeHTTP(rr, req)
+	if calls != 3 || Precondition(req, `"v1"`, time.Time{}) {
+		t.Errorf("expected handler to evaluate the precondition, got %d calls", calls)
+	}
+}
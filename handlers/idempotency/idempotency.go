@@ -0,0 +1,288 @@
+// Package idempotency implements a middleware which makes unsafe
+// requests idempotent using the Idempotency-Key header
+package idempotency
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"time"
+
+	"github.com/ian-kent/service.go/api/response"
+	"github.com/ian-kent/service.go/auth"
+	"github.com/ian-kent/service.go/handlers/proxy"
+	"github.com/ian-kent/service.go/log"
+)
+
+// ReplayedHeader is set on replayed responses
+var ReplayedHeader = "Idempotent-Replayed"
+
+// MaxKeyLength is the maximum length of an idempotency key
+var MaxKeyLength = 255
+
+// Config is the idempotency middleware configuration
+type Config struct {
+	// Store holds the idempotency records, a new MemoryStore if nil
+	Store Store
+	// Header is the idempotency key header, "Idempotency-Key" if empty
+	Header string
+	// Methods are the methods the key is honoured for, POST and PATCH if empty
+	Methods []string
+	// Required rejects requests without a key with a 400 problem
+	Required bool
+	// TTL is how long responses are stored, 24 hours if zero
+	TTL time.Duration
+	// LockTimeout is how long a key is reserved for an in-flight
+	// request, one minute if zero
+	LockTimeout time.Duration
+	// MaxResponseSize is the largest response body which is stored,
+	// 1MB if zero. Larger responses aren't replayed.
+	MaxResponseSize int
+}
+
+// Handler returns an idempotency middleware using the config
+//
+// Keys are scoped to the authenticated principal, so the middleware
+// should be added after auth.Handler. Keys on anonymous requests are
+// scoped to the client IP address, using proxy.ClientIP.
+//
+// The first response for a key is stored and replayed for repeated
+// requests. A repeated request while the first is in flight receives
+// a 409 problem, and reusing a key with a different request receives
+// a 422 problem. Server errors aren't stored so the request can be
+// retried.
+//
+// A request which outlives LockTimeout loses its reservation, and a
+// retry may then run; the first request's response is then neither
+// stored nor able to release the retry's reservation.
+func Handler(cfg Config) func(http.Handler) http.Handler {
+	if cfg.Store == nil {
+		cfg.Store = NewMemoryStore()
+	}
+	if len(cfg.Header) == 0 {
+		cfg.Header = "Idempotency-Key"
+	}
+	if len(cfg.Methods) == 0 {
+		cfg.Methods = []string{"POST", "PATCH"}
+	}
+	if cfg.TTL == 0 {
+		cfg.TTL = 24 * time.Hour
+	}
+	if cfg.LockTimeout == 0 {
+		cfg.LockTimeout = time.Minute
+	}
+	if cfg.MaxResponseSize == 0 {
+		cfg.MaxResponseSize = 1 << 20
+	}
+
+	methods := make(map[string]bool)
+	for _, m := range cfg.Methods {
+		methods[m] = true
+	}
+
+	return func(h http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+			if !methods[req.Method] {
+				h.ServeHTTP(w, req)
+				return
+			}
+
+			key := req.Header.Get(cfg.Header)
+			if len(key) == 0 {
+				if cfg.Required {
+					response.BadRequest(w, req, cfg.Header+" header is required")
+					return
+				}
+				h.ServeHTTP(w, req)
+				return
+			}
+			if len(key) > MaxKeyLength {
+				response.BadRequest(w, req, cfg.Header+" header is too long")
+				return
+			}
+
+			b, err := ioutil.ReadAll(req.Body)
+			if err != nil {
+				var mbe *http.MaxBytesError
+				if errors.As(err, &mbe) {
+					response.Error(w, req, http.StatusRequestEntityTooLarge, "request body too large")
+					return
+				}
+				response.BadRequest(w, req, "error reading request body")
+				return
+			}
+			req.Body = ioutil.NopCloser(bytes.NewReader(b))
+
+			key = scope(req) + key
+			fp := fingerprint(req, b)
+
+			rec, token, err := cfg.Store.Begin(key, fp, cfg.LockTimeout)
+			if err != nil {
+				// fail open, a store outage shouldn't take down the service
+				log.ErrorR(req, err, nil)
+				h.ServeHTTP(w, req)
+				return
+			}
+
+			if rec != nil {
+				switch {
+				case rec.Fingerprint != fp:
+					response.Error(w, req, http.StatusUnprocessableEntity, cfg.Header+" has been used with a different request")
+				case !rec.Completed:
+					w.Header().Set("Retry-After", "1")
+					response.Error(w, req, http.StatusConflict, "a request with this "+cfg.Header+" is in progress")
+				default:
+					log.DebugR(req, "replaying idempotent response", log.Data{"status": rec.Status})
+					replay(w, rec)
+				}
+				return
+			}
+
+			rr := &recorder{ResponseWriter: w, max: cfg.MaxResponseSize, before: w.Header().Clone()}
+			completed := false
+			defer func() {
+				if !completed {
+					if err := cfg.Store.Release(key, token); err != nil {
+						log.ErrorR(req, err, nil)
+					}
+				}
+			}()
+
+			h.ServeHTTP(rr, req)
+
+			if rr.storable() {
+				rec := &Record{Fingerprint: fp, Status: rr.status, Header: rr.header, Body: rr.body.Bytes()}
+				if err := cfg.Store.Complete(key, token, rec, cfg.TTL); err != nil {
+					log.ErrorR(req, err, nil)
+					return
+				}
+				completed = true
+			}
+		})
+	}
+}
+
+// scope returns the key prefix for the authenticated principal, or
+// the client IP address for anonymous requests so clients can't
+// replay each other's responses
+func scope(req *http.Request) string {
+	if p := auth.Get(req); p != nil {
+		return p.Method + ":" + p.ID + ":"
+	}
+	return "ip:" + proxy.ClientIP(req) + ":"
+}
+
+// fingerprint identifies a request by its method, URI and body
+func fingerprint(req *http.Request, body []byte) string {
+	s := sha256.New()
+	s.Write([]byte(req.Method + " " + req.URL.RequestURI() + "\n"))
+	s.Write(body)
+	return hex.EncodeToString(s.Sum(nil))
+}
+
+func replay(w http.ResponseWriter, rec *Record) {
+	hdr := w.Header()
+	for k, v := range rec.Header {
+		hdr[k] = v
+	}
+	hdr.Set(ReplayedHeader, "true")
+	w.WriteHeader(rec.Status)
+	w.Write(rec.Body)
+}
+
+// recorder writes the response and records it so it can be replayed
+//
+// Only headers set by the wrapped handler are recorded, since headers
+// set by outer middleware, like X-Request-Id, belong to the request
+// being served and are set again on the replayed response.
+type recorder struct {
+	http.ResponseWriter
+	max      int
+	status   int
+	before   http.Header
+	header   http.Header
+	body     bytes.Buffer
+	overflow bool
+	hijacked bool
+}
+
+func (r *recorder) WriteHeader(status int) {
+	if r.status == 0 {
+		r.status = status
+		r.header = r.handlerHeader()
+	}
+	r.ResponseWriter.WriteHeader(status)
+}
+
+// handlerHeader returns the headers set or changed by the wrapped handler
+func (r *recorder) handlerHeader() http.Header {
+	hdr := make(http.Header)
+	for k, v := range r.ResponseWriter.Header() {
+		if equal(r.before[k], v) {
+			continue
+		}
+		hdr[k] = append([]string(nil), v...)
+	}
+	return hdr
+}
+
+func equal(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+func (r *recorder) Write(b []byte) (int, error) {
+	if r.status == 0 {
+		r.WriteHeader(http.StatusOK)
+	}
+	if !r.overflow {
+		if r.body.Len()+len(b) > r.max {
+			r.overflow = true
+			r.body.Reset()
+		} else {
+			r.body.Write(b)
+		}
+	}
+	return r.ResponseWriter.Write(b)
+}
+
+func (r *recorder) storable() bool {
+	if r.status == 0 {
+		r.status = http.StatusOK
+		r.header = r.handlerHeader()
+	}
+	return !r.overflow && !r.hijacked && r.status < 500
+}
+
+func (r *recorder) Flush() {
+	if f, ok := r.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+func (r *recorder) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	if hj, ok := r.ResponseWriter.(http.Hijacker); ok {
+		r.hijacked = true
+		return hj.Hijack()
+	}
+	return nil, nil, errors.New("idempotency: ResponseWriter does not implement http.Hijacker")
+}
+
+func (r *recorder) Push(target string, opts *http.PushOptions) error {
+	if p, ok := r.ResponseWriter.(http.Pusher); ok {
+		return p.Push(target, opts)
+	}
+	return http.ErrNotSupported
+}
@@ -0,0 +1,204 @@
+package idempotency
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/ian-kent/service.go/handlers/requestID"
+)
+
+func TestIdempotency(t *testing.T) {
+	var calls int32
+	release := make(chan struct{})
+
+	h := Handler(Config{})(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		n := atomic.AddInt32(&calls, 1)
+		if req.URL.Path == "/slow" {
+			<-release
+		}
+		if n > 1 && req.URL.Path == "/things" {
+			t.Error("expected handler to be called once")
+		}
+		w.Header().Set("Location", "/things/1")
+		w.WriteHeader(http.StatusCreated)
+		w.Write([]byte(`{"id":1}`))
+	}))
+
+	do := func(path, key, body string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("POST", path, strings.NewReader(body))
+		req.Header.Set("Idempotency-Key", key)
+		rr := httptest.NewRecorder()
+		h.ServeHTTP(rr, req)
+		return rr
+	}
+
+	rr := do("/things", "a", "x")
+	if rr.Code != http.StatusCreated || len(rr.Header().Get(ReplayedHeader)) > 0 {
+		t.Errorf("unexpected first response: %d %v", rr.Code, rr.Header())
+	}
+
+	rr = do("/things", "a", "x")
+	if rr.Code != http.StatusCreated || rr.Body.String() != `{"id":1}` || rr.Header().Get("Location") != "/things/1" {
+		t.Errorf("expected replayed response, got %d %q", rr.Code, rr.Body.String())
+	}
+	if rr.Header().Get(ReplayedHeader) != "true" {
+		t.Error("expected replayed header")
+	}
+
+	if rr = do("/things", "a", "y"); rr.Code != http.StatusUnprocessableEntity {
+		t.Errorf("expected 422 for a different body, got %d", rr.Code)
+	}
+
+	done := make(chan struct{})
+	go func() {
+		do("/slow", "b", "x")
+		close(done)
+	}()
+	for atomic.LoadInt32(&calls) < 2 {
+		// wait for the first request to start
+		time.Sleep(time.Millisecond)
+	}
+	if rr = do("/slow", "b", "x"); rr.Code != http.StatusConflict {
+		t.Errorf("expected 409 for an in-flight request, got %d", rr.Code)
+	}
+	close(release)
+	<-done
+}
+
+func TestServerErrorNotStored(t *testing.T) {
+	var calls int
+	h := Handler(Config{})(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		calls++
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+
+	for i := 0; i < 2; i++ {
+		req := httptest.NewRequest("POST", "/", nil)
+		req.Header.Set("Idempotency-Key", "a")
+		h.ServeHTTP(httptest.NewRecorder(), req)
+	}
+
+	if calls != 2 {
+		t.Errorf("expected server errors to be retried, got %d calls", calls)
+	}
+}
+
+func TestAnonymousScope(t *testing.T) {
+	var calls int32
+	h := Handler(Config{})(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		atomic.AddInt32(&calls, 1)
+		w.WriteHeader(http.StatusCreated)
+	}))
+
+	for _, addr := range []string{"1.2.3.4:1234", "5.6.7.8:1234", "1.2.3.4:5678"} {
+		req := httptest.NewRequest("POST", "/things", strings.NewReader("x"))
+		req.RemoteAddr = addr
+		req.Header.Set("Idempotency-Key", "a")
+		h.ServeHTTP(httptest.NewRecorder(), req)
+	}
+
+	// each client has its own keys
+	if n := atomic.LoadInt32(&calls); n != 2 {
+		t.Errorf("expected handler to be called once per client, got %d", n)
+	}
+}
+
+func TestReplayHeaders(t *testing.T) {
+	h := Handler(Config{})(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.Header().Set("Location", "/things/1")
+		w.WriteHeader(http.StatusCreated)
+	}))
+	// an outer middleware setting a per-request header
+	h = requestID.GeneratorHandler(requestID.Random(10))(h)
+
+	serve := func() *httptest.ResponseRecorder {
+		req := httptest.NewRequest("POST", "/things", strings.NewReader("x"))
+		req.Header.Set("Idempotency-Key", "a")
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, req)
+		return w
+	}
+
+	first, second := serve(), serve()
+	if second.Header().Get(ReplayedHeader) != "true" || second.Header().Get("Location") != "/things/1" {
+		t.Errorf("expected replayed response, got %v", second.Header())
+	}
+	if id := second.Header().Get(requestID.Header); len(id) == 0 || id == first.Header().Get(requestID.Header) {
+		t.Errorf("expected replayed response to have its own request ID, got %q", id)
+	}
+}
+
+func TestExpiredReservation(t *testing.T) {
+	release := make(chan struct{})
+	started := make(chan struct{}, 3)
+	h := Handler(Config{LockTimeout: 10 * time.Millisecond})(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		started <- struct{}{}
+		switch req.Header.Get("X-Test") {
+		case "fail":
+			<-release
+			w.WriteHeader(http.StatusServiceUnavailable)
+		case "block":
+			<-release
+			w.WriteHeader(http.StatusCreated)
+		default:
+			w.WriteHeader(http.StatusCreated)
+		}
+	}))
+
+	do := func(behaviour string) chan int {
+		code := make(chan int, 1)
+		go func() {
+			req := httptest.NewRequest("POST", "/things", strings.NewReader("x"))
+			req.Header.Set("Idempotency-Key", "a")
+			req.Header.Set("X-Test", behaviour)
+			w := httptest.NewRecorder()
+			h.ServeHTTP(w, req)
+			code <- w.Code
+		}()
+		return code
+	}
+
+	// the first request outlives its reservation and a retry reserves the key
+	first := do("fail")
+	<-started
+	time.Sleep(20 * time.Millisecond)
+	second := do("block")
+	<-started
+
+	// the first request fails, which mustn't release the retry's reservation
+	release <- struct{}{}
+	if c := <-first; c != http.StatusServiceUnavailable {
+		t.Fatalf("expected 503, got %d", c)
+	}
+	if c := <-do(""); c != http.StatusConflict {
+		t.Errorf("expected 409 while the retry is in flight, got %d", c)
+	}
+
+	close(release)
+	if c := <-second; c != http.StatusCreated {
+		t.Errorf("expected 201, got %d", c)
+	}
+}
+
+func TestMemoryStoreToken(t *testing.T) {
+	m := NewMemoryStore()
+	_, token, err := m.Begin("a", "fp", time.Minute)
+	if err != nil || len(token) == 0 {
+		t.Fatalf("expected reservation, got %q %v", token, err)
+	}
+
+	m.Release("a", "other")
+	if rec, _, _ := m.Begin("a", "fp", time.Minute); rec == nil {
+		t.Error("expected release with a different token to be ignored")
+	}
+	if err := m.Complete("a", "other", &Record{Status: 201}, time.Minute); err != ErrReservationLost {
+		t.Errorf("expected ErrReservationLost, got %v", err)
+	}
+	if err := m.Complete("a", token, &Record{Status: 201}, time.Minute); err != nil {
+		t.Error(err)
+	}
+}
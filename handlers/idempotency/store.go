@@ -0,0 +1,148 @@
+package idempotency
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// ErrReservationLost is returned by Complete when the reservation has
+// expired and the key has been reserved by another request
+var ErrReservationLost = errors.New("idempotency: reservation lost")
+
+// Record is the state of an idempotency key
+type Record struct {
+	// Fingerprint identifies the request which used the key
+	Fingerprint string
+	// Completed is false while the request is in flight
+	Completed bool
+
+	Status int
+	Header http.Header
+	Body   []byte
+}
+
+// Store holds idempotency records
+//
+// A shared store, for example backed by Redis, is needed to apply
+// idempotency across multiple instances of a service.
+type Store interface {
+	// Begin atomically reserves key for an in-flight request, and
+	// returns a token identifying the reservation. If the key already
+	// has a record, the existing record is returned and the key isn't
+	// reserved. The reservation can be discarded once ttl has passed.
+	Begin(key, fingerprint string, ttl time.Duration) (*Record, string, error)
+	// Complete stores the completed record for key, which can be
+	// discarded once ttl has passed, if the key is still reserved with
+	// token. Otherwise it returns ErrReservationLost.
+	Complete(key, token string, rec *Record, ttl time.Duration) error
+	// Release removes the reservation for key so the request can be
+	// retried, if the key is still reserved with token
+	Release(key, token string) error
+}
+
+// NewToken returns a random reservation token
+func NewToken() (string, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
+
+type memoryEntry struct {
+	record  Record
+	token   string
+	expires time.Time
+}
+
+// MemoryStore is an in-memory Store
+type MemoryStore struct {
+	mu        sync.Mutex
+	entries   map[string]*memoryEntry
+	lastSweep time.Time
+
+	// SweepInterval is how often expired records are removed
+	SweepInterval time.Duration
+}
+
+// NewMemoryStore returns a new MemoryStore
+func NewMemoryStore() *MemoryStore {
+	return &MemoryStore{
+		entries:       make(map[string]*memoryEntry),
+		SweepInterval: time.Minute,
+	}
+}
+
+// Begin implements Store.Begin
+func (m *MemoryStore) Begin(key, fingerprint string, ttl time.Duration) (*Record, string, error) {
+	token, err := NewToken()
+	if err != nil {
+		return nil, "", err
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	now := time.Now()
+	if now.Sub(m.lastSweep) > m.SweepInterval {
+		m.sweep(now)
+	}
+
+	if e, ok := m.entries[key]; ok && now.Before(e.expires) {
+		rec := e.record
+		return &rec, "", nil
+	}
+
+	m.entries[key] = &memoryEntry{
+		record:  Record{Fingerprint: fingerprint},
+		token:   token,
+		expires: now.Add(ttl),
+	}
+	return nil, token, nil
+}
+
+// Complete implements Store.Complete
+func (m *MemoryStore) Complete(key, token string, rec *Record, ttl time.Duration) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if e, ok := m.entries[key]; !ok || e.record.Completed || e.token != token {
+		return ErrReservationLost
+	}
+
+	r := *rec
+	r.Completed = true
+	m.entries[key] = &memoryEntry{record: r, expires: time.Now().Add(ttl)}
+	return nil
+}
+
+// Release implements Store.Release
+func (m *MemoryStore) Release(key, token string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if e, ok := m.entries[key]; ok && !e.record.Completed && e.token == token {
+		delete(m.entries, key)
+	}
+	return nil
+}
+
+func (m *MemoryStore) sweep(now time.Time) {
+	for k, e := range m.entries {
+		if now.After(e.expires) {
+			delete(m.entries, k)
+		}
+	}
+	m.lastSweep = now
+}
+
+// Len returns the number of keys in the store
+func (m *MemoryStore) Len() int {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return len(m.entries)
+}
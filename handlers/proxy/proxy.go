@@ -0,0 +1,267 @@
+// Package proxy implements a middleware which resolves the client IP,
+// scheme and host of requests received through trusted proxies
+package proxy
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"strings"
+
+	"github.com/ian-kent/service.go/log"
+)
+
+// Config is the trusted proxy configuration
+type Config struct {
+	// Trusted are the networks of trusted proxies
+	//
+	// Forwarded and X-Forwarded-* headers are ignored unless the
+	// immediate peer is in one of the networks.
+	Trusted []*net.IPNet
+}
+
+// DefaultConfig is the configuration used by DefaultHandler
+//
+// Services copy it and set Trusted from the HTTPConfig
+var DefaultConfig = Config{}
+
+// ParseCIDRs parses a list of CIDRs or IP addresses, logging and
+// ignoring any which are invalid
+func ParseCIDRs(cidrs []string) []*net.IPNet {
+	var nets []*net.IPNet
+	for _, cidr := range cidrs {
+		cidr = strings.TrimSpace(cidr)
+		if len(cidr) == 0 {
+			continue
+		}
+		if !strings.Contains(cidr, "/") {
+			if ip := net.ParseIP(cidr); ip != nil {
+				bits := 8 * net.IPv6len
+				if ip4 := ip.To4(); ip4 != nil {
+					ip, bits = ip4, 8*net.IPv4len
+				}
+				nets = append(nets, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+				continue
+			}
+		}
+		_, n, err := net.ParseCIDR(cidr)
+		if err != nil {
+			log.Error(err, log.Data{"cidr": cidr})
+			continue
+		}
+		nets = append(nets, n)
+	}
+	return nets
+}
+
+// Info is the resolved origin of a request
+type Info struct {
+	// ClientIP is the IP address of the client
+	ClientIP string
+	// Scheme is the scheme used by the client, "http" or "https"
+	Scheme string
+	// Host is the host requested by the client
+	Host string
+}
+
+type contextKey struct{}
+
+// NewContext returns a context containing the request info
+func NewContext(ctx context.Context, info Info) context.Context {
+	return context.WithValue(ctx, contextKey{}, info)
+}
+
+// FromContext returns the request info from a context
+func FromContext(ctx context.Context) (Info, bool) {
+	info, ok := ctx.Value(contextKey{}).(Info)
+	return info, ok
+}
+
+// Get returns the request info set by the middleware, or the info
+// from the request itself if the middleware hasn't been used
+func Get(req *http.Request) Info {
+	if info, ok := FromContext(req.Context()); ok {
+		return info
+	}
+	return direct(req)
+}
+
+// ClientIP returns the IP address of the client making the request
+func ClientIP(req *http.Request) string {
+	return Get(req).ClientIP
+}
+
+// Scheme returns the scheme used by the client making the request
+func Scheme(req *http.Request) string {
+	return Get(req).Scheme
+}
+
+// Host returns the host requested by the client making the request
+func Host(req *http.Request) string {
+	return Get(req).Host
+}
+
+// DefaultHandler is a trusted proxy middleware using DefaultConfig
+func DefaultHandler(h http.Handler) http.Handler {
+	return Handler(DefaultConfig)(h)
+}
+
+// Handler returns a trusted proxy middleware using the config
+func Handler(cfg Config) func(http.Handler) http.Handler {
+	return func(h http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+			info := cfg.Resolve(req)
+			h.ServeHTTP(w, req.WithContext(NewContext(req.Context(), info)))
+		})
+	}
+}
+
+func (cfg Config) trusted(ip net.IP) bool {
+	for _, n := range cfg.Trusted {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// direct returns the info for a request which didn't use a proxy
+func direct(req *http.Request) Info {
+	info := Info{
+		ClientIP: stripPort(req.RemoteAddr),
+		Scheme:   "http",
+		Host:     req.Host,
+	}
+	if req.TLS != nil {
+		info.Scheme = "https"
+	}
+	return info
+}
+
+// Resolve resolves the request info
+//
+// If the immediate peer is trusted, the client is the rightmost
+// address in the Forwarded (or X-Forwarded-For) header which isn't
+// itself trusted. The scheme and host are taken from the same
+// Forwarded element, or from the last X-Forwarded-Proto and
+// X-Forwarded-Host values.
+func (cfg Config) Resolve(req *http.Request) Info {
+	info := direct(req)
+
+	peer := net.ParseIP(info.ClientIP)
+	if peer == nil || !cfg.trusted(peer) {
+		return info
+	}
+
+	if fwd := req.Header["Forwarded"]; len(fwd) > 0 {
+		elems := parseForwarded(strings.Join(fwd, ","))
+		for i := len(elems) - 1; i >= 0; i-- {
+			ip := net.ParseIP(stripPort(elems[i]["for"]))
+			if ip == nil {
+				// obfuscated or unknown, so nothing further can be trusted
+				break
+			}
+			info.ClientIP = ip.String()
+			if proto := strings.ToLower(elems[i]["proto"]); proto == "http" || proto == "https" {
+				info.Scheme = proto
+			}
+			if host := elems[i]["host"]; validHost(host) {
+				info.Host = host
+			}
+			if !cfg.trusted(ip) {
+				break
+			}
+		}
+		return info
+	}
+
+	hops := values(req.Header["X-Forwarded-For"])
+	for i := len(hops) - 1; i >= 0; i-- {
+		ip := net.ParseIP(stripPort(hops[i]))
+		if ip == nil {
+			break
+		}
+		info.ClientIP = ip.String()
+		if !cfg.trusted(ip) {
+			break
+		}
+	}
+
+	if protos := values(req.Header["X-Forwarded-Proto"]); len(protos) > 0 {
+		if proto := strings.ToLower(protos[len(protos)-1]); proto == "http" || proto == "https" {
+			info.Scheme = proto
+		}
+	}
+	if hosts := values(req.Header["X-Forwarded-Host"]); len(hosts) > 0 && validHost(hosts[len(hosts)-1]) {
+		info.Host = hosts[len(hosts)-1]
+	}
+
+	return info
+}
+
+// values splits comma separated header values
+func values(hdr []string) []string {
+	var v []string
+	for _, h := range hdr {
+		for _, s := range strings.Split(h, ",") {
+			if s = strings.TrimSpace(s); len(s) > 0 {
+				v = append(v, s)
+			}
+		}
+	}
+	return v
+}
+
+// parseForwarded parses a Forwarded header (RFC 7239)
+func parseForwarded(s string) []map[string]string {
+	var elems []map[string]string
+	for _, e := range splitQuoted(s, ',') {
+		m := make(map[string]string)
+		for _, pair := range splitQuoted(e, ';') {
+			kv := strings.SplitN(pair, "=", 2)
+			if len(kv) != 2 {
+				continue
+			}
+			v := strings.TrimSpace(kv[1])
+			if len(v) >= 2 && v[0] == '"' && v[len(v)-1] == '"' {
+				v = v[1 : len(v)-1]
+			}
+			m[strings.ToLower(strings.TrimSpace(kv[0]))] = v
+		}
+		elems = append(elems, m)
+	}
+	return elems
+}
+
+// splitQuoted splits s on sep, ignoring separators in quoted strings
+func splitQuoted(s string, sep byte) []string {
+	var parts []string
+	quoted, start := false, 0
+	for i := 0; i < len(s); i++ {
+		switch s[i] {
+		case '"':
+			quoted = !quoted
+		case sep:
+			if !quoted {
+				parts = append(parts, strings.TrimSpace(s[start:i]))
+				start = i + 1
+			}
+		}
+	}
+	return append(parts, strings.TrimSpace(s[start:]))
+}
+
+// stripPort removes the port, and brackets from IPv6 addresses
+func stripPort(addr string) string {
+	if host, _, err := net.SplitHostPort(addr); err == nil {
+		return host
+	}
+	return strings.TrimSuffix(strings.TrimPrefix(addr, "["), "]")
+}
+
+func validHost(host string) bool {
+	if len(host) == 0 || len(host) > 255 {
+		return false
+	}
+	return !strings.ContainsAny(host, " /\\@?#\"")
+}
@@ -0,0 +1,48 @@
+package proxy
+
+import (
+	"net/http/httptest"
+	"testing"
+)
+
+func TestResolve(t *testing.T) {
+	cfg := Config{Trusted: ParseCIDRs([]string{"10.0.0.0/8", "192.168.1.1"})}
+
+	tests := []struct {
+		remote  string
+		headers map[string]string
+		want    Info
+	}{
+		{
+			remote:  "203.0.113.1:1234",
+			headers: map[string]string{"X-Forwarded-For": "1.2.3.4", "X-Forwarded-Proto": "https"},
+			want:    Info{ClientIP: "203.0.113.1", Scheme: "http", Host: "example.com"},
+		},
+		{
+			remote:  "10.0.0.1:1234",
+			headers: map[string]string{"X-Forwarded-For": "6.6.6.6, 1.2.3.4, 192.168.1.1", "X-Forwarded-Proto": "https", "X-Forwarded-Host": "public.example.com"},
+			want:    Info{ClientIP: "1.2.3.4", Scheme: "https", Host: "public.example.com"},
+		},
+		{
+			remote:  "10.0.0.1:1234",
+			headers: map[string]string{"Forwarded": `for=6.6.6.6, for="[2001:db8::1]:4711";proto=https;host=public.example.com, for=10.1.1.1`},
+			want:    Info{ClientIP: "2001:db8::1", Scheme: "https", Host: "public.example.com"},
+		},
+		{
+			remote:  "10.0.0.1:1234",
+			headers: map[string]string{"Forwarded": `for=1.2.3.4, for=_hidden`},
+			want:    Info{ClientIP: "10.0.0.1", Scheme: "http", Host: "example.com"},
+		},
+	}
+
+	for i, tt := range tests {
+		req := httptest.NewRequest("GET", "http://example.com/", nil)
+		req.RemoteAddr = tt.remote
+		for k, v := range tt.headers {
+			req.Header.Set(k, v)
+		}
+		if got := cfg.Resolve(req); got != tt.want {
+			t.Errorf("test %d: expected %+v, got %+v", i, tt.want, got)
+		}
+	}
+}
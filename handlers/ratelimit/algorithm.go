@@ -0,0 +1,133 @@
+package ratelimit
+
+import (
+	"math"
+	"time"
+)
+
+// State is the rate limit state for a key
+type State struct {
+	// Tokens and Last are used by TokenBucket
+	Tokens float64
+	Last   time.Time
+
+	// Window, Count and PrevCount are used by SlidingWindow
+	Window    time.Time
+	Count     int
+	PrevCount int
+}
+
+// Algorithm is a rate limiting algorithm
+type Algorithm interface {
+	// Take takes a request from the state
+	Take(s *State, now time.Time) Result
+	// TTL is how long state must be kept after the last request
+	TTL() time.Duration
+}
+
+// TokenBucket is a token bucket rate limit
+//
+// The bucket holds up to Burst tokens, and is refilled at Rate tokens
+// per second. Each request takes a token.
+type TokenBucket struct {
+	Rate  float64
+	Burst int
+}
+
+// PerSecond returns a TokenBucket allowing n requests per second
+func PerSecond(n int) TokenBucket {
+	return TokenBucket{Rate: float64(n), Burst: n}
+}
+
+// PerMinute returns a TokenBucket allowing n requests per minute
+func PerMinute(n int) TokenBucket {
+	return TokenBucket{Rate: float64(n) / 60, Burst: n}
+}
+
+// Take implements Algorithm.Take
+func (tb TokenBucket) Take(s *State, now time.Time) Result {
+	if s.Last.IsZero() {
+		s.Tokens = float64(tb.Burst)
+	} else if elapsed := now.Sub(s.Last).Seconds(); elapsed > 0 {
+		s.Tokens = math.Min(float64(tb.Burst), s.Tokens+elapsed*tb.Rate)
+	}
+	s.Last = now
+
+	res := Result{Limit: tb.Burst}
+
+	if s.Tokens >= 1 {
+		s.Tokens--
+		res.Allowed = true
+	} else {
+		res.RetryAfter = tb.duration(1 - s.Tokens)
+	}
+
+	res.Remaining = int(s.Tokens)
+	res.Reset = tb.duration(float64(tb.Burst) - s.Tokens)
+	return res
+}
+
+func (tb TokenBucket) duration(tokens float64) time.Duration {
+	return time.Duration(tokens / tb.Rate * float64(time.Second))
+}
+
+// TTL implements Algorithm.TTL
+func (tb TokenBucket) TTL() time.Duration {
+	return tb.duration(float64(tb.Burst))
+}
+
+// SlidingWindow is a sliding window rate limit
+//
+// It allows Limit requests in any Window, approximating the count in
+// the sliding window from the counts in the current and previous
+// fixed windows.
+type SlidingWindow struct {
+	Limit  int
+	Window time.Duration
+}
+
+// Take implements Algorithm.Take
+func (sw SlidingWindow) Take(s *State, now time.Time) Result {
+	window := now.Truncate(sw.Window)
+	switch {
+	case window.Equal(s.Window):
+	case window.Equal(s.Window.Add(sw.Window)):
+		s.PrevCount, s.Count = s.Count, 0
+	default:
+		s.PrevCount, s.Count = 0, 0
+	}
+	s.Window = window
+
+	elapsed := now.Sub(window)
+	weight := 1 - float64(elapsed)/float64(sw.Window)
+	count := float64(s.PrevCount)*weight + float64(s.Count)
+
+	res := Result{Limit: sw.Limit, Reset: sw.Window - elapsed}
+
+	if count+1 <= float64(sw.Limit) {
+		s.Count++
+		count++
+		res.Allowed = true
+	} else if s.PrevCount > 0 {
+		// wait until enough of the previous window has slid out
+		needed := count + 1 - float64(sw.Limit)
+		wait := time.Duration(needed / float64(s.PrevCount) * float64(sw.Window))
+		if wait > res.Reset {
+			wait = res.Reset
+		}
+		res.RetryAfter = wait
+	} else {
+		res.RetryAfter = res.Reset
+	}
+
+	res.Remaining = sw.Limit - int(math.Ceil(count))
+	if res.Remaining < 0 {
+		res.Remaining = 0
+	}
+	return res
+}
+
+// TTL implements Algorithm.TTL
+func (sw SlidingWindow) TTL() time.Duration {
+	return 2 * sw.Window
+}
@@ -0,0 +1,50 @@
+package ratelimit
+
+import (
+	"net/http"
+
+	"github.com/ian-kent/service.go/auth"
+	"github.com/ian-kent/service.go/handlers/proxy"
+)
+
+// KeyFunc returns the key identifying the client making a request
+type KeyFunc func(req *http.Request) string
+
+// ByIP returns a KeyFunc which identifies clients by IP address
+//
+// Forwarded headers are only used if the immediate peer is in one of
+// the trusted CIDRs, in which case the client is the rightmost
+// address which isn't itself trusted.
+func ByIP(trusted []string) KeyFunc {
+	cfg := proxy.Config{Trusted: proxy.ParseCIDRs(trusted)}
+	return func(req *http.Request) string {
+		return "ip:" + cfg.Resolve(req).ClientIP
+	}
+}
+
+// ByClientIP returns a KeyFunc which identifies clients by the IP
+// address resolved by the proxy middleware
+func ByClientIP() KeyFunc {
+	return func(req *http.Request) string {
+		return "ip:" + proxy.ClientIP(req)
+	}
+}
+
+// ByPrincipal returns a KeyFunc which identifies clients by the
+// authenticated principal, falling back to fallback if the request
+// isn't authenticated
+//
+// Clients using API keys are limited per key when the keys are
+// verified by an auth.APIKey authenticator, so unverified keys can't be used to get a
+// new limit for each request.
+func ByPrincipal(fallback KeyFunc) KeyFunc {
+	return func(req *http.Request) string {
+		if p := auth.Get(req); p != nil {
+			return "principal:" + p.Method + ":" + p.ID
+		}
+		if fallback != nil {
+			return fallback(req)
+		}
+		return ""
+	}
+}
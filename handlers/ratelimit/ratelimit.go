@@ -0,0 +1,105 @@
+// Package ratelimit implements an inbound rate limiting middleware
+package ratelimit
+
+import (
+	"math"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/ian-kent/service.go/api/response"
+	"github.com/ian-kent/service.go/log"
+	"github.com/ian-kent/service.go/metrics"
+)
+
+// MetricName is the name of the metric incremented for each limited request
+var MetricName = "rate_limited"
+
+// Result is the result of taking from a limit
+type Result struct {
+	// Allowed is true if the request is within the limit
+	Allowed bool
+	// Limit is the maximum number of requests
+	Limit int
+	// Remaining is the number of requests remaining
+	Remaining int
+	// Reset is the time until the limit is fully reset
+	Reset time.Duration
+	// RetryAfter is the time until the next request will be allowed,
+	// if the request wasn't allowed
+	RetryAfter time.Duration
+}
+
+// Config is the rate limiting middleware configuration
+type Config struct {
+	// Algorithm is the rate limiting algorithm, and is required
+	Algorithm Algorithm
+	// Store holds the rate limit state, a new MemoryStore if nil
+	Store Store
+	// Key identifies the client, ByClientIP() if nil
+	//
+	// Requests with an empty key aren't limited
+	Key KeyFunc
+	// FailureHandler, if set, is called instead of writing a 429 problem
+	FailureHandler http.Handler
+}
+
+// Handler returns a rate limiting middleware using the config
+//
+// Handler panics if the config has no Algorithm.
+func Handler(cfg Config) func(http.Handler) http.Handler {
+	if cfg.Algorithm == nil {
+		panic("ratelimit: config has no algorithm")
+	}
+	if cfg.Store == nil {
+		cfg.Store = NewMemoryStore()
+	}
+	if cfg.Key == nil {
+		cfg.Key = ByClientIP()
+	}
+
+	return func(h http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+			key := cfg.Key(req)
+			if len(key) == 0 {
+				h.ServeHTTP(w, req)
+				return
+			}
+
+			var res Result
+			err := cfg.Store.Update(key, cfg.Algorithm.TTL(), func(s *State) {
+				res = cfg.Algorithm.Take(s, time.Now())
+			})
+			if err != nil {
+				// fail open, a store outage shouldn't take down the service
+				log.ErrorR(req, err, log.Data{"key": key})
+				h.ServeHTTP(w, req)
+				return
+			}
+
+			hdr := w.Header()
+			hdr.Set("RateLimit-Limit", strconv.Itoa(res.Limit))
+			hdr.Set("RateLimit-Remaining", strconv.Itoa(res.Remaining))
+			hdr.Set("RateLimit-Reset", strconv.Itoa(seconds(res.Reset)))
+
+			if !res.Allowed {
+				metrics.Incr(MetricName)
+				log.DebugR(req, "rate limited", log.Data{"key": key, "retry_after": res.RetryAfter.String()})
+				hdr.Set("Retry-After", strconv.Itoa(seconds(res.RetryAfter)))
+				if cfg.FailureHandler != nil {
+					cfg.FailureHandler.ServeHTTP(w, req)
+					return
+				}
+				response.Error(w, req, http.StatusTooManyRequests, "rate limit exceeded")
+				return
+			}
+
+			h.ServeHTTP(w, req)
+		})
+	}
+}
+
+// seconds rounds a duration up to whole seconds
+func seconds(d time.Duration) int {
+	return int(math.Ceil(d.Seconds()))
+}
@@ -0,0 +1,124 @@
+package ratelimit
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/ian-kent/service.go/auth"
+)
+
+func TestTokenBucket(t *testing.T) {
+	tb := TokenBucket{Rate: 1, Burst: 2}
+	var s State
+	now := time.Now()
+
+	for i, allowed := range []bool{true, true, false} {
+		if res := tb.Take(&s, now); res.Allowed != allowed {
+			t.Errorf("request %d: expected allowed %t", i, allowed)
+		}
+	}
+
+	res := tb.Take(&s, now)
+	if res.RetryAfter != time.Second {
+		t.Errorf("expected retry after 1s, got %s", res.RetryAfter)
+	}
+
+	if res := tb.Take(&s, now.Add(time.Second)); !res.Allowed {
+		t.Error("expected request to be allowed after refill")
+	}
+}
+
+func TestSlidingWindow(t *testing.T) {
+	sw := SlidingWindow{Limit: 10, Window: time.Minute}
+	var s State
+	start := time.Now().Truncate(time.Minute)
+
+	for i := 0; i < 10; i++ {
+		if res := sw.Take(&s, start); !res.Allowed {
+			t.Fatalf("request %d: expected to be allowed", i)
+		}
+	}
+	if res := sw.Take(&s, start); res.Allowed || res.Remaining != 0 {
+		t.Errorf("expected request to be limited, got %+v", res)
+	}
+
+	// half way through the next window, half the previous count remains
+	for i := 0; i < 5; i++ {
+		if res := sw.Take(&s, start.Add(90*time.Second)); !res.Allowed {
+			t.Errorf("request %d: expected to be allowed", i)
+		}
+	}
+	if res := sw.Take(&s, start.Add(90*time.Second)); res.Allowed {
+		t.Error("expected request to be limited")
+	}
+}
+
+func TestByIP(t *testing.T) {
+	key := ByIP([]string{"10.0.0.0/8"})
+
+	tests := []struct {
+		remote, xff, key string
+	}{
+		{"1.2.3.4:1234", "5.6.7.8", "ip:1.2.3.4"},
+		{"10.0.0.1:1234", "5.6.7.8", "ip:5.6.7.8"},
+		{"10.0.0.1:1234", "9.9.9.9, 5.6.7.8, 10.0.0.2", "ip:5.6.7.8"},
+		{"10.0.0.1:1234", "", "ip:10.0.0.1"},
+	}
+
+	for _, test := range tests {
+		req, _ := http.NewRequest("GET", "/", nil)
+		req.RemoteAddr = test.remote
+		req.Header.Set("X-Forwarded-For", test.xff)
+		if k := key(req); k != test.key {
+			t.Errorf("%s %s: expected %s, got %s", test.remote, test.xff, test.key, k)
+		}
+	}
+}
+
+func TestByPrincipal(t *testing.T) {
+	key := ByPrincipal(ByClientIP())
+
+	req, _ := http.NewRequest("GET", "/", nil)
+	req.RemoteAddr = "1.2.3.4:1234"
+	req.Header.Set("X-API-Key", "unverified")
+	if k := key(req); k != "ip:1.2.3.4" {
+		t.Errorf("expected unauthenticated request to use the fallback, got %s", k)
+	}
+
+	req = req.WithContext(auth.NewContext(req.Context(), &auth.Principal{ID: "client", Method: "apikey"}))
+	if k := key(req); k != "principal:apikey:client" {
+		t.Errorf("expected principal key, got %s", k)
+	}
+}
+
+func TestHandler(t *testing.T) {
+	h := Handler(Config{Algorithm: TokenBucket{Rate: 1, Burst: 1}})(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {}))
+
+	for i, status := range []int{http.StatusOK, http.StatusTooManyRequests} {
+		w := httptest.NewRecorder()
+		req, _ := http.NewRequest("GET", "/", nil)
+		req.RemoteAddr = "1.2.3.4:1234"
+		h.ServeHTTP(w, req)
+
+		if w.Code != status {
+			t.Errorf("request %d: expected status %d, got %d", i, status, w.Code)
+		}
+		if w.Header().Get("RateLimit-Limit") != "1" {
+			t.Errorf("request %d: expected RateLimit-Limit header", i)
+		}
+		if status == http.StatusTooManyRequests && w.Header().Get("Retry-After") != "1" {
+			t.Errorf("expected Retry-After 1, got %q", w.Header().Get("Retry-After"))
+		}
+	}
+}
+
+func TestHandlerWithoutAlgorithm(t *testing.T) {
+	defer func() {
+		if recover() == nil {
+			t.Error("expected panic without an algorithm")
+		}
+	}()
+	Handler(Config{})
+}
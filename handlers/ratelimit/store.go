@@ -0,0 +1,78 @@
+package ratelimit
+
+import (
+	"sync"
+	"time"
+)
+
+// Store holds rate limit state
+//
+// A shared store, for example backed by Redis, can be used to apply
+// limits across multiple instances of a service.
+type Store interface {
+	// Update atomically applies fn to the state for key, creating
+	// a zero State if none exists. The state can be discarded once
+	// ttl has passed without an update.
+	Update(key string, ttl time.Duration, fn func(s *State)) error
+}
+
+type memoryEntry struct {
+	state   State
+	expires time.Time
+}
+
+// MemoryStore is an in-memory Store
+type MemoryStore struct {
+	mu        sync.Mutex
+	entries   map[string]*memoryEntry
+	lastSweep time.Time
+
+	// SweepInterval is how often expired state is removed
+	SweepInterval time.Duration
+}
+
+// NewMemoryStore returns a new MemoryStore
+func NewMemoryStore() *MemoryStore {
+	return &MemoryStore{
+		entries:       make(map[string]*memoryEntry),
+		SweepInterval: time.Minute,
+	}
+}
+
+// Update implements Store.Update
+func (m *MemoryStore) Update(key string, ttl time.Duration, fn func(s *State)) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	now := time.Now()
+	if now.Sub(m.lastSweep) > m.SweepInterval {
+		m.sweep(now)
+	}
+
+	e, ok := m.entries[key]
+	if !ok || now.After(e.expires) {
+		e = &memoryEntry{}
+		m.entries[key] = e
+	}
+
+	fn(&e.state)
+	e.expires = now.Add(ttl)
+
+	return nil
+}
+
+func (m *MemoryStore) sweep(now time.Time) {
+	for k, e := range m.entries {
+		if now.After(e.expires) {
+			delete(m.entries, k)
+		}
+	}
+	m.lastSweep = now
+}
+
+// Len returns the number of keys in the store
+func (m *MemoryStore) Len() int {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return len(m.entries)
+}
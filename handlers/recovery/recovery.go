@@ -0,0 +1,134 @@
+// Package recovery implements a middleware which recovers from panics
+package recovery
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"runtime/debug"
+
+	"github.com/ian-kent/service.go/log"
+	"github.com/ian-kent/service.go/metrics"
+)
+
+// MetricName is the name of the metric incremented for each recovered panic
+var MetricName = "panics"
+
+// FailureHandler is the handler called by DefaultHandler after a panic
+//
+// Web services can replace it to render an HTML error page.
+var FailureHandler http.Handler = http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+	w.WriteHeader(http.StatusInternalServerError)
+})
+
+// Stacker is implemented by panic values which carry the stack trace
+// of the goroutine the panic was originally raised in
+type Stacker interface {
+	Stack() []byte
+}
+
+// DefaultHandler returns a Handler which uses FailureHandler
+func DefaultHandler(h http.Handler) http.Handler {
+	return Handler(nil)(h)
+}
+
+// Handler returns a middleware which recovers from panics in h
+//
+// The panic is logged with its stack trace, and if the response
+// hasn't been written fh is called to write an error response.
+// If fh is nil, FailureHandler is used.
+func Handler(fh http.Handler) func(http.Handler) http.Handler {
+	return func(h http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+			rw := &writer{ResponseWriter: w}
+
+			defer func() {
+				p := recover()
+				if p == nil {
+					return
+				}
+				if p == http.ErrAbortHandler {
+					panic(p)
+				}
+
+				stack := debug.Stack()
+				if s, ok := p.(Stacker); ok {
+					stack = s.Stack()
+				}
+
+				metrics.Incr(MetricName)
+				log.ErrorR(req, Error(p), log.Data{
+					"panic":  fmt.Sprintf("%v", p),
+					"stack":  string(stack),
+					"method": req.Method,
+					"path":   req.URL.Path,
+				})
+
+				if rw.wroteHeader || rw.hijacked {
+					log.TraceR(req, "response already written, not calling failure handler", nil)
+					return
+				}
+
+				if fh != nil {
+					fh.ServeHTTP(w, req)
+					return
+				}
+				FailureHandler.ServeHTTP(w, req)
+			}()
+
+			h.ServeHTTP(rw, req)
+		})
+	}
+}
+
+// Error converts a recovered panic value into an error
+func Error(p interface{}) error {
+	switch v := p.(type) {
+	case error:
+		return v
+	case string:
+		return errors.New(v)
+	}
+	return fmt.Errorf("panic: %v", p)
+}
+
+type writer struct {
+	http.ResponseWriter
+	wroteHeader bool
+	hijacked    bool
+}
+
+func (rw *writer) WriteHeader(status int) {
+	rw.wroteHeader = true
+	rw.ResponseWriter.WriteHeader(status)
+}
+
+func (rw *writer) Write(b []byte) (int, error) {
+	rw.wroteHeader = true
+	return rw.ResponseWriter.Write(b)
+}
+
+func (rw *writer) Flush() {
+	if f, ok := rw.ResponseWriter.(http.Flusher); ok {
+		rw.wroteHeader = true
+		f.Flush()
+	}
+}
+
+func (rw *writer) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	hj, ok := rw.ResponseWriter.(http.Hijacker)
+	if !ok {
+		return nil, nil, errors.New("recovery: ResponseWriter does not implement http.Hijacker")
+	}
+	rw.hijacked = true
+	return hj.Hijack()
+}
+
+func (rw *writer) Push(target string, opts *http.PushOptions) error {
+	if p, ok := rw.ResponseWriter.(http.Pusher); ok {
+		return p.Push(target, opts)
+	}
+	return http.ErrNotSupported
+}
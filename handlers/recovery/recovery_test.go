@@ -0,0 +1,62 @@
+package recovery
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/ian-kent/service.go/handlers/timeout"
+)
+
+func TestHandler(t *testing.T) {
+	h := DefaultHandler(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		panic("oops")
+	}))
+
+	w := httptest.NewRecorder()
+	req, _ := http.NewRequest("GET", "/", nil)
+	h.ServeHTTP(w, req)
+
+	if w.Code != http.StatusInternalServerError {
+		t.Errorf("expected status 500, got %d", w.Code)
+	}
+}
+
+func TestHandlerAfterWrite(t *testing.T) {
+	h := DefaultHandler(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.WriteHeader(http.StatusAccepted)
+		panic("oops")
+	}))
+
+	w := httptest.NewRecorder()
+	req, _ := http.NewRequest("GET", "/", nil)
+	h.ServeHTTP(w, req)
+
+	if w.Code != http.StatusAccepted {
+		t.Errorf("expected status 202, got %d", w.Code)
+	}
+}
+
+func TestHandlerWithTimeout(t *testing.T) {
+	var called bool
+	fh := http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		called = true
+		w.WriteHeader(http.StatusTeapot)
+	})
+
+	h := Handler(fh)(timeout.Handler(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		panic("oops")
+	}), time.Second, http.NotFoundHandler()))
+
+	w := httptest.NewRecorder()
+	req, _ := http.NewRequest("GET", "/", nil)
+	h.ServeHTTP(w, req)
+
+	if !called {
+		t.Error("expected failure handler to be called")
+	}
+	if w.Code != http.StatusTeapot {
+		t.Errorf("expected status 418, got %d", w.Code)
+	}
+}
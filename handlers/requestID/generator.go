@@ -0,0 +1,119 @@
+package requestID
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/hex"
+	"io"
+	"time"
+)
+
+// Generator generates request IDs
+type Generator interface {
+	Generate() string
+}
+
+// GeneratorFunc is a function which implements Generator
+type GeneratorFunc func() string
+
+// Generate implements Generator.Generate
+func (f GeneratorFunc) Generate() string { return f() }
+
+var letters = []byte("abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ")
+
+// randReader is the source of randomness for all generators
+var randReader io.Reader = rand.Reader
+
+func randomBytes(b []byte) {
+	if _, err := io.ReadFull(randReader, b); err != nil {
+		// crypto/rand only fails if the OS can't provide randomness
+		panic("requestID: error reading random bytes: " + err.Error())
+	}
+}
+
+// Random returns a Generator which generates IDs of random letters
+// using crypto/rand
+func Random(size int) Generator {
+	return GeneratorFunc(func() string {
+		b := make([]byte, size)
+		buf := make([]byte, size)
+		for i := 0; i < size; {
+			randomBytes(buf)
+			for _, r := range buf {
+				// reject values which would bias the result
+				if int(r) >= len(letters)*(256/len(letters)) {
+					continue
+				}
+				b[i] = letters[int(r)%len(letters)]
+				i++
+				if i == size {
+					break
+				}
+			}
+		}
+		return string(b)
+	})
+}
+
+func formatUUID(u []byte) string {
+	b := make([]byte, 36)
+	hex.Encode(b[0:8], u[0:4])
+	b[8] = '-'
+	hex.Encode(b[9:13], u[4:6])
+	b[13] = '-'
+	hex.Encode(b[14:18], u[6:8])
+	b[18] = '-'
+	hex.Encode(b[19:23], u[8:10])
+	b[23] = '-'
+	hex.Encode(b[24:], u[10:])
+	return string(b)
+}
+
+// UUIDv4 generates random (version 4) UUIDs
+var UUIDv4 Generator = GeneratorFunc(func() string {
+	u := make([]byte, 16)
+	randomBytes(u)
+	u[6] = (u[6] & 0x0f) | 0x40
+	u[8] = (u[8] & 0x3f) | 0x80
+	return formatUUID(u)
+})
+
+// UUIDv7 generates time-ordered (version 7) UUIDs
+var UUIDv7 Generator = GeneratorFunc(func() string {
+	u := make([]byte, 16)
+	randomBytes(u[6:])
+	putMillis(u, time.Now())
+	u[6] = (u[6] & 0x0f) | 0x70
+	u[8] = (u[8] & 0x3f) | 0x80
+	return formatUUID(u)
+})
+
+// putMillis writes the 48 bit unix millisecond timestamp to b[0:6]
+func putMillis(b []byte, t time.Time) {
+	var ts [8]byte
+	binary.BigEndian.PutUint64(ts[:], uint64(t.UnixNano()/int64(time.Millisecond)))
+	copy(b[0:6], ts[2:])
+}
+
+const crockford = "0123456789ABCDEFGHJKMNPQRSTVWXYZ"
+
+// ULID generates lexicographically sortable identifiers
+//
+// See https://github.com/ulid/spec
+var ULID Generator = GeneratorFunc(func() string {
+	u := make([]byte, 16)
+	randomBytes(u[6:])
+	putMillis(u, time.Now())
+
+	// 128 bits encoded as 26 base32 characters, the first
+	// character only carrying the top 3 bits
+	b := make([]byte, 26)
+	hi := binary.BigEndian.Uint64(u[0:8])
+	lo := binary.BigEndian.Uint64(u[8:16])
+	for i := 25; i >= 0; i-- {
+		b[i] = crockford[lo&0x1f]
+		lo = lo>>5 | hi<<59
+		hi >>= 5
+	}
+	return string(b)
+})
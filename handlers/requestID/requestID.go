@@ -1,27 +1,82 @@
 package requestID
 
 import (
-	"math/rand"
+	"context"
 	"net/http"
 )
 
+// Header is the name of the request ID header
+var Header = "X-Request-Id"
+
+// MaxLength is the maximum length of an inbound request ID
+var MaxLength = 128
+
+// Valid returns true if an inbound request ID can be trusted
+//
+// By default IDs must be no longer than MaxLength and contain only
+// letters, digits, '-', '_', '.' and ':'
+var Valid = func(id string) bool {
+	if len(id) == 0 || len(id) > MaxLength {
+		return false
+	}
+	for _, c := range id {
+		switch {
+		case c >= 'a' && c <= 'z', c >= 'A' && c <= 'Z', c >= '0' && c <= '9':
+		case c == '-', c == '_', c == '.', c == ':':
+		default:
+			return false
+		}
+	}
+	return true
+}
+
+type contextKey struct{}
+
+// NewContext returns a new context carrying the request ID
+func NewContext(ctx context.Context, id string) context.Context {
+	return context.WithValue(ctx, contextKey{}, id)
+}
+
+// FromContext returns the request ID from a context
+func FromContext(ctx context.Context) string {
+	id, _ := ctx.Value(contextKey{}).(string)
+	return id
+}
+
+// Get returns the request ID for a request, from the request context
+// if set, otherwise from the request header
+func Get(req *http.Request) string {
+	if id := FromContext(req.Context()); len(id) > 0 {
+		return id
+	}
+	return req.Header.Get(Header)
+}
+
 // Handler is a wrapper which adds an X-Request-Id header if one does not yet exist
+//
+// Generated IDs are random letters of the given size
 func Handler(size int) func(http.Handler) http.Handler {
-	return func(h http.Handler) http.Handler {
-		var letters = []rune("abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ")
+	return GeneratorHandler(Random(size))
+}
 
+// GeneratorHandler is a wrapper which adds an X-Request-Id header using
+// the generator if one does not yet exist, or if the inbound ID is invalid
+//
+// The request ID is stored in the request context and echoed in the
+// response header.
+func GeneratorHandler(g Generator) func(http.Handler) http.Handler {
+	return func(h http.Handler) http.Handler {
 		return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
-			requestID := req.Header.Get("X-Request-Id")
-
-			if len(requestID) == 0 {
-				b := make([]rune, size)
-				for i := range b {
-					b[i] = letters[rand.Intn(len(letters))]
-				}
-				req.Header.Set("X-Request-Id", string(b))
+			requestID := req.Header.Get(Header)
+
+			if !Valid(requestID) {
+				requestID = g.Generate()
+				req.Header.Set(Header, requestID)
 			}
 
-			h.ServeHTTP(w, req)
+			w.Header().Set(Header, requestID)
+
+			h.ServeHTTP(w, req.WithContext(NewContext(req.Context(), requestID)))
 		})
 	}
 }
@@ -0,0 +1,69 @@
+package requestID
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"strings"
+	"testing"
+)
+
+func TestGenerators(t *testing.T) {
+	tests := map[string]struct {
+		g  Generator
+		re *regexp.Regexp
+	}{
+		"random": {Random(20), regexp.MustCompile(`^[a-zA-Z]{20}$`)},
+		"uuidv4": {UUIDv4, regexp.MustCompile(`^[0-9a-f]{8}-[0-9a-f]{4}-4[0-9a-f]{3}-[89ab][0-9a-f]{3}-[0-9a-f]{12}$`)},
+		"uuidv7": {UUIDv7, regexp.MustCompile(`^[0-9a-f]{8}-[0-9a-f]{4}-7[0-9a-f]{3}-[89ab][0-9a-f]{3}-[0-9a-f]{12}$`)},
+		"ulid":   {ULID, regexp.MustCompile(`^[0-7][0-9A-HJKMNP-TV-Z]{25}$`)},
+	}
+
+	for name, test := range tests {
+		seen := make(map[string]bool)
+		for i := 0; i < 100; i++ {
+			id := test.g.Generate()
+			if !test.re.MatchString(id) {
+				t.Errorf("%s: invalid id %q", name, id)
+			}
+			if seen[id] {
+				t.Errorf("%s: duplicate id %q", name, id)
+			}
+			seen[id] = true
+		}
+	}
+}
+
+func TestHandler(t *testing.T) {
+	tests := []struct {
+		inbound string
+		keep    bool
+	}{
+		{"", false},
+		{"abc-123", true},
+		{"bad id\n", false},
+		{strings.Repeat("a", MaxLength+1), false},
+	}
+
+	for _, test := range tests {
+		var got string
+		h := GeneratorHandler(UUIDv4)(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+			got = FromContext(req.Context())
+			if hdr := req.Header.Get(Header); hdr != got {
+				t.Errorf("expected request header %q, got %q", got, hdr)
+			}
+		}))
+
+		w := httptest.NewRecorder()
+		req, _ := http.NewRequest("GET", "/", nil)
+		req.Header.Set(Header, test.inbound)
+		h.ServeHTTP(w, req)
+
+		if (got == test.inbound) != test.keep {
+			t.Errorf("inbound %q: unexpected request id %q", test.inbound, got)
+		}
+		if hdr := w.Header().Get(Header); hdr != got {
+			t.Errorf("expected response header %q, got %q", got, hdr)
+		}
+	}
+}
@@ -0,0 +1,44 @@
+// Package route matches requests against the route keys used to
+// configure middleware for individual routes
+package route
+
+import (
+	"net/http"
+	"strings"
+)
+
+// Score returns how closely a route key matches the request, or -1 if
+// it doesn't match
+//
+// Keys are either a path prefix, e.g. "/upload", or a method and path
+// prefix, e.g. "POST /upload". Paths match whole path segments, so
+// "/upload" matches "/upload" and "/upload/file" but not "/uploads".
+// Longer paths score higher, and method
+// specific keys score higher than keys for the same path, so the key
+// with the highest score is the most specific match.
+func Score(req *http.Request, key string) int {
+	path := key
+	if i := strings.Index(key, " "); i >= 0 {
+		if !strings.EqualFold(key[:i], req.Method) {
+			return -1
+		}
+		path = strings.TrimSpace(key[i+1:])
+	}
+	if !matchPath(req.URL.Path, path) {
+		return -1
+	}
+
+	n := len(path) * 2
+	if path != key {
+		n++
+	}
+	return n
+}
+
+// matchPath returns true if prefix is the path, or a parent of it
+func matchPath(path, prefix string) bool {
+	if !strings.HasPrefix(path, prefix) {
+		return false
+	}
+	return len(path) == len(prefix) || strings.HasSuffix(prefix, "/") || path[len(prefix)] == '/'
+}
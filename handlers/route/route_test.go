@@ -0,0 +1,43 @@
+package route
+
+import (
+	"net/http/httptest"
+	"testing"
+)
+
+func TestScore(t *testing.T) {
+	req := httptest.NewRequest("POST", "/upload/file", nil)
+
+	if Score(req, "GET /upload") != -1 || Score(req, "/download") != -1 {
+		t.Error("expected keys for other methods and paths not to match")
+	}
+
+	keys := []string{"/", "/upload", "POST /upload", "post /upload/file"}
+	for i := 1; i < len(keys); i++ {
+		if Score(req, keys[i]) <= Score(req, keys[i-1]) {
+			t.Errorf("expected %q to score higher than %q", keys[i], keys[i-1])
+		}
+	}
+}
+
+func TestScoreSegments(t *testing.T) {
+	tests := []struct {
+		path, key string
+		match     bool
+	}{
+		{"/upload", "/upload", true},
+		{"/upload/file", "/upload", true},
+		{"/uploads-admin", "/upload", false},
+		{"/upload-avatar", "POST /upload", false},
+		{"/upload/file", "/upload/", true},
+		{"/upload", "/upload/", false},
+		{"/anything", "/", true},
+	}
+
+	for _, tt := range tests {
+		req := httptest.NewRequest("POST", tt.path, nil)
+		if match := Score(req, tt.key) >= 0; match != tt.match {
+			t.Errorf("%s %s: expected match %t", tt.key, tt.path, tt.match)
+		}
+	}
+}
@@ -5,35 +5,97 @@
 package timeout
 
 import (
+	"bufio"
+	"context"
 	"errors"
+	"fmt"
+	"net"
 	"net/http"
+	"runtime/debug"
+	"strings"
 	"sync"
 	"time"
 
+	"github.com/ian-kent/service.go/handlers/route"
 	"github.com/ian-kent/service.go/log"
+	"github.com/ian-kent/service.go/metrics"
 )
 
-// DefaultHandler returns a Handler with a default timeout
+// Config is the timeout configuration used by DefaultHandler
+type Config struct {
+	// Timeout is the default timeout for all requests
+	Timeout time.Duration
+	// Routes overrides Timeout for individual routes
+	//
+	// Keys are either a path prefix, e.g. "/upload", or a method and
+	// path prefix, e.g. "POST /upload", matched as described by
+	// route.Score. The most specific matching key is used.
+	// A zero duration disables the timeout for the route.
+	Routes map[string]time.Duration
+	// Exempt, if not nil, disables the timeout for matching requests
+	Exempt func(*http.Request) bool
+}
+
+// DefaultConfig is the configuration used by DefaultHandler
+//
+// Services copy it and set Timeout and Routes from the HTTPConfig
+var DefaultConfig = Config{
+	Timeout: 1 * time.Second,
+	Exempt:  Streaming,
+}
+
+// DefaultFailureHandler is the failure handler used by DefaultHandler
+var DefaultFailureHandler http.Handler = http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+	log.TraceR(req, "timed out", nil)
+	w.WriteHeader(http.StatusRequestTimeout)
+})
+
+// Streaming returns true for websocket upgrades and server-sent
+// event requests, which are long-lived and shouldn't time out
+func Streaming(req *http.Request) bool {
+	if strings.EqualFold(req.Header.Get("Upgrade"), "websocket") {
+		return true
+	}
+	return strings.Contains(req.Header.Get("Accept"), "text/event-stream")
+}
+
+// For returns the timeout for a request, or zero if the request
+// shouldn't time out
+func (c Config) For(req *http.Request) time.Duration {
+	if c.Exempt != nil && c.Exempt(req) {
+		return 0
+	}
+
+	dt, n := c.Timeout, -1
+	for key, d := range c.Routes {
+		if score := route.Score(req, key); score > n {
+			dt, n = d, score
+		}
+	}
+
+	return dt
+}
+
+// DefaultHandler returns a Handler using DefaultConfig and DefaultFailureHandler
 func DefaultHandler(h http.Handler) http.Handler {
-	return Handler(h, 1*time.Second, http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
-		log.TraceR(req, "timed out", nil)
-		w.WriteHeader(http.StatusRequestTimeout)
-	}))
+	return ConfigHandler(h, DefaultConfig, DefaultFailureHandler)
 }
 
 // Handler returns a Handler that runs h with the given time limit.
 //
 // The new Handler calls h.ServeHTTP to handle each request, but if a
-// call runs for longer than its time limit, the handler responds with
-// a 503 Service Unavailable error and the given message in its body.
-// (If msg is empty, a suitable default message will be sent.)
+// call runs for longer than its time limit, the request context is
+// cancelled and fh is called to write the response.
 // After such a timeout, writes by h to its ResponseWriter will return
 // ErrHandlerTimeout.
 func Handler(h http.Handler, dt time.Duration, fh http.Handler) http.Handler {
-	f := func() <-chan time.Time {
-		return time.After(dt)
-	}
-	return &handler{h, f, fh}
+	return &handler{h, func(*http.Request) time.Duration { return dt }, fh}
+}
+
+// ConfigHandler returns a Handler that runs h with the time limit
+// from the config for each request
+func ConfigHandler(h http.Handler, cfg Config, fh http.Handler) http.Handler {
+	return &handler{h, cfg.For, fh}
 }
 
 // ErrHandlerTimeout is returned on ResponseWriter Write calls
@@ -42,27 +104,87 @@ var ErrHandlerTimeout = errors.New("http: Handler timeout")
 
 type handler struct {
 	handler     http.Handler
-	timeout     func() <-chan time.Time // returns channel producing a timeout
+	timeout     func(*http.Request) time.Duration // returns the timeout for a request
 	failHandler http.Handler
 }
 
+// PanicMetricName is the name of the metric incremented when a handler
+// panics after it has timed out
+var PanicMetricName = "panics"
+
+// panicError wraps a panic recovered from the handler goroutine so it
+// can be raised again in the calling goroutine with its original stack
+type panicError struct {
+	value interface{}
+	stack []byte
+}
+
+func (p panicError) Error() string { return fmt.Sprintf("%v", p.value) }
+func (p panicError) Stack() []byte { return p.stack }
+
+// raise returns the value to panic with in the calling goroutine
+func (p panicError) raise() interface{} {
+	if p.value == http.ErrAbortHandler {
+		return p.value
+	}
+	return p
+}
+
 func (h *handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	dt := h.timeout(r)
+	if dt <= 0 {
+		h.handler.ServeHTTP(w, r)
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), dt)
+	defer cancel()
+	r = r.WithContext(ctx)
+
 	done := make(chan bool, 1)
+	panicChan := make(chan panicError, 1)
 	tw := &writer{w: w}
 	go func() {
+		defer func() {
+			if p := recover(); p != nil {
+				pe := panicError{p, debug.Stack()}
+				tw.mu.Lock()
+				defer tw.mu.Unlock()
+				if tw.timedOut {
+					// nothing is waiting for the handler, so the panic
+					// can't be raised again - log it here instead
+					metrics.Incr(PanicMetricName)
+					log.ErrorR(r, pe, log.Data{"panic": pe.Error(), "stack": string(pe.stack), "timed_out": true})
+					return
+				}
+				panicChan <- pe
+			}
+		}()
 		h.handler.ServeHTTP(tw, r)
 		done <- true
 	}()
 	select {
 	case <-done:
 		return
-	case <-h.timeout():
+	case p := <-panicChan:
+		panic(p.raise())
+	case <-ctx.Done():
 		tw.mu.Lock()
+		select {
+		case p := <-panicChan:
+			tw.mu.Unlock()
+			panic(p.raise())
+		default:
+		}
 		defer tw.mu.Unlock()
-		log.TraceR(r, "request timed out", nil)
-		if !tw.wroteHeader {
-			log.TraceR(r, "headers not written, calling failure handler", nil)
-			h.failHandler.ServeHTTP(w, r)
+		if ctx.Err() != context.DeadlineExceeded {
+			log.TraceR(r, "request cancelled", log.Data{"error": ctx.Err()})
+		} else {
+			log.TraceR(r, "request timed out", log.Data{"timeout": dt.String()})
+			if !tw.wroteHeader {
+				log.TraceR(r, "headers not written, calling failure handler", nil)
+				h.failHandler.ServeHTTP(w, r)
+			}
 		}
 		tw.timedOut = true
 	}
@@ -99,3 +221,42 @@ func (tw *writer) WriteHeader(code int) {
 	tw.wroteHeader = true
 	tw.w.WriteHeader(code)
 }
+
+func (tw *writer) Flush() {
+	tw.mu.Lock()
+	defer tw.mu.Unlock()
+	if tw.timedOut {
+		return
+	}
+	if f, ok := tw.w.(http.Flusher); ok {
+		tw.wroteHeader = true
+		f.Flush()
+	}
+}
+
+func (tw *writer) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	tw.mu.Lock()
+	defer tw.mu.Unlock()
+	if tw.timedOut {
+		return nil, nil, ErrHandlerTimeout
+	}
+	hj, ok := tw.w.(http.Hijacker)
+	if !ok {
+		return nil, nil, errors.New("timeout: ResponseWriter does not implement http.Hijacker")
+	}
+	// the connection is no longer ours to write a failure response to
+	tw.wroteHeader = true
+	return hj.Hijack()
+}
+
+func (tw *writer) Push(target string, opts *http.PushOptions) error {
+	tw.mu.Lock()
+	defer tw.mu.Unlock()
+	if tw.timedOut {
+		return ErrHandlerTimeout
+	}
+	if p, ok := tw.w.(http.Pusher); ok {
+		return p.Push(target, opts)
+	}
+	return http.ErrNotSupported
+}
@@ -0,0 +1,83 @@
+package timeout
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestConfigFor(t *testing.T) {
+	cfg := Config{
+		Timeout: time.Second,
+		Routes: map[string]time.Duration{
+			"/upload":     30 * time.Second,
+			"/upload/big": time.Minute,
+			"GET /upload": 5 * time.Second,
+			"/events":     0,
+		},
+		Exempt: Streaming,
+	}
+
+	tests := []struct {
+		method, path, accept string
+		timeout              time.Duration
+	}{
+		{"GET", "/", "", time.Second},
+		{"POST", "/upload", "", 30 * time.Second},
+		{"GET", "/upload", "", 5 * time.Second},
+		{"POST", "/upload/big", "", time.Minute},
+		{"GET", "/events", "", 0},
+		{"GET", "/stream", "text/event-stream", 0},
+	}
+
+	for _, test := range tests {
+		req, _ := http.NewRequest(test.method, test.path, nil)
+		req.Header.Set("Accept", test.accept)
+		if d := cfg.For(req); d != test.timeout {
+			t.Errorf("%s %s: expected %s, got %s", test.method, test.path, test.timeout, d)
+		}
+	}
+}
+
+func TestHandlerCancelsContext(t *testing.T) {
+	cancelled := make(chan bool, 1)
+	h := Handler(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		<-req.Context().Done()
+		cancelled <- true
+	}), 10*time.Millisecond, http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+
+	w := httptest.NewRecorder()
+	req, _ := http.NewRequest("GET", "/", nil)
+	h.ServeHTTP(w, req)
+
+	if w.Code != http.StatusServiceUnavailable {
+		t.Errorf("expected status 503, got %d", w.Code)
+	}
+
+	select {
+	case <-cancelled:
+	case <-time.After(time.Second):
+		t.Error("expected handler context to be cancelled")
+	}
+}
+
+func TestWriterFlusher(t *testing.T) {
+	h := Handler(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if _, ok := w.(http.Flusher); !ok {
+			t.Error("expected writer to implement http.Flusher")
+		}
+		w.Write([]byte("ok"))
+		w.(http.Flusher).Flush()
+	}), time.Second, http.NotFoundHandler())
+
+	w := httptest.NewRecorder()
+	req, _ := http.NewRequest("GET", "/", nil)
+	h.ServeHTTP(w, req)
+
+	if !w.Flushed {
+		t.Error("expected response to be flushed")
+	}
+}
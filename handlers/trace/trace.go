@@ -0,0 +1,126 @@
+// Package trace propagates W3C trace context (traceparent and tracestate)
+package trace
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"net/http"
+	"strings"
+)
+
+// Header names used to propagate trace context
+var (
+	ParentHeader = "traceparent"
+	StateHeader  = "tracestate"
+)
+
+// Context is a trace context
+type Context struct {
+	// TraceID identifies the trace, 32 lowercase hex characters
+	TraceID string
+	// SpanID identifies the current span, 16 lowercase hex characters
+	SpanID string
+	// Flags are the trace flags, 2 lowercase hex characters
+	Flags string
+	// State is the vendor specific tracestate
+	State string
+}
+
+// New returns a new trace context with random IDs
+func New() Context {
+	return Context{TraceID: randomHex(16), SpanID: randomHex(8), Flags: "01"}
+}
+
+// Parse parses traceparent and tracestate headers
+func Parse(traceparent, tracestate string) (Context, bool) {
+	parts := strings.Split(strings.TrimSpace(traceparent), "-")
+	if len(parts) < 4 || len(parts[0]) != 2 || parts[0] == "ff" || (parts[0] == "00" && len(parts) != 4) {
+		return Context{}, false
+	}
+	c := Context{TraceID: parts[1], SpanID: parts[2], Flags: parts[3], State: tracestate}
+	if !isHex(parts[0]) || !validID(c.TraceID, 32) || !validID(c.SpanID, 16) || len(c.Flags) != 2 || !isHex(c.Flags) {
+		return Context{}, false
+	}
+	return c, true
+}
+
+// Child returns a trace context for a new span in the same trace
+func (c Context) Child() Context {
+	c.SpanID = randomHex(8)
+	return c
+}
+
+// Traceparent returns the traceparent header value
+func (c Context) Traceparent() string {
+	return "00-" + c.TraceID + "-" + c.SpanID + "-" + c.Flags
+}
+
+// Valid returns true if the trace context has a trace ID
+func (c Context) Valid() bool {
+	return len(c.TraceID) > 0
+}
+
+type contextKey struct{}
+
+// NewContext returns a new context carrying the trace context
+func NewContext(ctx context.Context, c Context) context.Context {
+	return context.WithValue(ctx, contextKey{}, c)
+}
+
+// FromContext returns the trace context from a context
+func FromContext(ctx context.Context) (Context, bool) {
+	c, ok := ctx.Value(contextKey{}).(Context)
+	return c, ok
+}
+
+// Get returns the trace context for a request, from the request
+// context if set, otherwise from the request headers
+func Get(req *http.Request) (Context, bool) {
+	if c, ok := FromContext(req.Context()); ok {
+		return c, true
+	}
+	return Parse(req.Header.Get(ParentHeader), req.Header.Get(StateHeader))
+}
+
+// Handler stores the trace context in the request context
+//
+// The request is handled in a new span of the inbound trace, or of
+// a new trace if the request has no valid traceparent header.
+func Handler(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		c, ok := Parse(req.Header.Get(ParentHeader), req.Header.Get(StateHeader))
+		if ok {
+			c = c.Child()
+		} else {
+			c = New()
+		}
+		h.ServeHTTP(w, req.WithContext(NewContext(req.Context(), c)))
+	})
+}
+
+func randomHex(n int) string {
+	b := make([]byte, n)
+	for {
+		rand.Read(b)
+		// all zero IDs are invalid
+		for _, c := range b {
+			if c != 0 {
+				return hex.EncodeToString(b)
+			}
+		}
+	}
+}
+
+func isHex(s string) bool {
+	for _, c := range s {
+		if !(c >= '0' && c <= '9') && !(c >= 'a' && c <= 'f') {
+			return false
+		}
+	}
+	return true
+}
+
+func validID(id string, n int) bool {
+	return len(id) == n && isHex(id) && strings.Trim(id, "0") != ""
+}
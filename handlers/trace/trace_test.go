@@ -0,0 +1,91 @@
+package trace
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+const (
+	traceID = "4bf92f3577b34da6a3ce929d0e0e4736"
+	spanID  = "00f067aa0ba902b7"
+)
+
+func TestParse(t *testing.T) {
+	tests := []struct {
+		traceparent string
+		valid       bool
+	}{
+		{"00-" + traceID + "-" + spanID + "-01", true},
+		{" 00-" + traceID + "-" + spanID + "-00 ", true},
+		// later versions may add fields
+		{"01-" + traceID + "-" + spanID + "-01-extra", true},
+		{"00-" + traceID + "-" + spanID + "-01-extra", false},
+		{"ff-" + traceID + "-" + spanID + "-01", false},
+		{"0-" + traceID + "-" + spanID + "-01", false},
+		{"zz-" + traceID + "-" + spanID + "-01", false},
+		{"00-00000000000000000000000000000000-" + spanID + "-01", false},
+		{"00-" + traceID + "-0000000000000000-01", false},
+		{"00-" + traceID[:31] + "-" + spanID + "-01", false},
+		{"00-4BF92F3577B34DA6A3CE929D0E0E4736-" + spanID + "-01", false},
+		{"00-" + traceID + "-" + spanID + "-1", false},
+		{"00-" + traceID + "-" + spanID, false},
+		{"", false},
+	}
+
+	for _, tt := range tests {
+		c, ok := Parse(tt.traceparent, "vendor=value")
+		if ok != tt.valid {
+			t.Errorf("%q: expected valid %t", tt.traceparent, tt.valid)
+			continue
+		}
+		if ok && (c.TraceID != traceID || c.SpanID != spanID || c.State != "vendor=value") {
+			t.Errorf("%q: unexpected context %+v", tt.traceparent, c)
+		}
+	}
+}
+
+func TestChild(t *testing.T) {
+	c := Context{TraceID: traceID, SpanID: spanID, Flags: "01", State: "vendor=value"}
+	child := c.Child()
+
+	if child.TraceID != c.TraceID || child.Flags != c.Flags || child.State != c.State {
+		t.Errorf("expected child to keep the trace, got %+v", child)
+	}
+	if child.SpanID == c.SpanID || !validID(child.SpanID, 16) {
+		t.Errorf("expected a new span ID, got %q", child.SpanID)
+	}
+	if _, ok := Parse(child.Traceparent(), ""); !ok {
+		t.Errorf("expected valid traceparent, got %q", child.Traceparent())
+	}
+}
+
+func TestHandler(t *testing.T) {
+	var c Context
+	h := Handler(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		c, _ = FromContext(req.Context())
+	}))
+
+	req := httptest.NewRequest("GET", "/", nil)
+	req.Header.Set(ParentHeader, "00-"+traceID+"-"+spanID+"-01")
+	req.Header.Set(StateHeader, "vendor=value")
+	h.ServeHTTP(httptest.NewRecorder(), req)
+
+	if c.TraceID != traceID || c.State != "vendor=value" {
+		t.Errorf("expected inbound trace, got %+v", c)
+	}
+	if c.SpanID == spanID {
+		t.Error("expected request to be a new span")
+	}
+
+	req = httptest.NewRequest("GET", "/", nil)
+	req.Header.Set(ParentHeader, "00-00000000000000000000000000000000-"+spanID+"-01")
+	h.ServeHTTP(httptest.NewRecorder(), req)
+
+	if !c.Valid() || c.TraceID == "00000000000000000000000000000000" {
+		t.Errorf("expected new trace for invalid traceparent, got %+v", c)
+	}
+	if _, ok := Parse(c.Traceparent(), ""); !ok {
+		t.Errorf("expected valid traceparent, got %q", c.Traceparent())
+	}
+}
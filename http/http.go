@@ -6,6 +6,7 @@ import (
 	"encoding/base64"
 	"encoding/json"
 	"encoding/xml"
+	"errors"
 	"fmt"
 	"io"
 	"io/ioutil"
@@ -13,6 +14,8 @@ import (
 	"reflect"
 	"strings"
 
+	"github.com/ian-kent/service.go/handlers/bodylimit"
+	"github.com/ian-kent/service.go/handlers/proxy"
 	"gopkg.in/yaml.v2"
 )
 
@@ -104,10 +107,12 @@ func (k Key) String() string {
 // are forwarded from the incoming request.
 //
 // Forwarded headers can be customised per-request using
-// Requester.ForwardHeaders
+// Requester.ForwardHeaders. The X-Forwarded-* and Forwarded headers
+// are never copied, since clients can set them to anything; instead
+// X-Forwarded-For, X-Forwarded-Proto and X-Forwarded-Host are set
+// from the client IP, scheme and host resolved by the proxy package.
 var DefaultForwardHeaders = []string{
-	"X-Forwarded-For", "X-Forwarded-Proto",
-	"X-Forwarded-Host", "X-Request-Id",
+	"X-Request-Id",
 }
 
 type requester struct {
@@ -146,7 +151,20 @@ type serviceCall struct {
 	unmarshaler    func([]byte, interface{}) error
 }
 
+// MaxBodySize is the maximum request body size read by Unmarshal
+//
+// It's used for requests which haven't been limited by the bodylimit
+// middleware; otherwise the limit for the route is used. If zero,
+// the body size isn't limited by Unmarshal.
+var MaxBodySize int64 = 10 << 20
+
+// ErrBodyTooLarge is returned by Unmarshal if the request body is too large
+var ErrBodyTooLarge = errors.New("http: request body too large")
+
 // Unmarshal unmarhals a http request body to dest
+//
+// ErrBodyTooLarge is returned if the body is larger than the limit
+// set by the bodylimit middleware, or MaxBodySize without it
 func Unmarshal(req *http.Request, dest interface{}) (body []byte, err error) {
 	var u func([]byte, interface{}) error
 
@@ -170,13 +188,31 @@ func Unmarshal(req *http.Request, dest interface{}) (body []byte, err error) {
 		u = yaml.Unmarshal
 	}
 
-	b, err := ioutil.ReadAll(req.Body)
+	max := MaxBodySize
+	if limit, ok := bodylimit.FromContext(req.Context()); ok {
+		max = limit
+	}
+
+	var rdr io.Reader = req.Body
+	if max > 0 {
+		rdr = io.LimitReader(req.Body, max+1)
+	}
+
+	b, err := ioutil.ReadAll(rdr)
 	if err != nil {
+		var mbe *http.MaxBytesError
+		if errors.As(err, &mbe) {
+			return b, ErrBodyTooLarge
+		}
 		err = fmt.Errorf("http: error reading body: %s", err)
 		return b, err
 	}
 	req.Body.Close()
 
+	if max > 0 && int64(len(b)) > max {
+		return b[:max], ErrBodyTooLarge
+	}
+
 	if u == nil {
 		return b, fmt.Errorf("http: unmarshaler not found for request")
 	}
@@ -239,6 +275,13 @@ func (r requester) unmarshal(rdr io.Reader, contentType string, dest interface{}
 	return
 }
 
+// forwardingHeader returns true for headers describing the origin of a
+// request, which are set from the proxy info rather than copied
+func forwardingHeader(hdr string) bool {
+	hdr = http.CanonicalHeaderKey(hdr)
+	return hdr == "Forwarded" || strings.HasPrefix(hdr, "X-Forwarded-")
+}
+
 // Do ...
 func (r requester) Do() (*http.Response, error) {
 	req, err := http.NewRequest(r.method, r.serviceCall.service.URL()+r.path, nil)
@@ -248,10 +291,24 @@ func (r requester) Do() (*http.Response, error) {
 
 	if r.serviceCall.request != nil {
 		for _, hdr := range r.forwardHeaders {
+			if forwardingHeader(hdr) {
+				continue
+			}
 			if h := r.serviceCall.request.Header.Get(hdr); len(h) > 0 {
 				req.Header.Set(hdr, h)
 			}
 		}
+
+		info := proxy.Get(r.serviceCall.request)
+		if len(info.ClientIP) > 0 {
+			req.Header.Set("X-Forwarded-For", info.ClientIP)
+		}
+		if len(info.Scheme) > 0 {
+			req.Header.Set("X-Forwarded-Proto", info.Scheme)
+		}
+		if len(info.Host) > 0 {
+			req.Header.Set("X-Forwarded-Host", info.Host)
+		}
 	}
 
 	if r.serviceCall.headers != nil {
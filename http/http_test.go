@@ -2,76 +2,104 @@ package http
 
 import (
 	"io"
-	"log"
 	"net/http"
-	"os"
+	"net/http/httptest"
 	"testing"
 )
 
-var exampleAPI = BasicService("https://some-api")
-
 func TestResult(t *testing.T) {
-	req := &http.Request{
-		Header: make(http.Header),
-	}
-	req.Header.Set("X-Request-Id", "test1234")
-	req.Header.Set("X-Forwarded-For", "127.0.0.1")
-
-	key := Key(os.Getenv("API_KEY"))
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{"example":"value"}`))
+	}))
+	defer srv.Close()
 
 	var m struct {
 		Example string `json:"example"`
 	}
 
-	res, err := exampleAPI.Call(req, key).Get("/some-url").Result(&m)
+	res, body, err := BasicService(srv.URL).Call(Key("key")).Get("/some-url").Result(&m)
 	if err != nil {
-		t.Error(err)
-		return
+		t.Fatal(err)
 	}
 
-	log.Printf("%+v", res)
-	log.Printf("%+v", m)
+	if res.StatusCode != http.StatusOK || string(body) != `{"example":"value"}` {
+		t.Errorf("unexpected response: %d %s", res.StatusCode, body)
+	}
+	if m.Example != "value" {
+		t.Errorf("expected result to be unmarshaled, got %+v", m)
+	}
 }
 
 func TestStream(t *testing.T) {
-	req := &http.Request{
-		Header: make(http.Header),
-	}
-	req.Header.Set("X-Request-Id", "test1234")
-	req.Header.Set("X-Forwarded-For", "127.0.0.1")
-
-	key := Key(os.Getenv("API_KEY"))
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte("{\"example\":\"a\"}\n{\"example\":\"b\"}\n"))
+	}))
+	defer srv.Close()
 
 	c := make(chan StreamResulter)
 
-	res, err := exampleAPI.Call(req, key).Get("/some-url").Stream('\n', c)
-	if err != nil {
-		t.Error(err)
-		return
-	}
-
-	log.Printf("%+v", res)
-
-	var m struct {
-		Example string `json:"example"`
+	if _, err := BasicService(srv.URL).Call().Get("/some-url").Stream('\n', c); err != nil {
+		t.Fatal(err)
 	}
 
+	var got []string
 	for {
 		r := <-c
 
-		if err := r.Result(&m); err != nil {
-			t.Error(err)
-			return
-		}
-
-		log.Printf("%+v", m)
-
 		if err := r.Error(); err != nil {
 			if err != io.EOF {
-				t.Error(err)
-				return
+				t.Fatal(err)
 			}
 			break
 		}
+
+		var m struct {
+			Example string `json:"example"`
+		}
+		if _, err := r.Result(&m); err != nil {
+			t.Fatal(err)
+		}
+		got = append(got, m.Example)
+	}
+
+	if len(got) != 2 || got[0] != "a" || got[1] != "b" {
+		t.Errorf("expected two results, got %v", got)
+	}
+}
+
+func TestForwardHeaders(t *testing.T) {
+	var got http.Header
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		got = req.Header
+	}))
+	defer srv.Close()
+
+	req := httptest.NewRequest("GET", "http://public.example.com/", nil)
+	req.RemoteAddr = "203.0.113.1:1234"
+	req.Header.Set("X-Request-Id", "test1234")
+	req.Header.Set("X-Forwarded-For", "6.6.6.6")
+	req.Header.Set("X-Forwarded-Host", "evil.example.com")
+	req.Header.Set("Forwarded", "for=6.6.6.6")
+
+	if _, err := BasicService(srv.URL).Call(req).ForwardHeaders("X-Request-Id", "Forwarded").Get("/").Do(); err != nil {
+		t.Fatal(err)
+	}
+
+	if v := got.Get("X-Request-Id"); v != "test1234" {
+		t.Errorf("expected request ID to be forwarded, got %q", v)
+	}
+	if v := got.Get("X-Forwarded-For"); v != "203.0.113.1" {
+		t.Errorf("expected client IP, got %q", v)
+	}
+	if v := got.Get("X-Forwarded-Host"); v != "public.example.com" {
+		t.Errorf("expected requested host, got %q", v)
+	}
+	if v := got.Get("X-Forwarded-Proto"); v != "http" {
+		t.Errorf("expected http, got %q", v)
+	}
+	if v := got.Get("Forwarded"); len(v) > 0 {
+		t.Errorf("expected Forwarded not to be copied, got %q", v)
 	}
 }
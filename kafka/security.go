@@ -0,0 +1,185 @@
+// Package kafka contains Kafka configuration shared by the consumer
+// and producer packages
+package kafka
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+
+	"github.com/twmb/franz-go/pkg/kgo"
+	"github.com/twmb/franz-go/pkg/sasl/plain"
+	kscram "github.com/twmb/franz-go/pkg/sasl/scram"
+)
+
+// SASL mechanisms
+const (
+	SASLPlain       = "PLAIN"
+	SASLScramSHA256 = "SCRAM-SHA-256"
+	SASLScramSHA512 = "SCRAM-SHA-512"
+)
+
+// Security is the TLS and SASL configuration used to connect to brokers
+type Security struct {
+	// TLS enables TLS, and is implied by any of the other TLS settings
+	TLS bool
+	// CAFile is a PEM file of CA certificates used to verify brokers,
+	// the system roots if empty
+	CAFile string
+	// CertFile and KeyFile are the PEM client certificate and key
+	CertFile string
+	KeyFile  string
+	// ServerName overrides the name used to verify broker certificates
+	ServerName string
+	// InsecureSkipVerify disables broker certificate verification
+	InsecureSkipVerify bool
+
+	// SASLMechanism is one of PLAIN, SCRAM-SHA-256 or SCRAM-SHA-512,
+	// or empty to disable SASL
+	SASLMechanism string
+	SASLUsername  string
+	SASLPassword  string
+}
+
+// SecurityConfig holds the TLS and SASL settings for gofigure, and is
+// embedded in the consumer and producer default configs so they share
+// the same KAFKA_TLS* and KAFKA_SASL* settings
+type SecurityConfig struct {
+	TLS                   bool   `env:"KAFKA_TLS" flag:"kafka-tls" flagDesc:"Connect to Kafka using TLS"`
+	TLSCAFile             string `env:"KAFKA_TLS_CA_FILE" flag:"kafka-tls-ca-file" flagDesc:"Kafka TLS CA certificates file"`
+	TLSCertFile           string `env:"KAFKA_TLS_CERT_FILE" flag:"kafka-tls-cert-file" flagDesc:"Kafka TLS client certificate file"`
+	TLSKeyFile            string `env:"KAFKA_TLS_KEY_FILE" flag:"kafka-tls-key-file" flagDesc:"Kafka TLS client key file"`
+	TLSServerName         string `env:"KAFKA_TLS_SERVER_NAME" flag:"kafka-tls-server-name" flagDesc:"Kafka TLS server name"`
+	TLSInsecureSkipVerify bool   `env:"KAFKA_TLS_INSECURE_SKIP_VERIFY" flag:"kafka-tls-insecure-skip-verify" flagDesc:"Skip Kafka TLS certificate verification"`
+	SASLMechanism         string `env:"KAFKA_SASL_MECHANISM" flag:"kafka-sasl-mechanism" flagDesc:"Kafka SASL mechanism (PLAIN, SCRAM-SHA-256 or SCRAM-SHA-512)"`
+	SASLUsername          string `env:"KAFKA_SASL_USERNAME" flag:"kafka-sasl-username" flagDesc:"Kafka SASL username"`
+	SASLPassword          string `env:"KAFKA_SASL_PASSWORD" flag:"kafka-sasl-password" flagDesc:"Kafka SASL password"`
+}
+
+// Security returns the Security for the settings
+func (c SecurityConfig) Security() Security {
+	return Security{
+		TLS:                c.TLS,
+		CAFile:             c.TLSCAFile,
+		CertFile:           c.TLSCertFile,
+		KeyFile:            c.TLSKeyFile,
+		ServerName:         c.TLSServerName,
+		InsecureSkipVerify: c.TLSInsecureSkipVerify,
+		SASLMechanism:      c.SASLMechanism,
+		SASLUsername:       c.SASLUsername,
+		SASLPassword:       c.SASLPassword,
+	}
+}
+
+func (s Security) tlsEnabled() bool {
+	return s.TLS || len(s.CAFile) > 0 || len(s.CertFile) > 0 || len(s.KeyFile) > 0 || len(s.ServerName) > 0
+}
+
+// Validate checks the configuration, returning an error describing
+// every problem found
+func (s Security) Validate() error {
+	var problems []string
+
+	checkFile := func(name, path string) {
+		if len(path) == 0 {
+			return
+		}
+		f, err := os.Open(path)
+		if err != nil {
+			if os.IsNotExist(err) {
+				problems = append(problems, fmt.Sprintf("%s %q does not exist", name, path))
+			} else {
+				problems = append(problems, fmt.Sprintf("%s %q can't be read: %s", name, path, err))
+			}
+			return
+		}
+		f.Close()
+	}
+
+	checkFile("TLS CA file", s.CAFile)
+	checkFile("TLS certificate file", s.CertFile)
+	checkFile("TLS key file", s.KeyFile)
+	if (len(s.CertFile) > 0) != (len(s.KeyFile) > 0) {
+		problems = append(problems, "TLS certificate and key files must be set together")
+	}
+
+	switch strings.ToUpper(s.SASLMechanism) {
+	case "":
+	case SASLPlain, SASLScramSHA256, SASLScramSHA512:
+		if len(s.SASLUsername) == 0 || len(s.SASLPassword) == 0 {
+			problems = append(problems, "SASL username and password are required")
+		}
+		if strings.ToUpper(s.SASLMechanism) == SASLPlain && !s.tlsEnabled() {
+			problems = append(problems, "SASL PLAIN requires TLS, credentials would be sent in plain text")
+		}
+	default:
+		problems = append(problems, fmt.Sprintf("unsupported SASL mechanism %q", s.SASLMechanism))
+	}
+
+	if len(problems) > 0 {
+		return errors.New("kafka: invalid security config: " + strings.Join(problems, "; "))
+	}
+	return nil
+}
+
+// ClientOptions validates the configuration and returns it as Kafka
+// client options
+func (s Security) ClientOptions() ([]kgo.Opt, error) {
+	if err := s.Validate(); err != nil {
+		return nil, err
+	}
+
+	var opts []kgo.Opt
+	if s.tlsEnabled() {
+		tc, err := s.tlsConfig()
+		if err != nil {
+			return nil, err
+		}
+		opts = append(opts, kgo.DialTLSConfig(tc))
+	}
+
+	switch strings.ToUpper(s.SASLMechanism) {
+	case SASLPlain:
+		opts = append(opts, kgo.SASL(plain.Auth{User: s.SASLUsername, Pass: s.SASLPassword}.AsMechanism()))
+	case SASLScramSHA256:
+		opts = append(opts, kgo.SASL(kscram.Auth{User: s.SASLUsername, Pass: s.SASLPassword}.AsSha256Mechanism()))
+	case SASLScramSHA512:
+		opts = append(opts, kgo.SASL(kscram.Auth{User: s.SASLUsername, Pass: s.SASLPassword}.AsSha512Mechanism()))
+	}
+
+	return opts, nil
+}
+
+func (s Security) tlsConfig() (*tls.Config, error) {
+	tc := &tls.Config{
+		ServerName:         s.ServerName,
+		InsecureSkipVerify: s.InsecureSkipVerify,
+		MinVersion:         tls.VersionTLS12,
+	}
+
+	if len(s.CAFile) > 0 {
+		b, err := ioutil.ReadFile(s.CAFile)
+		if err != nil {
+			return nil, err
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(b) {
+			return nil, fmt.Errorf("kafka: TLS CA file %q contains no PEM certificates", s.CAFile)
+		}
+		tc.RootCAs = pool
+	}
+
+	if len(s.CertFile) > 0 {
+		cert, err := tls.LoadX509KeyPair(s.CertFile, s.KeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("kafka: invalid TLS certificate or key: %s", err)
+		}
+		tc.Certificates = []tls.Certificate{cert}
+	}
+
+	return tc, nil
+}
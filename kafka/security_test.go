@@ -0,0 +1,54 @@
+package kafka
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestValidate(t *testing.T) {
+	if err := (Security{}).Validate(); err != nil {
+		t.Errorf("expected zero config to be valid, got %s", err)
+	}
+
+	err := Security{CAFile: "/does/not/exist.pem", CertFile: "/does/not/exist.crt"}.Validate()
+	if err == nil {
+		t.Fatal("expected error")
+	}
+	for _, s := range []string{`TLS CA file "/does/not/exist.pem" does not exist`, `TLS certificate file "/does/not/exist.crt" does not exist`, "must be set together"} {
+		if !strings.Contains(err.Error(), s) {
+			t.Errorf("expected error to contain %q, got %q", s, err)
+		}
+	}
+
+	err = Security{SASLMechanism: "PLAIN", SASLUsername: "user", SASLPassword: "pass"}.Validate()
+	if err == nil || !strings.Contains(err.Error(), "requires TLS") {
+		t.Errorf("expected PLAIN without TLS to be invalid, got %v", err)
+	}
+
+	err = Security{SASLMechanism: "GSSAPI"}.Validate()
+	if err == nil || !strings.Contains(err.Error(), "unsupported SASL mechanism") {
+		t.Errorf("expected unsupported mechanism error, got %v", err)
+	}
+}
+
+func TestClientOptions(t *testing.T) {
+	opts, err := Security{TLS: true, SASLMechanism: "SCRAM-SHA-256", SASLUsername: "user", SASLPassword: "pass"}.ClientOptions()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(opts) != 2 {
+		t.Errorf("expected TLS and SASL options, got %d", len(opts))
+	}
+
+	if _, err := (Security{SASLMechanism: "GSSAPI"}).ClientOptions(); err == nil {
+		t.Error("expected invalid config error")
+	}
+}
+
+func TestSecurityConfig(t *testing.T) {
+	c := SecurityConfig{TLSCAFile: "ca.pem", TLSServerName: "kafka", SASLMechanism: SASLPlain, SASLUsername: "user", SASLPassword: "pass"}
+	s := c.Security()
+	if s.CAFile != "ca.pem" || s.ServerName != "kafka" || s.SASLMechanism != SASLPlain || s.SASLUsername != "user" || s.SASLPassword != "pass" {
+		t.Errorf("unexpected security: %+v", s)
+	}
+}
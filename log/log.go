@@ -1,8 +1,11 @@
 package log
 
 import (
+	"bufio"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"net"
 	"net/http"
 	"os"
 	"sync"
@@ -69,6 +72,21 @@ func (r *responseCapture) Flush() {
 	}
 }
 
+func (r *responseCapture) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	if hj, ok := r.ResponseWriter.(http.Hijacker); ok {
+		r.statusCode = http.StatusSwitchingProtocols
+		return hj.Hijack()
+	}
+	return nil, nil, errors.New("log: ResponseWriter does not implement http.Hijacker")
+}
+
+func (r *responseCapture) Push(target string, opts *http.PushOptions) error {
+	if p, ok := r.ResponseWriter.(http.Pusher); ok {
+		return p.Push(target, opts)
+	}
+	return http.ErrNotSupported
+}
+
 // Event records an event
 func Event(name string, context string, data Data) {
 	m := map[string]interface{}{
@@ -0,0 +1,62 @@
+// Package metrics provides simple counters and gauges published using expvar
+package metrics
+
+import (
+	"expvar"
+	"net/http"
+	"sync"
+
+	"github.com/gorilla/pat"
+)
+
+var mu sync.Mutex
+
+// Int returns the named integer metric, creating it if it doesn't exist
+//
+// Int can be used for both counters and gauges
+func Int(name string) *expvar.Int {
+	mu.Lock()
+	defer mu.Unlock()
+
+	if v := expvar.Get(name); v != nil {
+		if i, ok := v.(*expvar.Int); ok {
+			return i
+		}
+	}
+	return expvar.NewInt(name)
+}
+
+// Map returns the named map metric, creating it if it doesn't exist
+//
+// Map can be used for labelled metrics, e.g. counts by status code
+func Map(name string) *expvar.Map {
+	mu.Lock()
+	defer mu.Unlock()
+
+	if v := expvar.Get(name); v != nil {
+		if m, ok := v.(*expvar.Map); ok {
+			return m
+		}
+	}
+	return expvar.NewMap(name)
+}
+
+// Incr increments the named counter by one
+func Incr(name string) {
+	Int(name).Add(1)
+}
+
+// Set sets the named gauge
+func Set(name string, value int64) {
+	Int(name).Set(value)
+}
+
+// Register registers a route which publishes all metrics as JSON
+func Register(r *pat.Router, path string) {
+	r.Path(path).Methods("GET").Handler(Handler())
+}
+
+// Handler returns a HTTP handler which publishes all metrics as JSON
+func Handler() http.Handler {
+	return expvar.Handler()
+}
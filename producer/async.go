@@ -0,0 +1,317 @@
+package producer
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/ian-kent/service.go/log"
+	"github.com/ian-kent/service.go/pubsub"
+	"github.com/twmb/franz-go/pkg/kgo"
+)
+
+// AsyncOptions configures an asynchronous producer
+type AsyncOptions struct {
+	// BatchBytes is the size in bytes of a full batch for a partition,
+	// which is sent without waiting for Linger, or zero for the client
+	// default of about 1MB
+	BatchBytes int
+	// Linger is how long messages wait for a batch to fill before
+	// being sent, or zero to send immediately
+	Linger time.Duration
+	// Compression is the compression codec, one of "none", "gzip",
+	// "snappy", "lz4" or "zstd"
+	Compression string
+	// Idempotent enables idempotent delivery, so retries can't
+	// duplicate or reorder messages
+	Idempotent bool
+}
+
+// DefaultAsyncOptions are the options used by NewAsync if none are given
+var DefaultAsyncOptions = AsyncOptions{
+	Linger:      10 * time.Millisecond,
+	Compression: "snappy",
+	Idempotent:  true,
+}
+
+// Callback is called when a message has been delivered, or has failed
+//
+// Callbacks are called in order on a separate goroutine to the Kafka
+// client, so a slow callback delays later callbacks but not delivery.
+// They may call SendAsync, but not Flush or Close, which wait for
+// callbacks to return.
+type Callback func(partition int32, offset int64, err error)
+
+// Result is the future result of an asynchronous send
+type Result struct {
+	done      chan struct{}
+	callback  Callback
+	partition int32
+	offset    int64
+	err       error
+}
+
+// Done returns a channel which is closed when the result is available
+func (r *Result) Done() <-chan struct{} {
+	return r.done
+}
+
+// Wait waits for the result, or returns the context error if ctx is done first
+func (r *Result) Wait(ctx context.Context) (partition int32, offset int64, err error) {
+	select {
+	case <-r.done:
+		return r.partition, r.offset, r.err
+	case <-ctx.Done():
+		return 0, 0, ctx.Err()
+	}
+}
+
+func (r *Result) complete(partition int32, offset int64, err error) {
+	r.partition, r.offset, r.err = partition, offset, err
+	close(r.done)
+}
+
+// call calls the callback, if any, with the result
+func (r *Result) call() {
+	if r.callback != nil {
+		r.callback(r.partition, r.offset, r.err)
+	}
+}
+
+// AsyncProducer sends messages in batches without waiting for delivery
+type AsyncProducer interface {
+	Producer
+	// SendAsync queues a message, calling callback (if not nil) once
+	// it's been delivered or has failed
+	SendAsync(msg Message, callback Callback) *Result
+	// SendAsyncContext is SendAsync with the request ID and trace
+	// context from ctx added to the message headers
+	SendAsyncContext(ctx context.Context, msg Message, callback Callback) *Result
+	// Flush waits for queued messages to be delivered, and their
+	// callbacks to return
+	//
+	// It can be registered with Service.OnShutdown.
+	Flush(ctx context.Context) error
+	// Close flushes queued messages and closes the producer
+	Close() error
+}
+
+type asyncProducer struct {
+	client client
+
+	mu      sync.Mutex
+	pending int
+	idle    chan struct{}
+	// results are completed results waiting for their callbacks
+	results []*Result
+	calling bool
+
+	closeMu sync.RWMutex
+	closed  bool
+
+	Config
+}
+
+// NewAsync returns an asynchronous producer using the options, or
+// DefaultAsyncOptions if none are given
+func NewAsync(config Config, opts ...AsyncOptions) (AsyncProducer, error) {
+	o := DefaultAsyncOptions
+	if len(opts) > 0 {
+		o = opts[0]
+	}
+
+	kopts, err := asyncOptions(config, o)
+	if err != nil {
+		return nil, err
+	}
+
+	client, err := kgo.NewClient(kopts...)
+	if err != nil {
+		return nil, err
+	}
+
+	return newAsyncProducer(config, client), nil
+}
+
+func asyncOptions(config Config, o AsyncOptions) ([]kgo.Opt, error) {
+	opts, err := clientOptions(config)
+	if err != nil {
+		return nil, err
+	}
+
+	codec, err := compressionCodec(o.Compression)
+	if err != nil {
+		return nil, err
+	}
+	opts = append(opts, kgo.ProducerBatchCompression(codec), kgo.ProducerLinger(o.Linger))
+	if o.BatchBytes > 0 {
+		opts = append(opts, kgo.ProducerBatchMaxBytes(int32(o.BatchBytes)))
+	}
+	if !o.Idempotent {
+		opts = append(opts, kgo.DisableIdempotentWrite())
+	}
+
+	return opts, nil
+}
+
+func newAsyncProducer(config Config, client client) *asyncProducer {
+	return &asyncProducer{
+		Config: config,
+		client: client,
+	}
+}
+
+func compressionCodec(name string) (kgo.CompressionCodec, error) {
+	switch strings.ToLower(name) {
+	case "", "none":
+		return kgo.NoCompression(), nil
+	case "gzip":
+		return kgo.GzipCompression(), nil
+	case "snappy":
+		return kgo.SnappyCompression(), nil
+	case "lz4":
+		return kgo.Lz4Compression(), nil
+	case "zstd":
+		return kgo.ZstdCompression(), nil
+	}
+	return kgo.NoCompression(), fmt.Errorf("producer: unsupported compression: %s", name)
+}
+
+// ErrClosed is returned when sending a message using a closed producer
+var ErrClosed = errors.New("producer: closed")
+
+func (ap *asyncProducer) SendAsync(msg Message, callback Callback) *Result {
+	r := &Result{done: make(chan struct{}), callback: callback}
+	if err := ap.send(msg, r); err != nil {
+		// messages which can't be queued fail before SendAsync returns
+		r.complete(0, 0, err)
+		r.call()
+	}
+	return r
+}
+
+// send queues the message for the result
+func (ap *asyncProducer) send(msg Message, r *Result) error {
+	// the read lock prevents the producer being closed while sending
+	ap.closeMu.RLock()
+	defer ap.closeMu.RUnlock()
+
+	if ap.closed {
+		return ErrClosed
+	}
+
+	rec, err := record(msg)
+	if err != nil {
+		return err
+	}
+
+	ap.mu.Lock()
+	ap.pending++
+	ap.mu.Unlock()
+
+	ap.client.Produce(context.Background(), rec, func(rec *kgo.Record, err error) {
+		if err != nil {
+			log.Error(err, log.Data{"topic": rec.Topic})
+		}
+		ap.done(r, rec, err)
+	})
+
+	return nil
+}
+
+func (ap *asyncProducer) Send(msg Message) (partition int32, offset int64, err error) {
+	return ap.SendAsync(msg, nil).Wait(context.Background())
+}
+
+func (ap *asyncProducer) SendContext(ctx context.Context, msg Message) (partition int32, offset int64, err error) {
+	return ap.Send(pubsub.WithContext(ctx, msg))
+}
+
+func (ap *asyncProducer) SendAsyncContext(ctx context.Context, msg Message, callback Callback) *Result {
+	return ap.SendAsync(pubsub.WithContext(ctx, msg), callback)
+}
+
+// done completes the result, and queues its callback to be called
+// without blocking the client
+func (ap *asyncProducer) done(r *Result, rec *kgo.Record, err error) {
+	r.complete(rec.Partition, rec.Offset, err)
+
+	ap.mu.Lock()
+	defer ap.mu.Unlock()
+	ap.results = append(ap.results, r)
+	if !ap.calling {
+		ap.calling = true
+		go ap.callbacks()
+	}
+}
+
+// callbacks calls the callbacks for completed results until there
+// are none left, and the message is no longer pending once its
+// callback has returned
+func (ap *asyncProducer) callbacks() {
+	for {
+		ap.mu.Lock()
+		if len(ap.results) == 0 {
+			ap.calling = false
+			ap.mu.Unlock()
+			return
+		}
+		r := ap.results[0]
+		ap.results = ap.results[1:]
+		ap.mu.Unlock()
+
+		r.call()
+
+		ap.mu.Lock()
+		ap.pending--
+		if ap.pending == 0 && ap.idle != nil {
+			close(ap.idle)
+			ap.idle = nil
+		}
+		ap.mu.Unlock()
+	}
+}
+
+func (ap *asyncProducer) Flush(ctx context.Context) error {
+	ap.mu.Lock()
+	if ap.pending == 0 {
+		ap.mu.Unlock()
+		return nil
+	}
+	if ap.idle == nil {
+		ap.idle = make(chan struct{})
+	}
+	idle := ap.idle
+	ap.mu.Unlock()
+
+	// lingering batches are sent immediately
+	if err := ap.client.Flush(ctx); err != nil {
+		return err
+	}
+
+	select {
+	case <-idle:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func (ap *asyncProducer) Close() error {
+	ap.closeMu.Lock()
+	if ap.closed {
+		ap.closeMu.Unlock()
+		return nil
+	}
+	ap.closed = true
+	ap.closeMu.Unlock()
+
+	// queued messages are delivered, and their callbacks called,
+	// before returning
+	err := ap.Flush(context.Background())
+	ap.client.Close()
+	return err
+}
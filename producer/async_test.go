@@ -0,0 +1,294 @@
+package producer
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/ian-kent/service.go/handlers/requestID"
+	"github.com/ian-kent/service.go/handlers/trace"
+	"github.com/ian-kent/service.go/pubsub"
+	"github.com/twmb/franz-go/pkg/kgo"
+)
+
+// fakeClient completes produced records with the queued errors, and
+// holds them until Flush is called if hold is set
+type fakeClient struct {
+	mu     sync.Mutex
+	errs   []error
+	offset int64
+	hold   bool
+	held   []func()
+	closed bool
+
+	records []*kgo.Record
+}
+
+func (f *fakeClient) Produce(ctx context.Context, r *kgo.Record, promise func(*kgo.Record, error)) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	f.records = append(f.records, r)
+	var err error
+	if len(f.errs) > 0 {
+		err, f.errs = f.errs[0], f.errs[1:]
+	}
+	if err == nil {
+		r.Offset = f.offset
+		f.offset++
+	}
+	complete := func() { promise(r, err) }
+	if f.hold {
+		f.held = append(f.held, complete)
+		return
+	}
+	go complete()
+}
+
+func (f *fakeClient) Flush(ctx context.Context) error {
+	f.mu.Lock()
+	held := f.held
+	f.held = nil
+	f.mu.Unlock()
+
+	for _, complete := range held {
+		complete()
+	}
+	return nil
+}
+
+func (f *fakeClient) Close() {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.closed = true
+}
+
+var errProduce = errors.New("produce failed")
+
+func TestAsyncOptions(t *testing.T) {
+	config := DefaultProducerConfig{defaultConfig{KafkaBrokers: "localhost:9092"}}
+
+	opts, err := asyncOptions(config, DefaultAsyncOptions)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the options are validated by the client without connecting
+	client, err := kgo.NewClient(opts...)
+	if err != nil {
+		t.Fatalf("expected valid client options, got %s", err)
+	}
+	client.Close()
+
+	if _, err := asyncOptions(config, AsyncOptions{Compression: "brotli"}); err == nil {
+		t.Error("expected unsupported compression error")
+	}
+}
+
+func TestSend(t *testing.T) {
+	fc := &fakeClient{errs: []error{nil, errProduce}}
+	p := &kafkaProducer{client: fc}
+
+	if _, offset, err := p.Send(NewStringMessage("topic", "key", "a")); err != nil || offset != 0 {
+		t.Errorf("unexpected result: %d %v", offset, err)
+	}
+	if _, _, err := p.Send(NewStringMessage("topic", "key", "b")); err != errProduce {
+		t.Errorf("expected produce error, got %v", err)
+	}
+}
+
+func TestSendContext(t *testing.T) {
+	fc := &fakeClient{}
+	ap := newAsyncProducer(DefaultProducerConfig{}, fc)
+	defer ap.Close()
+
+	tc := trace.New()
+	ctx := trace.NewContext(requestID.NewContext(context.Background(), "abc123"), tc)
+
+	producers := []Producer{&kafkaProducer{client: fc}, ap}
+	for _, p := range producers {
+		if _, _, err := p.SendContext(ctx, NewStringMessage("topic", "key", "a")); err != nil {
+			t.Fatal(err)
+		}
+	}
+	ap.SendAsyncContext(ctx, NewStringMessage("topic", "key", "b"), nil).Wait(context.Background())
+
+	if len(fc.records) != 3 {
+		t.Fatalf("expected 3 records, got %d", len(fc.records))
+	}
+	for i, r := range fc.records {
+		headers := make(map[string]string)
+		for _, h := range r.Headers {
+			headers[h.Key] = string(h.Value)
+		}
+		if headers[pubsub.RequestIDHeader] != "abc123" {
+			t.Errorf("record %d: expected request ID header, got %v", i, headers)
+		}
+		if p, ok := trace.Parse(headers[trace.ParentHeader], ""); !ok || p.TraceID != tc.TraceID {
+			t.Errorf("record %d: expected traceparent in trace %s, got %v", i, tc.TraceID, headers)
+		}
+	}
+}
+
+func TestSendAsync(t *testing.T) {
+	ap := newAsyncProducer(DefaultProducerConfig{}, &fakeClient{offset: 1, errs: []error{nil, errProduce}})
+	defer ap.Close()
+
+	called := make(chan error, 1)
+	r := ap.SendAsync(NewStringMessage("topic", "key", "a"), func(partition int32, offset int64, err error) {
+		called <- err
+	})
+	if err := <-called; err != nil {
+		t.Errorf("expected callback without error, got %s", err)
+	}
+	if _, offset, err := r.Wait(context.Background()); err != nil || offset != 1 {
+		t.Errorf("unexpected result: %d %v", offset, err)
+	}
+
+	if _, _, err := ap.Send(NewStringMessage("topic", "key", "b")); err != errProduce {
+		t.Errorf("expected produce error, got %v", err)
+	}
+}
+
+func TestSlowCallback(t *testing.T) {
+	fc := &fakeClient{hold: true}
+	ap := newAsyncProducer(DefaultProducerConfig{}, fc)
+	defer ap.Close()
+
+	release := make(chan struct{})
+	var order []string
+	first := ap.SendAsync(NewStringMessage("topic", "key", "a"), func(partition int32, offset int64, err error) {
+		<-release
+		order = append(order, "a")
+		// callbacks can send messages
+		ap.SendAsync(NewStringMessage("topic", "key", "c"), func(partition int32, offset int64, err error) {
+			order = append(order, "c")
+		})
+	})
+	second := ap.SendAsync(NewStringMessage("topic", "key", "b"), func(partition int32, offset int64, err error) {
+		order = append(order, "b")
+	})
+
+	// the client completes both records while the first callback blocks
+	flushed := make(chan struct{})
+	go func() {
+		fc.Flush(context.Background())
+		close(flushed)
+	}()
+	select {
+	case <-flushed:
+	case <-time.After(5 * time.Second):
+		t.Fatal("expected a slow callback not to block the client")
+	}
+	for _, r := range []*Result{first, second} {
+		if _, _, err := r.Wait(context.Background()); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	if err := ap.Flush(ctx); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("expected flush to wait for callbacks, got %v", err)
+	}
+
+	// the message sent by the callback isn't held until the next flush
+	fc.mu.Lock()
+	fc.hold = false
+	fc.mu.Unlock()
+
+	close(release)
+	if err := ap.Flush(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if len(order) != 3 || order[0] != "a" || order[1] != "b" || order[2] != "c" {
+		t.Errorf("expected callbacks to be called in order, got %v", order)
+	}
+}
+
+func TestResultWait(t *testing.T) {
+	r := &Result{done: make(chan struct{})}
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, _, err := r.Wait(ctx); err != context.Canceled {
+		t.Errorf("expected context error, got %v", err)
+	}
+
+	r.complete(1, 2, nil)
+	select {
+	case <-r.Done():
+	default:
+		t.Error("expected result to be done")
+	}
+}
+
+func TestFlush(t *testing.T) {
+	ap := newAsyncProducer(DefaultProducerConfig{}, &fakeClient{hold: true})
+	defer ap.Close()
+
+	// an idle producer doesn't wait for the context
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if err := ap.Flush(ctx); err != nil {
+		t.Errorf("expected idle flush to succeed, got %s", err)
+	}
+
+	var results []*Result
+	for i := 0; i < 10; i++ {
+		results = append(results, ap.SendAsync(NewStringMessage("topic", "key", "value"), nil))
+	}
+	if err := ap.Flush(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	for i, r := range results {
+		select {
+		case <-r.Done():
+		default:
+			t.Errorf("expected message %d to be delivered after flush", i)
+		}
+	}
+}
+
+func TestFlushTimeout(t *testing.T) {
+	ap := newAsyncProducer(DefaultProducerConfig{}, &fakeClient{})
+
+	// a message the client hasn't acknowledged yet
+	ap.mu.Lock()
+	ap.pending++
+	ap.mu.Unlock()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	if err := ap.Flush(ctx); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("expected deadline exceeded, got %v", err)
+	}
+}
+
+func TestSendAfterClose(t *testing.T) {
+	fc := &fakeClient{hold: true}
+	ap := newAsyncProducer(DefaultProducerConfig{}, fc)
+
+	r := ap.SendAsync(NewStringMessage("topic", "key", "value"), nil)
+	if err := ap.Close(); err != nil {
+		t.Fatal(err)
+	}
+	// messages queued before closing are delivered
+	if _, _, err := r.Wait(context.Background()); err != nil {
+		t.Errorf("expected queued message to be delivered, got %s", err)
+	}
+	if !fc.closed {
+		t.Error("expected client to be closed")
+	}
+
+	var called error
+	r = ap.SendAsync(NewStringMessage("topic", "key", "value"), func(partition int32, offset int64, err error) {
+		called = err
+	})
+	if _, _, err := r.Wait(context.Background()); err != ErrClosed || called != ErrClosed {
+		t.Errorf("expected ErrClosed, got %v %v", err, called)
+	}
+	if err := ap.Close(); err != nil {
+		t.Errorf("expected second close to succeed, got %s", err)
+	}
+}
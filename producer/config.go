@@ -1,16 +1,23 @@
 package producer
 
-import "strings"
+import (
+	"strings"
+
+	"github.com/ian-kent/service.go/kafka"
+)
 
 // FIXME rationalise with consumer/config.go
 
 // Config represents the configuration required for a consumer service
 type Config interface {
 	KafkaBrokers() []string
+	Security() kafka.Security
 }
 
 type defaultConfig struct {
 	KafkaBrokers string `env:"KAFKA_BROKERS" flag:"kafka-brokers" flagDesc:"Kafka brokers"`
+
+	kafka.SecurityConfig
 }
 
 // DefaultProducerConfig is a default Config implementation
@@ -22,3 +29,8 @@ type DefaultProducerConfig struct {
 func (c DefaultProducerConfig) KafkaBrokers() []string {
 	return strings.Split(c.defaultConfig.KafkaBrokers, ",")
 }
+
+// Security implements Config.Security
+func (c DefaultProducerConfig) Security() kafka.Security {
+	return c.defaultConfig.SecurityConfig.Security()
+}
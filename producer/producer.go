@@ -1,67 +1,166 @@
 package producer
 
-import "github.com/Shopify/sarama"
+import (
+	"context"
+	"time"
+
+	"github.com/ian-kent/service.go/pubsub"
+	"github.com/ian-kent/service.go/pubsub/codec"
+	"github.com/twmb/franz-go/pkg/kgo"
+)
 
 // Producer ...
+//
+// It's implemented using Kafka by New, and in-process by the
+// pubsub/memory package.
 type Producer interface {
-	Send(Message) (partition int32, offset int64, err error)
+	pubsub.Publisher
+	// SendContext sends a message with the request ID and trace
+	// context from ctx added to its headers, see pubsub.WithContext
+	//
+	// The context isn't used to cancel the send.
+	SendContext(ctx context.Context, msg Message) (partition int32, offset int64, err error)
 }
 
 // Message ...
-type Message interface {
-	Topic() string
-	Key() sarama.Encoder
-	Value() sarama.Encoder
-}
+type Message = pubsub.OutgoingMessage
 
-type saramaMessage struct {
-	key, value sarama.Encoder
+type message struct {
+	key, value pubsub.Encoder
 	topic      string
+	headers    map[string]string
+	timestamp  time.Time
 }
 
-func (sm saramaMessage) Key() sarama.Encoder   { return sm.key }
-func (sm saramaMessage) Value() sarama.Encoder { return sm.value }
-func (sm saramaMessage) Topic() string         { return sm.topic }
+func (m message) Key() pubsub.Encoder        { return m.key }
+func (m message) Value() pubsub.Encoder      { return m.value }
+func (m message) Topic() string              { return m.topic }
+func (m message) Headers() map[string]string { return m.headers }
+func (m message) Timestamp() time.Time       { return m.timestamp }
 
 // NewStringMessage returns a new Message
 func NewStringMessage(topic, key, value string) Message {
-	return saramaMessage{sarama.StringEncoder(key), sarama.StringEncoder(value), topic}
+	return message{pubsub.StringEncoder(key), pubsub.StringEncoder(value), topic, nil, time.Time{}}
 }
 
 // NewByteMessage returns a new Message
 func NewByteMessage(topic, key string, value []byte) Message {
-	return saramaMessage{sarama.StringEncoder(key), sarama.ByteEncoder(value), topic}
+	return message{pubsub.StringEncoder(key), pubsub.ByteEncoder(value), topic, nil, time.Time{}}
+}
+
+// NewTimestampMessage returns a new Message with headers and a timestamp
+func NewTimestampMessage(topic string, key, value pubsub.Encoder, headers map[string]string, timestamp time.Time) Message {
+	return message{key, value, topic, headers, timestamp}
+}
+
+// NewMessage returns a new Message with headers
+func NewMessage(topic string, key, value pubsub.Encoder, headers map[string]string) Message {
+	return message{key, value, topic, headers, time.Time{}}
+}
+
+// NewCodecMessage returns a new Message with the value encoded by the
+// codec, and the content type header set
+//
+// Consumers can decode the value using codec.Decode.
+func NewCodecMessage(topic, key string, value interface{}, c codec.Codec) (Message, error) {
+	v, err := codec.Encode(c, value)
+	if err != nil {
+		return nil, err
+	}
+	headers := map[string]string{codec.ContentTypeHeader: c.ContentType()}
+	return message{pubsub.StringEncoder(key), v, topic, headers, time.Time{}}, nil
+}
+
+// client is the part of *kgo.Client used by the producers
+type client interface {
+	Produce(ctx context.Context, r *kgo.Record, promise func(*kgo.Record, error))
+	Flush(ctx context.Context) error
+	Close()
 }
 
 type kafkaProducer struct {
-	producer sarama.SyncProducer
+	client client
 
 	Config
 }
 
 // New ...
 func New(config Config) (Producer, error) {
-	cfg := sarama.NewConfig()
-	cfg.Producer.RequiredAcks = sarama.WaitForAll
-	cfg.Producer.Retry.Max = 10
-
-	// TODO: TLS config, see https://github.com/Shopify/sarama/blob/master/examples/http_server/http_server.go
+	opts, err := clientOptions(config)
+	if err != nil {
+		return nil, err
+	}
 
-	producer, err := sarama.NewSyncProducer(config.KafkaBrokers(), cfg)
+	client, err := kgo.NewClient(opts...)
 	if err != nil {
 		return nil, err
 	}
 
 	return &kafkaProducer{
-		Config:   config,
-		producer: producer,
+		Config: config,
+		client: client,
 	}, nil
 }
 
-func (kc *kafkaProducer) Send(msg Message) (partition int32, offset int64, err error) {
-	return kc.producer.SendMessage(&sarama.ProducerMessage{
-		Key:   msg.Key(),
-		Value: msg.Value(),
-		Topic: msg.Topic(),
+// clientOptions returns the client options shared by the producers
+func clientOptions(config Config) ([]kgo.Opt, error) {
+	security, err := config.Security().ClientOptions()
+	if err != nil {
+		return nil, err
+	}
+
+	opts := []kgo.Opt{
+		kgo.SeedBrokers(config.KafkaBrokers()...),
+		kgo.RequiredAcks(kgo.AllISRAcks()),
+		kgo.RecordRetries(10),
+	}
+	return append(opts, security...), nil
+}
+
+func (kp *kafkaProducer) Send(msg Message) (partition int32, offset int64, err error) {
+	r, err := record(msg)
+	if err != nil {
+		return 0, 0, err
+	}
+
+	done := make(chan struct{})
+	kp.client.Produce(context.Background(), r, func(_ *kgo.Record, e error) {
+		err = e
+		close(done)
 	})
+	<-done
+
+	if err != nil {
+		return 0, 0, err
+	}
+	return r.Partition, r.Offset, nil
+}
+
+func (kp *kafkaProducer) SendContext(ctx context.Context, msg Message) (partition int32, offset int64, err error) {
+	return kp.Send(pubsub.WithContext(ctx, msg))
+}
+
+// record returns the Kafka record for a message
+func record(msg Message) (*kgo.Record, error) {
+	r := &kgo.Record{
+		Topic:     msg.Topic(),
+		Timestamp: msg.Timestamp(),
+	}
+
+	var err error
+	if msg.Key() != nil {
+		if r.Key, err = msg.Key().Encode(); err != nil {
+			return nil, err
+		}
+	}
+	if msg.Value() != nil {
+		if r.Value, err = msg.Value().Encode(); err != nil {
+			return nil, err
+		}
+	}
+
+	for k, v := range msg.Headers() {
+		r.Headers = append(r.Headers, kgo.RecordHeader{Key: k, Value: []byte(v)})
+	}
+	return r, nil
 }
@@ -0,0 +1,76 @@
+package codec
+
+import (
+	"fmt"
+
+	"github.com/hamba/avro/v2"
+)
+
+// Avro is an Avro codec
+//
+// Values are Go structs with `avro` field tags, or maps.
+type Avro struct {
+	definition string
+	schema     avro.Schema
+}
+
+// NewAvro returns an Avro codec for the schema definition
+func NewAvro(definition string) (*Avro, error) {
+	s, err := avro.Parse(definition)
+	if err != nil {
+		return nil, fmt.Errorf("codec: invalid avro schema: %s", err)
+	}
+	return &Avro{definition: definition, schema: s}, nil
+}
+
+// ContentType implements Codec.ContentType
+func (a *Avro) ContentType() string { return "application/avro" }
+
+// Marshal implements Codec.Marshal
+func (a *Avro) Marshal(v interface{}) ([]byte, error) {
+	return avro.Marshal(a.schema, v)
+}
+
+// Unmarshal implements Codec.Unmarshal
+func (a *Avro) Unmarshal(data []byte, v interface{}) error {
+	return avro.Unmarshal(a.schema, data, v)
+}
+
+// Schema implements SchemaCodec.Schema
+func (a *Avro) Schema() (string, string) {
+	return SchemaAvro, a.definition
+}
+
+// WithSchema implements SchemaCodec.WithSchema
+//
+// The returned codec decodes data written with the definition,
+// resolving it against this codec's schema. It fails if the
+// schemas aren't compatible.
+func (a *Avro) WithSchema(definition string) (Codec, error) {
+	if definition == a.definition {
+		return a, nil
+	}
+
+	writer, err := avro.Parse(definition)
+	if err != nil {
+		return nil, fmt.Errorf("codec: invalid avro schema: %s", err)
+	}
+
+	resolved, err := avro.NewSchemaCompatibility().Resolve(a.schema, writer)
+	if err != nil {
+		return nil, fmt.Errorf("codec: incompatible avro schema: %s", err)
+	}
+
+	return avroReader{a, resolved}, nil
+}
+
+// avroReader decodes data written with a different schema, and
+// encodes data using the reader's schema
+type avroReader struct {
+	*Avro
+	resolved avro.Schema
+}
+
+func (r avroReader) Unmarshal(data []byte, v interface{}) error {
+	return avro.Unmarshal(r.resolved, data, v)
+}
@@ -0,0 +1,120 @@
+// Package codec encodes and decodes typed message keys and values
+//
+// Codecs can be used directly, or wrapped by schema.NewCodec to
+// register schemas and embed schema IDs in the encoded data.
+package codec
+
+import (
+	"encoding/json"
+	"fmt"
+
+	"github.com/ian-kent/service.go/pubsub"
+	"google.golang.org/protobuf/proto"
+)
+
+// ContentTypeHeader is the message header set to the codec content type
+var ContentTypeHeader = "content-type"
+
+// Schema types, using the names used by schema registries
+const (
+	SchemaJSON     = "JSON"
+	SchemaProtobuf = "PROTOBUF"
+	SchemaAvro     = "AVRO"
+)
+
+// Codec encodes and decodes values
+type Codec interface {
+	// ContentType is the MIME type of the encoded data
+	ContentType() string
+	Marshal(v interface{}) ([]byte, error)
+	Unmarshal(data []byte, v interface{}) error
+}
+
+// SchemaCodec is a Codec whose data is described by a schema
+type SchemaCodec interface {
+	Codec
+	// Schema returns the schema type and definition
+	Schema() (typ, definition string)
+	// WithSchema returns a codec which decodes data written using
+	// a different version of the schema
+	WithSchema(definition string) (Codec, error)
+}
+
+// Encode returns an encoder for v, for use as a message key or value
+func Encode(c Codec, v interface{}) (pubsub.Encoder, error) {
+	b, err := c.Marshal(v)
+	if err != nil {
+		return nil, err
+	}
+	return pubsub.ByteEncoder(b), nil
+}
+
+// Decode decodes the message value into v
+func Decode(c Codec, msg pubsub.Message, v interface{}) error {
+	return c.Unmarshal(msg.Value(), v)
+}
+
+// DecodeKey decodes the message key into v
+func DecodeKey(c Codec, msg pubsub.Message, v interface{}) error {
+	return c.Unmarshal(msg.Key(), v)
+}
+
+// JSON is a JSON codec
+var JSON Codec = jsonCodec{}
+
+type jsonCodec struct {
+	definition string
+}
+
+func (jsonCodec) ContentType() string                        { return "application/json" }
+func (jsonCodec) Marshal(v interface{}) ([]byte, error)      { return json.Marshal(v) }
+func (jsonCodec) Unmarshal(data []byte, v interface{}) error { return json.Unmarshal(data, v) }
+
+func (c jsonCodec) Schema() (string, string) { return SchemaJSON, c.definition }
+
+func (c jsonCodec) WithSchema(string) (Codec, error) { return c, nil }
+
+// JSONSchema returns a JSON codec described by a JSON schema
+//
+// The schema is registered by schema.NewCodec, but values aren't
+// validated against it.
+func JSONSchema(definition string) SchemaCodec {
+	return jsonCodec{definition}
+}
+
+// Protobuf is a protocol buffers codec, values must implement proto.Message
+var Protobuf Codec = protobufCodec{}
+
+type protobufCodec struct {
+	definition string
+}
+
+func (protobufCodec) ContentType() string { return "application/x-protobuf" }
+
+func (protobufCodec) Marshal(v interface{}) ([]byte, error) {
+	m, ok := v.(proto.Message)
+	if !ok {
+		return nil, fmt.Errorf("codec: %T is not a proto.Message", v)
+	}
+	return proto.Marshal(m)
+}
+
+func (protobufCodec) Unmarshal(data []byte, v interface{}) error {
+	m, ok := v.(proto.Message)
+	if !ok {
+		return fmt.Errorf("codec: %T is not a proto.Message", v)
+	}
+	return proto.Unmarshal(data, m)
+}
+
+func (c protobufCodec) Schema() (string, string) { return SchemaProtobuf, c.definition }
+
+// WithSchema implements SchemaCodec.WithSchema, protocol buffers
+// don't need the writer schema to decode data
+func (c protobufCodec) WithSchema(string) (Codec, error) { return c, nil }
+
+// ProtobufSchema returns a protocol buffers codec described by a .proto
+// definition, in which the message type is the first message defined
+func ProtobufSchema(definition string) SchemaCodec {
+	return protobufCodec{definition}
+}
@@ -0,0 +1,95 @@
+package codec
+
+import (
+	"testing"
+
+	"google.golang.org/protobuf/types/known/wrapperspb"
+)
+
+type user struct {
+	Name string `json:"name" avro:"name"`
+	Age  int    `json:"age" avro:"age"`
+}
+
+const userV1 = `{"type":"record","name":"User","fields":[{"name":"name","type":"string"}]}`
+const userV2 = `{"type":"record","name":"User","fields":[{"name":"name","type":"string"},{"name":"age","type":"int","default":18}]}`
+
+func TestJSON(t *testing.T) {
+	b, err := JSON.Marshal(user{"alice", 30})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var u user
+	if err := JSON.Unmarshal(b, &u); err != nil {
+		t.Fatal(err)
+	}
+	if u != (user{"alice", 30}) {
+		t.Errorf("unexpected value: %+v", u)
+	}
+}
+
+func TestProtobuf(t *testing.T) {
+	b, err := Protobuf.Marshal(wrapperspb.String("hello"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var v wrapperspb.StringValue
+	if err := Protobuf.Unmarshal(b, &v); err != nil {
+		t.Fatal(err)
+	}
+	if v.Value != "hello" {
+		t.Errorf("expected hello, got %q", v.Value)
+	}
+
+	if _, err := Protobuf.Marshal(user{}); err == nil {
+		t.Error("expected error marshaling a non-proto value")
+	}
+}
+
+func TestAvro(t *testing.T) {
+	if _, err := NewAvro(`{"type":"nope"}`); err == nil {
+		t.Error("expected invalid schema error")
+	}
+
+	v1, err := NewAvro(userV1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	v2, err := NewAvro(userV2)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	b, err := v2.Marshal(user{"alice", 30})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var u user
+	if err := v2.Unmarshal(b, &u); err != nil {
+		t.Fatal(err)
+	}
+	if u != (user{"alice", 30}) {
+		t.Errorf("unexpected value: %+v", u)
+	}
+
+	// data written with v1 is read using the v2 default
+	b, err = v1.Marshal(user{Name: "bob"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	r, err := v2.WithSchema(userV1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	u = user{}
+	if err := r.Unmarshal(b, &u); err != nil {
+		t.Fatal(err)
+	}
+	if u != (user{"bob", 18}) {
+		t.Errorf("unexpected value: %+v", u)
+	}
+
+	if _, err := v2.WithSchema(`{"type":"record","name":"User","fields":[{"name":"name","type":"int"}]}`); err == nil {
+		t.Error("expected incompatible schema error")
+	}
+}
@@ -0,0 +1,65 @@
+package pubsub
+
+import (
+	"context"
+
+	"github.com/ian-kent/service.go/handlers/requestID"
+	"github.com/ian-kent/service.go/handlers/trace"
+)
+
+// RequestIDHeader is the message header used to propagate request IDs
+var RequestIDHeader = "request-id"
+
+// Inject returns a copy of the headers with the request ID and trace
+// context from ctx added
+//
+// The trace context is propagated as a new span of the trace.
+func Inject(ctx context.Context, headers map[string]string) map[string]string {
+	h := make(map[string]string, len(headers)+3)
+	for k, v := range headers {
+		h[k] = v
+	}
+	if id := requestID.FromContext(ctx); len(id) > 0 {
+		h[RequestIDHeader] = id
+	}
+	if tc, ok := trace.FromContext(ctx); ok && tc.Valid() {
+		tc = tc.Child()
+		h[trace.ParentHeader] = tc.Traceparent()
+		if len(tc.State) > 0 {
+			h[trace.StateHeader] = tc.State
+		}
+	}
+	return h
+}
+
+// Extract returns a context carrying the request ID and trace context
+// from the message headers
+func Extract(ctx context.Context, msg Message) context.Context {
+	h := msg.Headers()
+	if id := h[RequestIDHeader]; requestID.Valid(id) {
+		ctx = requestID.NewContext(ctx, id)
+	}
+	if tc, ok := trace.Parse(h[trace.ParentHeader], h[trace.StateHeader]); ok {
+		ctx = trace.NewContext(ctx, tc)
+	}
+	return ctx
+}
+
+// WithContext returns the message with the request ID and trace
+// context from ctx added to its headers
+//
+// For example, in a HTTP handler:
+//
+//	p.Send(pubsub.WithContext(req.Context(), msg))
+//
+// Producers do this in SendContext.
+func WithContext(ctx context.Context, msg OutgoingMessage) OutgoingMessage {
+	return contextMessage{msg, Inject(ctx, msg.Headers())}
+}
+
+type contextMessage struct {
+	OutgoingMessage
+	headers map[string]string
+}
+
+func (m contextMessage) Headers() map[string]string { return m.headers }
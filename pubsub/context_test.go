@@ -0,0 +1,48 @@
+package pubsub
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/ian-kent/service.go/handlers/requestID"
+	"github.com/ian-kent/service.go/handlers/trace"
+)
+
+type testMessage struct {
+	headers map[string]string
+}
+
+func (m testMessage) Topic() string              { return "test" }
+func (m testMessage) Key() []byte                { return nil }
+func (m testMessage) Value() []byte              { return nil }
+func (m testMessage) Partition() int32           { return 0 }
+func (m testMessage) Offset() int64              { return 0 }
+func (m testMessage) Headers() map[string]string { return m.headers }
+func (m testMessage) Timestamp() time.Time       { return time.Time{} }
+
+func TestPropagation(t *testing.T) {
+	tc := trace.New()
+	tc.State = "vendor=value"
+
+	ctx := requestID.NewContext(context.Background(), "abc123")
+	ctx = trace.NewContext(ctx, tc)
+
+	headers := Inject(ctx, map[string]string{"other": "value"})
+	if headers[RequestIDHeader] != "abc123" || headers["other"] != "value" {
+		t.Errorf("unexpected headers: %v", headers)
+	}
+
+	restored := Extract(context.Background(), testMessage{headers})
+	if id := requestID.FromContext(restored); id != "abc123" {
+		t.Errorf("expected request ID to be restored, got %q", id)
+	}
+
+	rtc, ok := trace.FromContext(restored)
+	if !ok || rtc.TraceID != tc.TraceID || rtc.State != tc.State {
+		t.Errorf("expected trace context to be restored, got %+v", rtc)
+	}
+	if rtc.SpanID == tc.SpanID {
+		t.Error("expected message to be a new span")
+	}
+}
@@ -0,0 +1,495 @@
+// Package memory implements an in-process pubsub broker
+package memory
+
+import (
+	"context"
+	"errors"
+	"hash/fnv"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/ian-kent/service.go/pubsub"
+)
+
+// DefaultPartitions is the number of partitions in topics created
+// when they're first used
+var DefaultPartitions = 1
+
+// ErrClosed is returned when committing using a closed subscriber
+var ErrClosed = errors.New("memory: subscriber is closed")
+
+// Broker is an in-process broker with topics, partitions, consumer
+// groups and committed offsets
+//
+// Messages are kept for the lifetime of the broker.
+type Broker struct {
+	mu      sync.Mutex
+	topics  map[string][][]*message
+	groups  map[string]*group
+	changed chan struct{}
+	next    uint32
+}
+
+type topicPartition struct {
+	topic     string
+	partition int32
+}
+
+type group struct {
+	members   []*subscriber
+	committed map[topicPartition]int64
+}
+
+// NewBroker returns a new Broker
+func NewBroker() *Broker {
+	return &Broker{
+		topics:  make(map[string][][]*message),
+		groups:  make(map[string]*group),
+		changed: make(chan struct{}),
+	}
+}
+
+// CreateTopic creates a topic with the number of partitions
+//
+// Creating a topic which already exists has no effect.
+func (b *Broker) CreateTopic(topic string, partitions int) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.createTopic(topic, partitions)
+}
+
+func (b *Broker) createTopic(topic string, partitions int) [][]*message {
+	if t, ok := b.topics[topic]; ok {
+		return t
+	}
+	if partitions < 1 {
+		partitions = 1
+	}
+	t := make([][]*message, partitions)
+	b.topics[topic] = t
+	// subscribers may be waiting for the topic
+	for _, g := range b.groups {
+		if g.subscribed(topic) {
+			b.rebalance(g)
+		}
+	}
+	return t
+}
+
+// broadcast wakes subscribers waiting for messages; b.mu must be held
+func (b *Broker) broadcast() {
+	close(b.changed)
+	b.changed = make(chan struct{})
+}
+
+// SendContext sends the message with the request ID and trace context
+// from ctx added to its headers, see pubsub.WithContext
+func (b *Broker) SendContext(ctx context.Context, msg pubsub.OutgoingMessage) (int32, int64, error) {
+	return b.Send(pubsub.WithContext(ctx, msg))
+}
+
+// Send implements pubsub.Publisher.Send
+//
+// Messages with a key are partitioned by a hash of the key, and
+// messages without one are distributed across partitions.
+func (b *Broker) Send(msg pubsub.OutgoingMessage) (int32, int64, error) {
+	var key, value []byte
+	var err error
+	if msg.Key() != nil {
+		if key, err = msg.Key().Encode(); err != nil {
+			return 0, 0, err
+		}
+	}
+	if msg.Value() != nil {
+		if value, err = msg.Value().Encode(); err != nil {
+			return 0, 0, err
+		}
+	}
+
+	var headers map[string]string
+	if len(msg.Headers()) > 0 {
+		headers = make(map[string]string, len(msg.Headers()))
+		for k, v := range msg.Headers() {
+			headers[k] = v
+		}
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	t := b.createTopic(msg.Topic(), DefaultPartitions)
+
+	var p int32
+	if len(key) > 0 {
+		h := fnv.New32a()
+		h.Write(key)
+		p = int32(h.Sum32() % uint32(len(t)))
+	} else {
+		p = int32(b.next % uint32(len(t)))
+		b.next++
+	}
+
+	m := &message{
+		topic:     msg.Topic(),
+		key:       key,
+		value:     value,
+		headers:   headers,
+		partition: p,
+		offset:    int64(len(t[p])),
+		timestamp: msg.Timestamp(),
+	}
+	if m.timestamp.IsZero() {
+		m.timestamp = time.Now()
+	}
+	t[p] = append(t[p], m)
+	b.broadcast()
+
+	return m.partition, m.offset, nil
+}
+
+// Committed returns the committed offset of a consumer group, which is
+// the offset of the next message to consume, or -1 if none is committed
+func (b *Broker) Committed(groupID, topic string, partition int32) int64 {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	g, ok := b.groups[groupID]
+	if !ok {
+		return -1
+	}
+	if o, ok := g.committed[topicPartition{topic, partition}]; ok {
+		return o
+	}
+	return -1
+}
+
+// HighWatermark returns the offset of the next message published to a partition
+func (b *Broker) HighWatermark(topic string, partition int32) int64 {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	t, ok := b.topics[topic]
+	if !ok || int(partition) >= len(t) {
+		return 0
+	}
+	return int64(len(t[partition]))
+}
+
+// Subscriber returns a subscriber which consumes the topics as a
+// member of the consumer group
+//
+// Partitions are assigned to the members of a group when members
+// start or close. Consumption starts from the committed offset, or
+// the oldest message if no offset is committed.
+func (b *Broker) Subscriber(groupID string, topics ...string) pubsub.Subscriber {
+	return &subscriber{
+		broker: b,
+		group:  groupID,
+		topics: topics,
+		paused: make(map[topicPartition]bool),
+		closed: make(chan struct{}),
+	}
+}
+
+// subscribed returns true if any member of the group consumes the topic
+func (g *group) subscribed(topic string) bool {
+	for _, m := range g.members {
+		if contains(m.topics, topic) {
+			return true
+		}
+	}
+	return false
+}
+
+// rebalance assigns the partitions of a group's topics to its members
+// in turn; b.mu must be held
+//
+// Members keep their positions in partitions they're still assigned,
+// so messages which have been delivered aren't delivered again, and
+// start from the committed offset in newly assigned partitions.
+func (b *Broker) rebalance(g *group) {
+	var tps []topicPartition
+	seen := make(map[string]bool)
+	for _, m := range g.members {
+		for _, topic := range m.topics {
+			if seen[topic] {
+				continue
+			}
+			seen[topic] = true
+			for p := range b.topics[topic] {
+				tps = append(tps, topicPartition{topic, int32(p)})
+			}
+		}
+	}
+	sortTopicPartitions(tps)
+
+	positions := make(map[*subscriber]map[topicPartition]int64, len(g.members))
+	for _, m := range g.members {
+		positions[m] = make(map[topicPartition]int64)
+	}
+
+	i := 0
+	for _, tp := range tps {
+		// assign to the next member subscribed to the topic
+		for n := 0; n < len(g.members); n++ {
+			m := g.members[(i+n)%len(g.members)]
+			if contains(m.topics, tp.topic) {
+				if o, ok := m.positions[tp]; ok {
+					positions[m][tp] = o
+				} else {
+					positions[m][tp] = g.committed[tp]
+				}
+				i = (i + n + 1) % len(g.members)
+				break
+			}
+		}
+	}
+
+	for _, m := range g.members {
+		m.positions = positions[m]
+	}
+
+	b.broadcast()
+}
+
+func sortTopicPartitions(tps []topicPartition) {
+	sort.Slice(tps, func(i, j int) bool {
+		if tps[i].topic != tps[j].topic {
+			return tps[i].topic < tps[j].topic
+		}
+		return tps[i].partition < tps[j].partition
+	})
+}
+
+func contains(s []string, v string) bool {
+	for _, i := range s {
+		if i == v {
+			return true
+		}
+	}
+	return false
+}
+
+type subscriber struct {
+	broker *Broker
+	group  string
+	topics []string
+
+	// positions are the next offsets to deliver for the assigned
+	// partitions, and paused are the paused partitions, both guarded
+	// by broker.mu
+	positions map[topicPartition]int64
+	paused    map[topicPartition]bool
+	turn      int
+
+	startOnce sync.Once
+	closeOnce sync.Once
+	closed    chan struct{}
+	done      chan struct{}
+}
+
+// Start implements pubsub.Subscriber.Start
+func (s *subscriber) Start() chan pubsub.Message {
+	msgs := make(chan pubsub.Message)
+
+	s.startOnce.Do(func() {
+		b := s.broker
+		b.mu.Lock()
+		g, ok := b.groups[s.group]
+		if !ok {
+			g = &group{committed: make(map[topicPartition]int64)}
+			b.groups[s.group] = g
+		}
+		g.members = append(g.members, s)
+		b.rebalance(g)
+		b.mu.Unlock()
+
+		s.done = make(chan struct{})
+		go s.deliver(g, msgs)
+	})
+
+	return msgs
+}
+
+func (s *subscriber) deliver(g *group, msgs chan pubsub.Message) {
+	defer close(s.done)
+	defer close(msgs)
+
+	b := s.broker
+	for {
+		b.mu.Lock()
+		m := s.next()
+		wait := b.changed
+		b.mu.Unlock()
+
+		if m == nil {
+			select {
+			case <-wait:
+				continue
+			case <-s.closed:
+				return
+			}
+		}
+
+		select {
+		case msgs <- m:
+			b.mu.Lock()
+			// the partition may have been reassigned by a rebalance
+			tp := topicPartition{m.topic, m.partition}
+			if o, ok := s.positions[tp]; ok && o == m.offset {
+				s.positions[tp] = m.offset + 1
+			}
+			b.mu.Unlock()
+		case <-wait:
+			// the group rebalanced, or there are new messages
+		case <-s.closed:
+			return
+		}
+	}
+}
+
+// next returns the next message to deliver; broker.mu must be held
+//
+// Partitions are consumed in turn so a busy partition doesn't
+// prevent others from being consumed.
+func (s *subscriber) next() *message {
+	tps := make([]topicPartition, 0, len(s.positions))
+	for tp := range s.positions {
+		tps = append(tps, tp)
+	}
+	sortTopicPartitions(tps)
+
+	for n := 0; n < len(tps); n++ {
+		i := (s.turn + n) % len(tps)
+		tp := tps[i]
+		if s.paused[tp] {
+			continue
+		}
+		msgs := s.broker.topics[tp.topic][tp.partition]
+		if o := s.positions[tp]; o < int64(len(msgs)) {
+			s.turn = i + 1
+			return msgs[o]
+		}
+	}
+	return nil
+}
+
+// Commit implements pubsub.Subscriber.Commit
+func (s *subscriber) Commit(to pubsub.Message) error {
+	select {
+	case <-s.closed:
+		return ErrClosed
+	default:
+	}
+
+	b := s.broker
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	g, ok := b.groups[s.group]
+	if !ok {
+		return ErrClosed
+	}
+
+	tp := topicPartition{to.Topic(), to.Partition()}
+	if to.Offset()+1 > g.committed[tp] {
+		g.committed[tp] = to.Offset() + 1
+	}
+	return nil
+}
+
+// Pause implements pubsub.Subscriber.Pause
+//
+// Paused partitions stay paused if they're reassigned by a rebalance.
+func (s *subscriber) Pause(partitions ...pubsub.TopicPartition) {
+	b := s.broker
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if len(partitions) == 0 {
+		for tp := range s.positions {
+			s.paused[tp] = true
+		}
+		return
+	}
+	for _, p := range partitions {
+		s.paused[topicPartition{p.Topic, p.Partition}] = true
+	}
+}
+
+// Resume implements pubsub.Subscriber.Resume
+func (s *subscriber) Resume(partitions ...pubsub.TopicPartition) {
+	b := s.broker
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if len(partitions) == 0 {
+		s.paused = make(map[topicPartition]bool)
+	}
+	for _, p := range partitions {
+		delete(s.paused, topicPartition{p.Topic, p.Partition})
+	}
+	b.broadcast()
+}
+
+// Lag implements pubsub.Subscriber.Lag
+func (s *subscriber) Lag() map[pubsub.TopicPartition]int64 {
+	b := s.broker
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	lag := make(map[pubsub.TopicPartition]int64, len(s.positions))
+	g, ok := b.groups[s.group]
+	if !ok {
+		return lag
+	}
+	for tp := range s.positions {
+		hwm := int64(len(b.topics[tp.topic][tp.partition]))
+		lag[pubsub.TopicPartition{Topic: tp.topic, Partition: tp.partition}] = hwm - g.committed[tp]
+	}
+	return lag
+}
+
+// Close implements pubsub.Subscriber.Close
+func (s *subscriber) Close() error {
+	s.closeOnce.Do(func() {
+		close(s.closed)
+
+		b := s.broker
+		b.mu.Lock()
+		if g, ok := b.groups[s.group]; ok {
+			for i, m := range g.members {
+				if m == s {
+					g.members = append(g.members[:i], g.members[i+1:]...)
+					b.rebalance(g)
+					break
+				}
+			}
+		}
+		b.mu.Unlock()
+
+		if s.done != nil {
+			<-s.done
+		}
+	})
+	return nil
+}
+
+type message struct {
+	topic     string
+	key       []byte
+	value     []byte
+	headers   map[string]string
+	partition int32
+	offset    int64
+	timestamp time.Time
+}
+
+func (m *message) Topic() string              { return m.topic }
+func (m *message) Key() []byte                { return m.key }
+func (m *message) Value() []byte              { return m.value }
+func (m *message) Partition() int32           { return m.partition }
+func (m *message) Offset() int64              { return m.offset }
+func (m *message) Headers() map[string]string { return m.headers }
+func (m *message) Timestamp() time.Time       { return m.timestamp }
@@ -0,0 +1,168 @@
+package memory
+
+import (
+	"testing"
+	"time"
+
+	"github.com/ian-kent/service.go/pubsub"
+)
+
+type testMessage struct {
+	topic, key, value string
+}
+
+func (m testMessage) Topic() string              { return m.topic }
+func (m testMessage) Key() pubsub.Encoder        { return pubsub.StringEncoder(m.key) }
+func (m testMessage) Value() pubsub.Encoder      { return pubsub.StringEncoder(m.value) }
+func (m testMessage) Headers() map[string]string { return map[string]string{"h": m.value} }
+func (m testMessage) Timestamp() time.Time       { return time.Time{} }
+
+func receive(t *testing.T, msgs chan pubsub.Message) pubsub.Message {
+	select {
+	case m := <-msgs:
+		return m
+	case <-time.After(time.Second):
+		t.Fatal("timed out waiting for message")
+	}
+	return nil
+}
+
+func TestGroupRebalance(t *testing.T) {
+	b := NewBroker()
+	b.CreateTopic("t", 2)
+
+	s1 := b.Subscriber("g", "t")
+	msgs1 := s1.Start()
+
+	// keys chosen to land in both partitions
+	partitions := make(map[int32]bool)
+	for _, k := range []string{"a", "b", "c", "d", "e"} {
+		p, _, _ := b.Send(testMessage{"t", k, k})
+		partitions[p] = true
+	}
+	if len(partitions) != 2 {
+		t.Fatal("expected messages in both partitions")
+	}
+
+	// the only member consumes both partitions
+	seen := make(map[int32]bool)
+	for i := 0; i < 5; i++ {
+		m := receive(t, msgs1)
+		if m.Headers()["h"] != string(m.Value()) {
+			t.Errorf("unexpected headers: %v", m.Headers())
+		}
+		seen[m.Partition()] = true
+		s1.Commit(m)
+	}
+	if len(seen) != 2 {
+		t.Errorf("expected messages from both partitions, got %v", seen)
+	}
+
+	// a second member takes one partition
+	s2 := b.Subscriber("g", "t")
+	msgs2 := s2.Start()
+
+	p1, _, _ := b.Send(testMessage{"t", "", "x"})
+	p2, _, _ := b.Send(testMessage{"t", "", "y"})
+	if p1 == p2 {
+		t.Fatal("expected messages without keys to be distributed")
+	}
+
+	m1, m2 := receive(t, msgs1), receive(t, msgs2)
+	if m1.Partition() == m2.Partition() {
+		t.Errorf("expected members to consume different partitions")
+	}
+
+	// committed messages aren't redelivered after the member leaves
+	s2.Close()
+	s1.Commit(m1)
+	if m := receive(t, msgs1); m.Offset() != m2.Offset() || m.Partition() != m2.Partition() {
+		t.Errorf("expected uncommitted message to be redelivered, got %d/%d", m.Partition(), m.Offset())
+	}
+	s1.Close()
+
+	if _, ok := <-msgs1; ok {
+		t.Error("expected channel to be closed")
+	}
+}
+
+func TestPauseResumeLag(t *testing.T) {
+	b := NewBroker()
+	b.CreateTopic("t", 2)
+
+	s := b.Subscriber("g", "t")
+	defer s.Close()
+	msgs := s.Start()
+
+	b.Send(testMessage{"t", "", "x"})
+	b.Send(testMessage{"t", "", "y"})
+
+	s.Pause(pubsub.TopicPartition{Topic: "t", Partition: 0})
+	m := receive(t, msgs)
+	if m.Partition() != 1 {
+		t.Errorf("expected message from partition 1, got %d", m.Partition())
+	}
+	select {
+	case m := <-msgs:
+		t.Errorf("expected paused partition not to be consumed, got %d/%d", m.Partition(), m.Offset())
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	lag := s.Lag()
+	if lag[pubsub.TopicPartition{Topic: "t", Partition: 0}] != 1 || lag[pubsub.TopicPartition{Topic: "t", Partition: 1}] != 1 {
+		t.Errorf("unexpected lag: %v", lag)
+	}
+	s.Commit(m)
+	if l := s.Lag()[pubsub.TopicPartition{Topic: "t", Partition: 1}]; l != 0 {
+		t.Errorf("expected no lag after commit, got %d", l)
+	}
+
+	s.Resume()
+	if m := receive(t, msgs); m.Partition() != 0 {
+		t.Errorf("expected message from resumed partition, got %d", m.Partition())
+	}
+}
+
+func TestNewTopicKeepsPositions(t *testing.T) {
+	b := NewBroker()
+	b.CreateTopic("t", 1)
+
+	s := b.Subscriber("g", "t", "retry")
+	defer s.Close()
+	msgs := s.Start()
+
+	other := b.Subscriber("other", "t")
+	defer other.Close()
+	other.Start()
+
+	b.Send(testMessage{"t", "", "x"})
+	b.Send(testMessage{"t", "", "y"})
+
+	// delivered but not committed
+	if m := receive(t, msgs); m.Offset() != 0 {
+		t.Fatalf("expected offset 0, got %d", m.Offset())
+	}
+
+	// creating a topic the group subscribes to doesn't redeliver messages
+	b.Send(testMessage{"retry", "", "z"})
+	// or one it doesn't
+	b.Send(testMessage{"dlq", "", "z"})
+
+	seen := make(map[string]bool)
+	for i := 0; i < 2; i++ {
+		m := receive(t, msgs)
+		if m.Topic() == "t" && m.Offset() != 1 {
+			t.Errorf("expected offset 1, got %d", m.Offset())
+		}
+		seen[m.Topic()] = true
+	}
+	if !seen["t"] || !seen["retry"] {
+		t.Errorf("expected messages from both topics, got %v", seen)
+	}
+
+	select {
+	case m := <-msgs:
+		t.Errorf("unexpected message %s/%d", m.Topic(), m.Offset())
+	case <-time.After(50 * time.Millisecond):
+	}
+}
@@ -0,0 +1,601 @@
+// Package outbox implements a transactional outbox
+//
+// Handlers write messages to an outbox table in the same SQL
+// transaction as their other changes, so messages are only published
+// if the transaction commits. A relay publishes unsent messages in
+// the order they were written, and marks them as sent.
+//
+// Messages are ordered by their ID, which is assigned when they're
+// written rather than when their transaction commits. Messages written
+// by concurrent transactions may be published in a different order to
+// their commits, and a message may be published after messages with
+// later IDs. Messages which must be published in order should be
+// written by the same transaction, or by transactions which can't
+// overlap, for example because they update the same row.
+//
+// Only one relay publishes at a time, using a lease stored in a
+// separate table, so relays can run in multiple instances. No
+// transaction or row lock is held while messages are published.
+//
+// Messages are published at least once: if the process stops after
+// publishing a message but before marking it as sent, it's published
+// again when the relay restarts.
+//
+// For example:
+//
+//	ob := outbox.New(db, outbox.Postgres, p)
+//	ob.Start()
+//	svc.OnShutdown(ob.Shutdown)
+//
+//	// in a handler
+//	tx, err := db.BeginTx(req.Context(), nil)
+//	...
+//	err = ob.Write(req.Context(), tx, msg)
+//	...
+//	err = tx.Commit()
+//	ob.Notify()
+package outbox
+
+import (
+	"context"
+	"crypto/rand"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/ian-kent/service.go/log"
+	"github.com/ian-kent/service.go/metrics"
+	"github.com/ian-kent/service.go/pubsub"
+)
+
+// Metric names
+//
+// The backlog gauges are set by the relay holding the lease, every
+// MetricsInterval, and are zero in other instances.
+var (
+	// BacklogMetricName is the gauge of unsent messages
+	BacklogMetricName = "outbox_backlog"
+	// LagMetricName is the gauge of the age of the oldest unsent
+	// message, in milliseconds
+	LagMetricName = "outbox_lag_ms"
+	// PublishedMetricName is incremented for each published message
+	PublishedMetricName = "outbox_published"
+	// FailedMetricName is incremented for each failed publish
+	FailedMetricName = "outbox_publish_failed"
+)
+
+// Dialect describes the SQL differences between databases
+type Dialect struct {
+	// Placeholder returns the placeholder for the nth query argument,
+	// counting from 1
+	Placeholder func(n int) string
+	// CreateTable are the statements which create the outbox table
+	// and the relay lease table, %[1]s_relay, containing a single row
+	// with an id of 1, with %[1]s replaced by the table name
+	CreateTable []string
+}
+
+// Postgres is the PostgreSQL dialect
+var Postgres = Dialect{
+	Placeholder: func(n int) string { return "$" + strconv.Itoa(n) },
+	CreateTable: []string{
+		`CREATE TABLE IF NOT EXISTS %[1]s (
+			id BIGSERIAL PRIMARY KEY,
+			topic TEXT NOT NULL,
+			msg_key BYTEA,
+			value BYTEA,
+			headers TEXT,
+			created_at BIGINT NOT NULL,
+			sent_at BIGINT
+		)`,
+		`CREATE INDEX IF NOT EXISTS %[1]s_unsent ON %[1]s (id) WHERE sent_at IS NULL`,
+		`CREATE TABLE IF NOT EXISTS %[1]s_relay (
+			id INTEGER PRIMARY KEY,
+			owner TEXT NOT NULL,
+			expires_at BIGINT NOT NULL
+		)`,
+		`INSERT INTO %[1]s_relay (id, owner, expires_at) VALUES (1, '', 0) ON CONFLICT DO NOTHING`,
+	},
+}
+
+// MySQL is the MySQL dialect
+var MySQL = Dialect{
+	Placeholder: func(int) string { return "?" },
+	CreateTable: []string{
+		`CREATE TABLE IF NOT EXISTS %[1]s (
+			id BIGINT AUTO_INCREMENT PRIMARY KEY,
+			topic VARCHAR(255) NOT NULL,
+			msg_key BLOB,
+			value LONGBLOB,
+			headers TEXT,
+			created_at BIGINT NOT NULL,
+			sent_at BIGINT NULL,
+			INDEX %[1]s_unsent (sent_at, id)
+		)`,
+		`CREATE TABLE IF NOT EXISTS %[1]s_relay (
+			id INT PRIMARY KEY,
+			owner VARCHAR(64) NOT NULL,
+			expires_at BIGINT NOT NULL
+		)`,
+		`INSERT IGNORE INTO %[1]s_relay (id, owner, expires_at) VALUES (1, '', 0)`,
+	},
+}
+
+// SQLite is the SQLite dialect
+var SQLite = Dialect{
+	Placeholder: func(int) string { return "?" },
+	CreateTable: []string{
+		`CREATE TABLE IF NOT EXISTS %[1]s (
+			id INTEGER PRIMARY KEY AUTOINCREMENT,
+			topic TEXT NOT NULL,
+			msg_key BLOB,
+			value BLOB,
+			headers TEXT,
+			created_at INTEGER NOT NULL,
+			sent_at INTEGER
+		)`,
+		`CREATE INDEX IF NOT EXISTS %[1]s_unsent ON %[1]s (id) WHERE sent_at IS NULL`,
+		`CREATE TABLE IF NOT EXISTS %[1]s_relay (
+			id INTEGER PRIMARY KEY,
+			owner TEXT NOT NULL,
+			expires_at INTEGER NOT NULL
+		)`,
+		`INSERT OR IGNORE INTO %[1]s_relay (id, owner, expires_at) VALUES (1, '', 0)`,
+	},
+}
+
+// Execer executes a query, and is implemented by *sql.Tx and *sql.DB
+type Execer interface {
+	ExecContext(ctx context.Context, query string, args ...interface{}) (sql.Result, error)
+}
+
+// Outbox writes messages to an outbox table, and relays them to a publisher
+type Outbox struct {
+	DB        *sql.DB
+	Dialect   Dialect
+	Publisher pubsub.Publisher
+
+	// Table is the outbox table name
+	Table string
+	// BatchSize is the maximum number of messages published per batch
+	BatchSize int
+	// PollInterval is how often the relay checks for unsent messages
+	PollInterval time.Duration
+	// MaxBackoff is the maximum time the relay waits after an error
+	MaxBackoff time.Duration
+	// Retention is how long sent messages are kept, or zero to keep
+	// them indefinitely
+	Retention time.Duration
+	// Lease is how long a relay may publish for before another
+	// instance can take over, and should be longer than publishing a
+	// batch takes
+	Lease time.Duration
+	// MetricsInterval is how often the relay holding the lease updates
+	// the backlog metrics, or zero to not update them
+	MetricsInterval time.Duration
+
+	// owner identifies the relay holding the lease
+	owner    string
+	wake     chan struct{}
+	initOnce sync.Once
+	stop     chan struct{}
+	done     chan struct{}
+	cancel   context.CancelFunc
+	once     sync.Once
+}
+
+// New returns an Outbox using the default table and settings
+func New(db *sql.DB, dialect Dialect, publisher pubsub.Publisher) *Outbox {
+	return &Outbox{
+		DB:           db,
+		Dialect:      dialect,
+		Publisher:    publisher,
+		Table:        "outbox",
+		BatchSize:    100,
+		PollInterval: time.Second,
+		MaxBackoff:   time.Minute,
+		Retention:    24 * time.Hour,
+		Lease:        30 * time.Second,
+
+		MetricsInterval: 30 * time.Second,
+	}
+}
+
+// init sets the owner and wake channel, so an Outbox doesn't have to
+// be created using New
+func (o *Outbox) init() {
+	o.initOnce.Do(func() {
+		if len(o.owner) == 0 {
+			o.owner = newOwner()
+		}
+		if o.wake == nil {
+			o.wake = make(chan struct{}, 1)
+		}
+	})
+}
+
+func newOwner() string {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		panic(err)
+	}
+	return hex.EncodeToString(b)
+}
+
+// CreateTable creates the outbox table if it doesn't exist
+func (o *Outbox) CreateTable(ctx context.Context) error {
+	for _, stmt := range o.Dialect.CreateTable {
+		if _, err := o.DB.ExecContext(ctx, fmt.Sprintf(stmt, o.Table)); err != nil {
+			return fmt.Errorf("outbox: error creating table: %s", err)
+		}
+	}
+	return nil
+}
+
+// Write writes messages to the outbox using tx, which should be the
+// transaction making the changes the messages describe
+//
+// The request ID and trace context from ctx are added to the message
+// headers. Messages without a timestamp are given the current time.
+func (o *Outbox) Write(ctx context.Context, tx Execer, msgs ...pubsub.OutgoingMessage) error {
+	query := fmt.Sprintf("INSERT INTO %s (topic, msg_key, value, headers, created_at) VALUES (%s, %s, %s, %s, %s)",
+		o.Table, o.arg(1), o.arg(2), o.arg(3), o.arg(4), o.arg(5))
+
+	for _, msg := range msgs {
+		key, err := encode(msg.Key())
+		if err != nil {
+			return err
+		}
+		value, err := encode(msg.Value())
+		if err != nil {
+			return err
+		}
+
+		var headers []byte
+		if h := pubsub.Inject(ctx, msg.Headers()); len(h) > 0 {
+			if headers, err = json.Marshal(h); err != nil {
+				return err
+			}
+		}
+
+		ts := msg.Timestamp()
+		if ts.IsZero() {
+			ts = time.Now()
+		}
+
+		_, err = tx.ExecContext(ctx, query, msg.Topic(), key, value, string(headers), millis(ts))
+		if err != nil {
+			return fmt.Errorf("outbox: error writing message: %s", err)
+		}
+	}
+
+	return nil
+}
+
+// Notify wakes the relay, so messages written by a committed
+// transaction are published without waiting for the poll interval
+func (o *Outbox) Notify() {
+	o.init()
+	select {
+	case o.wake <- struct{}{}:
+	default:
+	}
+}
+
+// Start starts the relay in a new goroutine
+func (o *Outbox) Start() {
+	o.init()
+	var ctx context.Context
+	ctx, o.cancel = context.WithCancel(context.Background())
+	o.stop = make(chan struct{})
+	o.done = make(chan struct{})
+	go o.run(ctx)
+}
+
+// Shutdown stops the relay after publishing a final batch of unsent
+// messages, and can be registered using Service.OnShutdown
+//
+// Shutdown functions are called in reverse order, so the publisher's
+// shutdown should be registered before the outbox's.
+//
+// If ctx is done first, the current batch is abandoned and its
+// messages are published again when the relay next starts.
+func (o *Outbox) Shutdown(ctx context.Context) error {
+	if o.done == nil {
+		return nil
+	}
+	o.once.Do(func() { close(o.stop) })
+
+	select {
+	case <-o.done:
+		return nil
+	case <-ctx.Done():
+		o.cancel()
+		<-o.done
+		return ctx.Err()
+	}
+}
+
+func (o *Outbox) run(ctx context.Context) {
+	defer close(o.done)
+	defer o.cancel()
+
+	var wait, backoff time.Duration
+	var lastCleanup, lastMetrics time.Time
+	var leader bool
+
+	for {
+		timer := time.NewTimer(wait)
+		select {
+		case <-o.stop:
+			timer.Stop()
+			// publish messages written by the last requests
+			if _, err := o.Relay(ctx); err != nil {
+				log.Error(err, nil)
+			}
+			if err := o.release(ctx); err != nil {
+				log.Error(err, log.Data{"table": o.Table})
+			}
+			return
+		case <-o.wake:
+			timer.Stop()
+		case <-timer.C:
+		}
+
+		n, held, err := o.relay(ctx)
+		switch {
+		case held && o.MetricsInterval > 0 && time.Since(lastMetrics) >= o.MetricsInterval:
+			o.updateMetrics(ctx)
+			lastMetrics = time.Now()
+		case !held && leader:
+			// the relay holding the lease reports the backlog
+			o.resetMetrics()
+			lastMetrics = time.Time{}
+		}
+		leader = held
+
+		switch {
+		case err != nil:
+			log.Error(err, log.Data{"table": o.Table})
+			if backoff == 0 {
+				backoff = o.PollInterval
+			} else {
+				backoff *= 2
+			}
+			if backoff > o.MaxBackoff {
+				backoff = o.MaxBackoff
+			}
+			wait = backoff
+			continue
+		case n == o.BatchSize:
+			// there may be more unsent messages
+			wait = 0
+		default:
+			wait = o.PollInterval
+		}
+		backoff = 0
+
+		if held && o.Retention > 0 && time.Since(lastCleanup) > time.Minute {
+			if err := o.cleanup(ctx); err != nil {
+				log.Error(err, log.Data{"table": o.Table})
+			}
+			lastCleanup = time.Now()
+		}
+	}
+}
+
+// Relay publishes a batch of unsent messages in order, and returns
+// the number published
+//
+// Publishing stops at the first error, so later messages aren't
+// published before earlier ones. Nothing is published if another
+// relay holds the lease. Relay is called by the relay started by
+// Start, and can be called directly, for example in tests.
+func (o *Outbox) Relay(ctx context.Context) (int, error) {
+	n, _, err := o.relay(ctx)
+	return n, err
+}
+
+// relay publishes a batch of unsent messages, and returns whether the
+// relay holds the lease
+func (o *Outbox) relay(ctx context.Context) (n int, held bool, err error) {
+	o.init()
+	ok, err := o.acquire(ctx)
+	if err != nil || !ok {
+		return 0, false, err
+	}
+	// stop publishing before the lease expires
+	deadline := time.Now().Add(o.Lease)
+
+	msgs, err := o.unsent(ctx)
+	if err != nil {
+		return 0, true, err
+	}
+
+	var sent []int64
+	var sendErr error
+	for _, m := range msgs {
+		if time.Now().After(deadline) {
+			break
+		}
+		if _, _, err := o.Publisher.Send(m); err != nil {
+			metrics.Incr(FailedMetricName)
+			sendErr = fmt.Errorf("outbox: error publishing message %d: %s", m.id, err)
+			break
+		}
+		sent = append(sent, m.id)
+	}
+
+	if err := o.markSent(ctx, sent); err != nil {
+		return 0, true, err
+	}
+	metrics.Int(PublishedMetricName).Add(int64(len(sent)))
+
+	return len(sent), true, sendErr
+}
+
+// acquire takes or renews the relay lease, and returns false if
+// another relay holds it
+func (o *Outbox) acquire(ctx context.Context) (bool, error) {
+	now := time.Now()
+	query := fmt.Sprintf("UPDATE %s_relay SET owner = %s, expires_at = %s WHERE id = 1 AND (owner = %s OR expires_at < %s)",
+		o.Table, o.arg(1), o.arg(2), o.arg(3), o.arg(4))
+	res, err := o.DB.ExecContext(ctx, query, o.owner, millis(now.Add(o.Lease)), o.owner, millis(now))
+	if err != nil {
+		return false, fmt.Errorf("outbox: error acquiring relay lease: %s", err)
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return false, fmt.Errorf("outbox: error acquiring relay lease: %s", err)
+	}
+	return n == 1, nil
+}
+
+// release gives up the relay lease, so another relay can take over
+// without waiting for it to expire
+func (o *Outbox) release(ctx context.Context) error {
+	query := fmt.Sprintf("UPDATE %s_relay SET expires_at = 0 WHERE id = 1 AND owner = %s", o.Table, o.arg(1))
+	if _, err := o.DB.ExecContext(ctx, query, o.owner); err != nil {
+		return fmt.Errorf("outbox: error releasing relay lease: %s", err)
+	}
+	return nil
+}
+
+// unsent reads a batch of unsent messages
+func (o *Outbox) unsent(ctx context.Context) ([]message, error) {
+	query := fmt.Sprintf("SELECT id, topic, msg_key, value, headers, created_at FROM %s WHERE sent_at IS NULL ORDER BY id LIMIT %s",
+		o.Table, o.arg(1))
+	rows, err := o.DB.QueryContext(ctx, query, o.BatchSize)
+	if err != nil {
+		return nil, fmt.Errorf("outbox: error reading messages: %s", err)
+	}
+	defer rows.Close()
+
+	var msgs []message
+	for rows.Next() {
+		var m message
+		var headers sql.NullString
+		var created int64
+		if err := rows.Scan(&m.id, &m.topic, &m.key, &m.value, &headers, &created); err != nil {
+			return nil, fmt.Errorf("outbox: error reading messages: %s", err)
+		}
+		if len(headers.String) > 0 {
+			if err := json.Unmarshal([]byte(headers.String), &m.headers); err != nil {
+				return nil, fmt.Errorf("outbox: invalid headers for message %d: %s", m.id, err)
+			}
+		}
+		m.timestamp = time.Unix(0, created*int64(time.Millisecond))
+		msgs = append(msgs, m)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("outbox: error reading messages: %s", err)
+	}
+	return msgs, nil
+}
+
+// markSent marks published messages as sent in a single transaction
+func (o *Outbox) markSent(ctx context.Context, ids []int64) error {
+	if len(ids) == 0 {
+		return nil
+	}
+
+	tx, err := o.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return fmt.Errorf("outbox: error starting transaction: %s", err)
+	}
+	defer tx.Rollback()
+
+	update := fmt.Sprintf("UPDATE %s SET sent_at = %s WHERE id = %s", o.Table, o.arg(1), o.arg(2))
+	now := millis(time.Now())
+	for _, id := range ids {
+		if _, err := tx.ExecContext(ctx, update, now, id); err != nil {
+			return fmt.Errorf("outbox: error marking message %d as sent: %s", id, err)
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("outbox: error committing transaction: %s", err)
+	}
+	return nil
+}
+
+// Backlog returns the number of unsent messages, and the age of the oldest
+func (o *Outbox) Backlog(ctx context.Context) (count int64, lag time.Duration, err error) {
+	var oldest sql.NullInt64
+	query := fmt.Sprintf("SELECT COUNT(*), MIN(created_at) FROM %s WHERE sent_at IS NULL", o.Table)
+	if err := o.DB.QueryRowContext(ctx, query).Scan(&count, &oldest); err != nil {
+		return 0, 0, fmt.Errorf("outbox: error reading backlog: %s", err)
+	}
+	if oldest.Valid {
+		lag = time.Since(time.Unix(0, oldest.Int64*int64(time.Millisecond)))
+	}
+	return count, lag, nil
+}
+
+func (o *Outbox) updateMetrics(ctx context.Context) {
+	count, lag, err := o.Backlog(ctx)
+	if err != nil {
+		log.Error(err, log.Data{"table": o.Table})
+		return
+	}
+	metrics.Set(BacklogMetricName, count)
+	metrics.Set(LagMetricName, int64(lag/time.Millisecond))
+}
+
+// resetMetrics clears the backlog metrics once another relay holds
+// the lease, so the backlog is only reported by one instance
+func (o *Outbox) resetMetrics() {
+	metrics.Set(BacklogMetricName, 0)
+	metrics.Set(LagMetricName, 0)
+}
+
+// cleanup deletes sent messages older than the retention period
+func (o *Outbox) cleanup(ctx context.Context) error {
+	query := fmt.Sprintf("DELETE FROM %s WHERE sent_at IS NOT NULL AND sent_at < %s", o.Table, o.arg(1))
+	if _, err := o.DB.ExecContext(ctx, query, millis(time.Now().Add(-o.Retention))); err != nil {
+		return fmt.Errorf("outbox: error deleting sent messages: %s", err)
+	}
+	return nil
+}
+
+func (o *Outbox) arg(n int) string {
+	return o.Dialect.Placeholder(n)
+}
+
+func encode(e pubsub.Encoder) ([]byte, error) {
+	if e == nil {
+		return nil, nil
+	}
+	return e.Encode()
+}
+
+func millis(t time.Time) int64 {
+	return t.UnixNano() / int64(time.Millisecond)
+}
+
+type message struct {
+	id         int64
+	topic      string
+	key, value []byte
+	headers    map[string]string
+	timestamp  time.Time
+}
+
+func (m message) Topic() string              { return m.topic }
+func (m message) Key() pubsub.Encoder        { return encoder(m.key) }
+func (m message) Value() pubsub.Encoder      { return encoder(m.value) }
+func (m message) Headers() map[string]string { return m.headers }
+func (m message) Timestamp() time.Time       { return m.timestamp }
+
+// encoder returns nil for a nil key or value, so it isn't published
+// as an empty one
+func encoder(b []byte) pubsub.Encoder {
+	if b == nil {
+		return nil
+	}
+	return pubsub.ByteEncoder(b)
+}
@@ -0,0 +1,289 @@
+package outbox
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/ian-kent/service.go/handlers/requestID"
+	"github.com/ian-kent/service.go/metrics"
+	"github.com/ian-kent/service.go/pubsub"
+	_ "github.com/mattn/go-sqlite3"
+)
+
+type testMessage struct {
+	topic, key, value string
+}
+
+func (m testMessage) Topic() string              { return m.topic }
+func (m testMessage) Key() pubsub.Encoder        { return pubsub.StringEncoder(m.key) }
+func (m testMessage) Value() pubsub.Encoder      { return pubsub.StringEncoder(m.value) }
+func (m testMessage) Headers() map[string]string { return nil }
+func (m testMessage) Timestamp() time.Time       { return time.Time{} }
+
+type testPublisher struct {
+	mu     sync.Mutex
+	sent   []pubsub.OutgoingMessage
+	failAt int
+}
+
+func (p *testPublisher) Send(msg pubsub.OutgoingMessage) (int32, int64, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.failAt > 0 && len(p.sent)+1 == p.failAt {
+		p.failAt = 0
+		return 0, 0, errors.New("unavailable")
+	}
+	p.sent = append(p.sent, msg)
+	return 0, int64(len(p.sent) - 1), nil
+}
+
+func (p *testPublisher) values() []string {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	var values []string
+	for _, m := range p.sent {
+		b, _ := m.Value().Encode()
+		values = append(values, string(b))
+	}
+	return values
+}
+
+func newOutbox(t *testing.T, p pubsub.Publisher) *Outbox {
+	db, err := sql.Open("sqlite3", "file:"+t.Name()+"?mode=memory&cache=shared")
+	if err != nil {
+		t.Fatal(err)
+	}
+	db.SetMaxOpenConns(1)
+	t.Cleanup(func() { db.Close() })
+
+	o := New(db, SQLite, p)
+	if err := o.CreateTable(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	return o
+}
+
+func write(t *testing.T, o *Outbox, ctx context.Context, commit bool, values ...string) {
+	tx, err := o.DB.BeginTx(ctx, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, v := range values {
+		if err := o.Write(ctx, tx, testMessage{"events", "key", v}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if commit {
+		err = tx.Commit()
+	} else {
+		err = tx.Rollback()
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func equal(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+func TestRelay(t *testing.T) {
+	p := &testPublisher{failAt: 3}
+	o := newOutbox(t, p)
+	o.BatchSize = 10
+	ctx := context.Background()
+
+	write(t, o, requestID.NewContext(ctx, "abc123"), true, "1", "2", "3", "4")
+	write(t, o, ctx, false, "rolled back")
+
+	if n, _, _ := o.Backlog(ctx); n != 4 {
+		t.Errorf("expected backlog of 4, got %d", n)
+	}
+
+	// publishing stops at the failure, so later messages aren't sent first
+	n, err := o.Relay(ctx)
+	if err == nil || n != 2 {
+		t.Errorf("expected 2 messages and an error, got %d %v", n, err)
+	}
+	if n, _, _ := o.Backlog(ctx); n != 2 {
+		t.Errorf("expected backlog of 2, got %d", n)
+	}
+
+	n, err = o.Relay(ctx)
+	if err != nil || n != 2 {
+		t.Errorf("expected 2 messages, got %d %v", n, err)
+	}
+	if v := p.values(); !equal(v, []string{"1", "2", "3", "4"}) {
+		t.Errorf("unexpected messages: %v", v)
+	}
+
+	msg := p.sent[0]
+	if msg.Topic() != "events" || msg.Headers()[pubsub.RequestIDHeader] != "abc123" || msg.Timestamp().IsZero() {
+		t.Errorf("unexpected message: %s %v %s", msg.Topic(), msg.Headers(), msg.Timestamp())
+	}
+	if k, _ := msg.Key().Encode(); string(k) != "key" {
+		t.Errorf("expected key, got %q", k)
+	}
+
+	if n, lag, _ := o.Backlog(ctx); n != 0 || lag != 0 {
+		t.Errorf("expected empty backlog, got %d %s", n, lag)
+	}
+}
+
+func TestStartShutdown(t *testing.T) {
+	p := &testPublisher{}
+	o := newOutbox(t, p)
+	o.PollInterval = time.Hour
+	o.Start()
+
+	write(t, o, context.Background(), true, "1")
+	o.Notify()
+	for i := 0; i < 100 && len(p.values()) == 0; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if v := p.values(); !equal(v, []string{"1"}) {
+		t.Errorf("expected notified relay to publish, got %v", v)
+	}
+
+	// messages written before shutdown are published
+	write(t, o, context.Background(), true, "2")
+	if err := o.Shutdown(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if v := p.values(); !equal(v, []string{"1", "2"}) {
+		t.Errorf("expected final batch to be published, got %v", v)
+	}
+}
+
+// writingPublisher writes to the database while publishing, which
+// blocks if the relay holds a transaction on the only connection
+type writingPublisher struct {
+	testPublisher
+	t  *testing.T
+	db *sql.DB
+}
+
+func (p *writingPublisher) Send(msg pubsub.OutgoingMessage) (int32, int64, error) {
+	if _, err := p.db.ExecContext(context.Background(), "UPDATE outbox_relay SET owner = owner"); err != nil {
+		p.t.Error(err)
+	}
+	return p.testPublisher.Send(msg)
+}
+
+func TestRelayWithoutTransaction(t *testing.T) {
+	p := &writingPublisher{t: t}
+	o := newOutbox(t, p)
+	p.db = o.DB
+	ctx := context.Background()
+
+	write(t, o, ctx, true, "1", "2")
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		if n, err := o.Relay(ctx); err != nil || n != 2 {
+			t.Errorf("expected 2 messages, got %d %v", n, err)
+		}
+	}()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("expected writes not to be blocked while publishing")
+	}
+}
+
+func TestRelayLease(t *testing.T) {
+	p := &testPublisher{}
+	o := newOutbox(t, p)
+	ctx := context.Background()
+
+	other := New(o.DB, SQLite, p)
+	write(t, o, ctx, true, "1")
+
+	if n, err := o.Relay(ctx); err != nil || n != 1 {
+		t.Fatalf("expected 1 message, got %d %v", n, err)
+	}
+
+	write(t, o, ctx, true, "2")
+	if n, err := other.Relay(ctx); err != nil || n != 0 {
+		t.Errorf("expected other relay to wait for the lease, got %d %v", n, err)
+	}
+
+	if err := o.release(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if n, err := other.Relay(ctx); err != nil || n != 1 {
+		t.Errorf("expected other relay to take over the released lease, got %d %v", n, err)
+	}
+	if v := p.values(); !equal(v, []string{"1", "2"}) {
+		t.Errorf("unexpected messages: %v", v)
+	}
+}
+
+func TestRelayLeaseWithoutNew(t *testing.T) {
+	p := &testPublisher{}
+	o := newOutbox(t, p)
+	ctx := context.Background()
+
+	first := &Outbox{DB: o.DB, Dialect: SQLite, Publisher: p, Table: "outbox", BatchSize: 10, Lease: time.Minute}
+	second := &Outbox{DB: o.DB, Dialect: SQLite, Publisher: p, Table: "outbox", BatchSize: 10, Lease: time.Minute}
+	write(t, o, ctx, true, "1")
+
+	if n, err := first.Relay(ctx); err != nil || n != 1 {
+		t.Fatalf("expected 1 message, got %d %v", n, err)
+	}
+
+	write(t, o, ctx, true, "2")
+	if n, err := second.Relay(ctx); err != nil || n != 0 {
+		t.Errorf("expected relays created without New not to share the lease, got %d %v", n, err)
+	}
+	// notifying before starting doesn't block
+	second.Notify()
+}
+
+func TestMetricsLeaseHolder(t *testing.T) {
+	p := &testPublisher{}
+	o := newOutbox(t, p)
+	ctx := context.Background()
+	write(t, o, ctx, true, "1", "2")
+
+	// another relay holds the lease, so the backlog isn't reported
+	other := New(o.DB, SQLite, &testPublisher{failAt: 1})
+	if _, err := other.Relay(ctx); err == nil {
+		t.Fatal("expected publish error")
+	}
+
+	metrics.Set(BacklogMetricName, -1)
+	o.PollInterval = 10 * time.Millisecond
+	o.MetricsInterval = 10 * time.Millisecond
+	o.Start()
+	time.Sleep(50 * time.Millisecond)
+	if v := metrics.Int(BacklogMetricName).Value(); v != -1 {
+		t.Errorf("expected relay without the lease not to report the backlog, got %d", v)
+	}
+
+	if err := other.release(ctx); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 100 && len(p.values()) < 2; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if err := o.Shutdown(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if v := metrics.Int(BacklogMetricName).Value(); v != 0 {
+		t.Errorf("expected lease holder to report an empty backlog, got %d", v)
+	}
+}
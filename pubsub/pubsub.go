@@ -0,0 +1,95 @@
+// Package pubsub defines broker-agnostic interfaces for publishing
+// and consuming messages
+//
+// The consumer and producer packages implement the interfaces using
+// Kafka, and the memory package implements them with an in-process
+// broker for development and tests.
+package pubsub
+
+import (
+	"strconv"
+	"time"
+)
+
+// Encoder encodes a message key or value
+type Encoder interface {
+	Encode() ([]byte, error)
+	Length() int
+}
+
+// StringEncoder encodes a string
+type StringEncoder string
+
+// Encode implements Encoder.Encode
+func (s StringEncoder) Encode() ([]byte, error) { return []byte(s), nil }
+
+// Length implements Encoder.Length
+func (s StringEncoder) Length() int { return len(s) }
+
+// ByteEncoder encodes a byte slice
+type ByteEncoder []byte
+
+// Encode implements Encoder.Encode
+func (b ByteEncoder) Encode() ([]byte, error) { return b, nil }
+
+// Length implements Encoder.Length
+func (b ByteEncoder) Length() int { return len(b) }
+
+// OutgoingMessage is a message to publish
+type OutgoingMessage interface {
+	Topic() string
+	Key() Encoder
+	Value() Encoder
+	Headers() map[string]string
+	// Timestamp is the time of the message, or the zero time to use
+	// the time it's published
+	Timestamp() time.Time
+}
+
+// Message is a consumed message
+type Message interface {
+	Topic() string
+	Key() []byte
+	Value() []byte
+	Partition() int32
+	Offset() int64
+	Headers() map[string]string
+	Timestamp() time.Time
+}
+
+// TopicPartition identifies a partition of a topic
+type TopicPartition struct {
+	Topic     string
+	Partition int32
+}
+
+func (tp TopicPartition) String() string {
+	return tp.Topic + "/" + strconv.Itoa(int(tp.Partition))
+}
+
+// Publisher publishes messages
+type Publisher interface {
+	Send(OutgoingMessage) (partition int32, offset int64, err error)
+}
+
+// Subscriber consumes messages as a member of a consumer group
+type Subscriber interface {
+	// Start joins the consumer group and returns the consumed messages
+	Start() chan Message
+	// Commit commits the offset of the message, and all earlier
+	// messages in the same partition
+	Commit(to Message) error
+	// Close leaves the consumer group
+	Close() error
+	// Pause stops consuming messages from the partitions, or from all
+	// assigned partitions if none are given
+	//
+	// Messages which have already been fetched may still be delivered.
+	Pause(partitions ...TopicPartition)
+	// Resume resumes consuming messages from the partitions, or from
+	// all paused partitions if none are given
+	Resume(partitions ...TopicPartition)
+	// Lag returns the number of messages after the committed offset
+	// in each assigned partition
+	Lag() map[TopicPartition]int64
+}
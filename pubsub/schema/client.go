@@ -0,0 +1,160 @@
+package schema
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/ian-kent/service.go/pubsub/codec"
+)
+
+// ContentType is the content type used by the registry API
+const ContentType = "application/vnd.schemaregistry.v1+json"
+
+// Client is a Registry using a schema registry HTTP API
+//
+// Registered IDs and schemas are cached, since they never change.
+type Client struct {
+	// URL is the registry base URL
+	URL string
+	// Username and Password are used for basic authentication, if set
+	Username string
+	Password string
+	// Client is the HTTP client used to call the registry
+	Client *http.Client
+
+	mu      sync.Mutex
+	ids     map[string]int
+	schemas map[int]Schema
+}
+
+var _ Registry = &Client{}
+
+// NewClient returns a Client for the registry URL
+func NewClient(registryURL string) *Client {
+	return &Client{
+		URL:     strings.TrimSuffix(registryURL, "/"),
+		Client:  &http.Client{Timeout: 10 * time.Second},
+		ids:     make(map[string]int),
+		schemas: make(map[int]Schema),
+	}
+}
+
+// Register implements Registry.Register
+func (c *Client) Register(subject, typ, definition string) (int, error) {
+	key := subject + "\x00" + typ + "\x00" + definition
+
+	c.mu.Lock()
+	id, ok := c.ids[key]
+	c.mu.Unlock()
+	if ok {
+		return id, nil
+	}
+
+	req := struct {
+		Schema     string `json:"schema"`
+		SchemaType string `json:"schemaType,omitempty"`
+	}{Schema: definition}
+	// the type is omitted for Avro, for older registries
+	if typ != codec.SchemaAvro {
+		req.SchemaType = typ
+	}
+
+	var res struct {
+		ID int `json:"id"`
+	}
+	if err := c.do("POST", "/subjects/"+url.PathEscape(subject)+"/versions", req, &res); err != nil {
+		return 0, err
+	}
+
+	c.mu.Lock()
+	c.ids[key] = res.ID
+	c.mu.Unlock()
+
+	return res.ID, nil
+}
+
+// Schema implements Registry.Schema
+func (c *Client) Schema(id int) (Schema, error) {
+	c.mu.Lock()
+	s, ok := c.schemas[id]
+	c.mu.Unlock()
+	if ok {
+		return s, nil
+	}
+
+	if err := c.do("GET", "/schemas/ids/"+strconv.Itoa(id), nil, &s); err != nil {
+		return Schema{}, err
+	}
+	s.ID = id
+	if len(s.Type) == 0 {
+		s.Type = codec.SchemaAvro
+	}
+
+	c.mu.Lock()
+	c.schemas[id] = s
+	c.mu.Unlock()
+
+	return s, nil
+}
+
+func (c *Client) do(method, path string, body, dest interface{}) error {
+	var rdr io.Reader
+	if body != nil {
+		b, err := json.Marshal(body)
+		if err != nil {
+			return err
+		}
+		rdr = bytes.NewReader(b)
+	}
+
+	req, err := http.NewRequest(method, c.URL+path, rdr)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Accept", ContentType)
+	if body != nil {
+		req.Header.Set("Content-Type", ContentType)
+	}
+	if len(c.Username) > 0 || len(c.Password) > 0 {
+		req.SetBasicAuth(c.Username, c.Password)
+	}
+
+	res, err := c.Client.Do(req)
+	if err != nil {
+		return fmt.Errorf("schema: error calling registry: %s", err)
+	}
+	defer res.Body.Close()
+
+	b, err := ioutil.ReadAll(res.Body)
+	if err != nil {
+		return fmt.Errorf("schema: error reading registry response: %s", err)
+	}
+
+	if res.StatusCode == http.StatusNotFound {
+		return ErrNotFound
+	}
+	if res.StatusCode < 200 || res.StatusCode > 299 {
+		var e struct {
+			Code    int    `json:"error_code"`
+			Message string `json:"message"`
+		}
+		if json.Unmarshal(b, &e) == nil && len(e.Message) > 0 {
+			return fmt.Errorf("schema: registry error %d: %s", e.Code, e.Message)
+		}
+		return fmt.Errorf("schema: unexpected registry response: %s", res.Status)
+	}
+
+	if err := json.Unmarshal(b, dest); err != nil {
+		return fmt.Errorf("schema: invalid registry response: %s", err)
+	}
+	return nil
+}
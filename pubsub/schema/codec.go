@@ -0,0 +1,99 @@
+package schema
+
+import (
+	"fmt"
+	"sync"
+
+	"github.com/ian-kent/service.go/pubsub/codec"
+)
+
+type registryCodec struct {
+	codec    codec.SchemaCodec
+	registry Registry
+	subject  string
+
+	mu      sync.Mutex
+	id      int
+	readers map[int]codec.Codec
+}
+
+// NewCodec returns a codec which registers the schema of c under the
+// subject, and embeds the schema ID in the encoded data
+//
+// The schema is registered when the first value is encoded. Decoding
+// looks up the schema by the embedded ID, so data written with other
+// versions of the schema can be read.
+func NewCodec(c codec.SchemaCodec, r Registry, subject string) codec.Codec {
+	return &registryCodec{
+		codec:    c,
+		registry: r,
+		subject:  subject,
+		readers:  make(map[int]codec.Codec),
+	}
+}
+
+func (rc *registryCodec) ContentType() string {
+	return rc.codec.ContentType()
+}
+
+func (rc *registryCodec) Marshal(v interface{}) ([]byte, error) {
+	typ, definition := rc.codec.Schema()
+
+	rc.mu.Lock()
+	if rc.id == 0 {
+		id, err := rc.registry.Register(rc.subject, typ, definition)
+		if err != nil {
+			rc.mu.Unlock()
+			return nil, err
+		}
+		rc.id = id
+	}
+	id := rc.id
+	rc.mu.Unlock()
+
+	b, err := rc.codec.Marshal(v)
+	if err != nil {
+		return nil, err
+	}
+	return Encode(id, typ, b), nil
+}
+
+func (rc *registryCodec) Unmarshal(data []byte, v interface{}) error {
+	typ, _ := rc.codec.Schema()
+
+	id, payload, err := Decode(typ, data)
+	if err != nil {
+		return err
+	}
+
+	c, err := rc.reader(id, typ)
+	if err != nil {
+		return err
+	}
+	return c.Unmarshal(payload, v)
+}
+
+// reader returns a codec which decodes data written with the schema
+func (rc *registryCodec) reader(id int, typ string) (codec.Codec, error) {
+	rc.mu.Lock()
+	defer rc.mu.Unlock()
+
+	if c, ok := rc.readers[id]; ok {
+		return c, nil
+	}
+
+	s, err := rc.registry.Schema(id)
+	if err != nil {
+		return nil, err
+	}
+	if s.Type != typ {
+		return nil, fmt.Errorf("schema: schema %d is %s, not %s", id, s.Type, typ)
+	}
+
+	c, err := rc.codec.WithSchema(s.Definition)
+	if err != nil {
+		return nil, err
+	}
+	rc.readers[id] = c
+	return c, nil
+}
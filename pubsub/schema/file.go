@@ -0,0 +1,129 @@
+package schema
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+// FileRegistry is a Registry which stores schemas in a local JSON file
+//
+// It's intended for development and tests, and isn't safe for use by
+// multiple processes.
+type FileRegistry struct {
+	path string
+
+	mu      sync.Mutex
+	schemas []Schema
+}
+
+var _ Registry = &FileRegistry{}
+
+// OpenFile returns a FileRegistry using the file at path, which is
+// created when the first schema is registered if it doesn't exist
+func OpenFile(path string) (*FileRegistry, error) {
+	r := &FileRegistry{path: path}
+
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return r, nil
+		}
+		return nil, err
+	}
+	if err := json.Unmarshal(b, &r.schemas); err != nil {
+		return nil, err
+	}
+
+	return r, nil
+}
+
+// Register implements Registry.Register
+//
+// Like a registry server, an identical schema registered under a
+// different subject is given the same ID. Compatibility between
+// versions isn't checked.
+func (r *FileRegistry) Register(subject, typ, definition string) (int, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	var id, version, maxID int
+	for _, s := range r.schemas {
+		if s.Type == typ && s.Definition == definition {
+			if s.Subject == subject {
+				return s.ID, nil
+			}
+			id = s.ID
+		}
+		if s.Subject == subject && s.Version > version {
+			version = s.Version
+		}
+		if s.ID > maxID {
+			maxID = s.ID
+		}
+	}
+	if id == 0 {
+		id = maxID + 1
+	}
+
+	schemas := append(r.schemas, Schema{
+		ID:         id,
+		Subject:    subject,
+		Version:    version + 1,
+		Type:       typ,
+		Definition: definition,
+	})
+	if err := r.save(schemas); err != nil {
+		return 0, err
+	}
+	r.schemas = schemas
+
+	return id, nil
+}
+
+// Schema implements Registry.Schema
+func (r *FileRegistry) Schema(id int) (Schema, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	for _, s := range r.schemas {
+		if s.ID == id {
+			return s, nil
+		}
+	}
+	return Schema{}, ErrNotFound
+}
+
+// Schemas returns the registered schemas, in the order they were registered
+func (r *FileRegistry) Schemas() []Schema {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return append([]Schema{}, r.schemas...)
+}
+
+// save writes the schemas to a temporary file, then renames it
+// so the file is never partially written
+func (r *FileRegistry) save(schemas []Schema) error {
+	b, err := json.MarshalIndent(schemas, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	f, err := ioutil.TempFile(filepath.Dir(r.path), filepath.Base(r.path)+".tmp")
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(b); err != nil {
+		f.Close()
+		os.Remove(f.Name())
+		return err
+	}
+	if err := f.Close(); err != nil {
+		os.Remove(f.Name())
+		return err
+	}
+
+	return os.Rename(f.Name(), r.path)
+}
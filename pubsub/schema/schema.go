@@ -0,0 +1,102 @@
+// Package schema registers message schemas and embeds schema IDs
+// in encoded messages
+//
+// The wire format and HTTP API are compatible with the Confluent
+// schema registry. Client uses a registry over HTTP, and FileRegistry
+// stores schemas in a local file for development and tests.
+package schema
+
+import (
+	"encoding/binary"
+	"errors"
+
+	"github.com/ian-kent/service.go/pubsub/codec"
+)
+
+// Schema is a registered schema
+type Schema struct {
+	ID         int    `json:"id"`
+	Subject    string `json:"subject,omitempty"`
+	Version    int    `json:"version,omitempty"`
+	Type       string `json:"schemaType"`
+	Definition string `json:"schema"`
+}
+
+// Registry registers and looks up schemas
+type Registry interface {
+	// Register registers a schema under the subject and returns its
+	// ID, or the ID of an identical schema if it's already registered
+	Register(subject, typ, definition string) (id int, err error)
+	// Schema returns the schema with the ID, or ErrNotFound
+	Schema(id int) (Schema, error)
+}
+
+// ErrNotFound is returned if a schema isn't registered
+var ErrNotFound = errors.New("schema: not found")
+
+// ErrInvalidWireFormat is returned when decoding data which doesn't
+// start with a schema ID
+var ErrInvalidWireFormat = errors.New("schema: invalid wire format")
+
+var errUnsupportedMessageType = errors.New("schema: only the first protobuf message type is supported")
+
+// MagicByte is the first byte of encoded data
+const MagicByte byte = 0
+
+// TopicSubject returns the subject for a topic's keys or values,
+// using the registry's default topic name strategy
+func TopicSubject(topic string, key bool) string {
+	if key {
+		return topic + "-key"
+	}
+	return topic + "-value"
+}
+
+// Encode prefixes the payload with the schema ID
+//
+// Protocol buffers payloads are also prefixed with the index of the
+// message type in the schema, which is always the first message.
+func Encode(id int, typ string, payload []byte) []byte {
+	b := make([]byte, 5, 6+len(payload))
+	b[0] = MagicByte
+	binary.BigEndian.PutUint32(b[1:], uint32(id))
+	if typ == codec.SchemaProtobuf {
+		// an empty list of indexes is shorthand for [0]
+		b = append(b, 0)
+	}
+	return append(b, payload...)
+}
+
+// Decode returns the schema ID and payload from encoded data
+func Decode(typ string, data []byte) (id int, payload []byte, err error) {
+	if len(data) < 5 || data[0] != MagicByte {
+		return 0, nil, ErrInvalidWireFormat
+	}
+	id = int(binary.BigEndian.Uint32(data[1:5]))
+	payload = data[5:]
+
+	if typ == codec.SchemaProtobuf {
+		n, l := binary.Varint(payload)
+		if l <= 0 || n < 0 {
+			return 0, nil, ErrInvalidWireFormat
+		}
+		payload = payload[l:]
+		// only the first message type is supported, which is
+		// encoded as [] or [0]
+		if n > 1 {
+			return 0, nil, errUnsupportedMessageType
+		}
+		if n == 1 {
+			idx, l := binary.Varint(payload)
+			if l <= 0 {
+				return 0, nil, ErrInvalidWireFormat
+			}
+			if idx != 0 {
+				return 0, nil, errUnsupportedMessageType
+			}
+			payload = payload[l:]
+		}
+	}
+
+	return id, payload, nil
+}
@@ -0,0 +1,187 @@
+package schema
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+
+	"github.com/ian-kent/service.go/pubsub/codec"
+)
+
+type user struct {
+	Name string `avro:"name"`
+	Age  int    `avro:"age"`
+}
+
+const userV1 = `{"type":"record","name":"User","fields":[{"name":"name","type":"string"}]}`
+const userV2 = `{"type":"record","name":"User","fields":[{"name":"name","type":"string"},{"name":"age","type":"int","default":18}]}`
+
+func TestWireFormat(t *testing.T) {
+	b := Encode(258, codec.SchemaAvro, []byte("data"))
+	if !bytes.Equal(b, []byte{0, 0, 0, 1, 2, 'd', 'a', 't', 'a'}) {
+		t.Errorf("unexpected encoding: %v", b)
+	}
+	id, payload, err := Decode(codec.SchemaAvro, b)
+	if err != nil || id != 258 || string(payload) != "data" {
+		t.Errorf("unexpected decoding: %d %q %v", id, payload, err)
+	}
+
+	b = Encode(1, codec.SchemaProtobuf, []byte("data"))
+	if !bytes.Equal(b[5:], []byte{0, 'd', 'a', 't', 'a'}) {
+		t.Errorf("expected empty message indexes, got %v", b)
+	}
+	// [0] written as a list of one index
+	_, payload, err = Decode(codec.SchemaProtobuf, []byte{0, 0, 0, 0, 1, 2, 0, 'x'})
+	if err != nil || string(payload) != "x" {
+		t.Errorf("unexpected decoding: %q %v", payload, err)
+	}
+	if _, _, err = Decode(codec.SchemaProtobuf, []byte{0, 0, 0, 0, 1, 2, 2, 'x'}); err == nil {
+		t.Error("expected error for second message type")
+	}
+
+	if _, _, err := Decode(codec.SchemaAvro, []byte{1, 0, 0, 0, 1}); err != ErrInvalidWireFormat {
+		t.Errorf("expected ErrInvalidWireFormat, got %v", err)
+	}
+	if _, _, err := Decode(codec.SchemaAvro, []byte{0, 0}); err != ErrInvalidWireFormat {
+		t.Errorf("expected ErrInvalidWireFormat, got %v", err)
+	}
+}
+
+func TestFileRegistry(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "schemas.json")
+
+	r, err := OpenFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	id1, err := r.Register("users-value", codec.SchemaAvro, userV1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	id2, _ := r.Register("users-value", codec.SchemaAvro, userV2)
+	again, _ := r.Register("users-value", codec.SchemaAvro, userV1)
+	other, _ := r.Register("other-value", codec.SchemaAvro, userV1)
+	if id1 != 1 || id2 != 2 || again != 1 || other != 1 {
+		t.Errorf("unexpected IDs: %d %d %d %d", id1, id2, again, other)
+	}
+
+	r, err = OpenFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s, err := r.Schema(2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s.Subject != "users-value" || s.Version != 2 || s.Definition != userV2 {
+		t.Errorf("unexpected schema: %+v", s)
+	}
+	if _, err := r.Schema(3); err != ErrNotFound {
+		t.Errorf("expected ErrNotFound, got %v", err)
+	}
+	if n := len(r.Schemas()); n != 3 {
+		t.Errorf("expected 3 schemas, got %d", n)
+	}
+}
+
+func TestClient(t *testing.T) {
+	var registered int
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.Header().Set("Content-Type", ContentType)
+		switch {
+		case req.Method == "POST" && req.URL.Path == "/subjects/users-value/versions":
+			if u, p, _ := req.BasicAuth(); u != "user" || p != "pass" {
+				w.WriteHeader(http.StatusUnauthorized)
+				w.Write([]byte(`{"error_code":401,"message":"unauthorized"}`))
+				return
+			}
+			registered++
+			b, _ := ioutil.ReadAll(req.Body)
+			var body map[string]string
+			json.Unmarshal(b, &body)
+			if body["schema"] != userV1 || len(body["schemaType"]) > 0 {
+				t.Errorf("unexpected body: %s", b)
+			}
+			w.Write([]byte(`{"id":7}`))
+		case req.URL.Path == "/schemas/ids/7":
+			json.NewEncoder(w).Encode(map[string]string{"schema": userV1})
+		default:
+			w.WriteHeader(http.StatusNotFound)
+			w.Write([]byte(`{"error_code":40403,"message":"Schema not found"}`))
+		}
+	}))
+	defer srv.Close()
+
+	c := NewClient(srv.URL + "/")
+	if _, err := c.Register("users-value", codec.SchemaAvro, userV1); err == nil || err.Error() != "schema: registry error 401: unauthorized" {
+		t.Errorf("expected unauthorized error, got %v", err)
+	}
+
+	c.Username, c.Password = "user", "pass"
+	for i := 0; i < 2; i++ {
+		id, err := c.Register("users-value", codec.SchemaAvro, userV1)
+		if err != nil || id != 7 {
+			t.Errorf("unexpected result: %d %v", id, err)
+		}
+	}
+	if registered != 1 {
+		t.Errorf("expected registered ID to be cached, registered %d times", registered)
+	}
+
+	s, err := c.Schema(7)
+	if err != nil || s.ID != 7 || s.Type != codec.SchemaAvro || s.Definition != userV1 {
+		t.Errorf("unexpected schema: %+v %v", s, err)
+	}
+	if _, err := c.Schema(8); err != ErrNotFound {
+		t.Errorf("expected ErrNotFound, got %v", err)
+	}
+}
+
+func TestCodec(t *testing.T) {
+	r, err := OpenFile(filepath.Join(t.TempDir(), "schemas.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	v1, _ := codec.NewAvro(userV1)
+	v2, _ := codec.NewAvro(userV2)
+	c1 := NewCodec(v1, r, TopicSubject("users", false))
+	c2 := NewCodec(v2, r, TopicSubject("users", false))
+
+	b, err := c1.Marshal(user{Name: "alice"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if id, _, _ := Decode(codec.SchemaAvro, b); id != 1 {
+		t.Errorf("expected schema ID 1, got %d", id)
+	}
+
+	var u user
+	if err := c2.Unmarshal(b, &u); err != nil {
+		t.Fatal(err)
+	}
+	if u != (user{"alice", 18}) {
+		t.Errorf("unexpected value: %+v", u)
+	}
+
+	b, _ = c2.Marshal(user{"bob", 30})
+	u = user{}
+	if err := c2.Unmarshal(b, &u); err != nil {
+		t.Fatal(err)
+	}
+	if u != (user{"bob", 30}) {
+		t.Errorf("unexpected value: %+v", u)
+	}
+
+	if err := c2.Unmarshal(Encode(9, codec.SchemaAvro, nil), &u); err != ErrNotFound {
+		t.Errorf("expected ErrNotFound, got %v", err)
+	}
+	if err := NewCodec(codec.JSONSchema(`{}`), r, "json").Unmarshal(b, &u); err == nil {
+		t.Error("expected schema type mismatch error")
+	}
+}
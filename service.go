@@ -1,36 +1,85 @@
 package service
 
 import (
+	"context"
 	"net/http"
 	"os"
+	"os/signal"
+	"syscall"
 
+	"github.com/ian-kent/service.go/handlers/accesslog"
+	"github.com/ian-kent/service.go/handlers/bodylimit"
+	"github.com/ian-kent/service.go/handlers/proxy"
+	"github.com/ian-kent/service.go/handlers/recovery"
 	"github.com/ian-kent/service.go/handlers/requestID"
 	"github.com/ian-kent/service.go/handlers/timeout"
+	"github.com/ian-kent/service.go/handlers/trace"
 	"github.com/ian-kent/service.go/log"
 
 	"github.com/gorilla/pat"
 	"github.com/justinas/alice"
 )
 
-// DefaultMiddleware is the default middleware used to create a service
-var DefaultMiddleware = []alice.Constructor{
-	requestID.Handler(20),
-	log.Handler,
-	timeout.DefaultHandler,
+// DefaultMiddleware returns the default middleware used to create a service
+//
+// Each service configures its own middleware, starting from the
+// package DefaultConfig of each middleware and overriding it with the
+// HTTPConfig, so services in the same process don't share settings.
+var DefaultMiddleware = func(config HTTPConfig, router *pat.Router) []alice.Constructor {
+	proxyConfig := proxy.DefaultConfig
+	proxyConfig.Trusted = proxy.ParseCIDRs(config.TrustedProxies())
+
+	accessConfig := accesslog.DefaultConfig
+	format, err := accesslog.ParseFormat(config.AccessLog())
+	if err != nil {
+		log.Error(err, nil)
+	}
+	accessConfig.Format = format
+	accessConfig.Router = router
+
+	timeoutConfig := timeout.DefaultConfig
+	timeoutConfig.Timeout = config.Timeout()
+	timeoutConfig.Routes = config.RouteTimeouts()
+
+	bodyConfig := bodylimit.DefaultConfig
+	bodyConfig.MaxSize = config.MaxBodySize()
+	bodyConfig.Routes = config.RouteMaxBodySizes()
+
+	return []alice.Constructor{
+		requestID.Handler(20),
+		trace.Handler,
+		proxy.Handler(proxyConfig),
+		log.Handler,
+		accesslog.Handler(accessConfig),
+		recovery.DefaultHandler,
+		func(h http.Handler) http.Handler {
+			return timeout.ConfigHandler(h, timeoutConfig, timeout.DefaultFailureHandler)
+		},
+		bodylimit.Handler(bodyConfig, bodylimit.DefaultFailureHandler),
+	}
 }
 
 // Service represents a service
 type Service interface {
 	Chain(handler ...alice.Constructor)
+	// Start starts the service, returning once it has been shut down
+	// by SIGINT or SIGTERM
 	Start()
 	Router() *pat.Router
+	// OnShutdown registers a function called when the service shuts
+	// down, after in-flight requests have completed
+	//
+	// Functions are called in reverse order of registration, and the
+	// context is cancelled once the shutdown timeout has passed.
+	OnShutdown(f func(ctx context.Context) error)
 }
 
 type service struct {
-	config HTTPConfig
-	router *pat.Router
-	chain  []alice.Constructor
-	alice  *alice.Chain
+	config   HTTPConfig
+	router   *pat.Router
+	chain    []alice.Constructor
+	alice    *alice.Chain
+	shutdown []func(ctx context.Context) error
 }
 
 // Web returns a new web service using the provided config
@@ -61,28 +110,67 @@ func (s *service) Start() {
 	bindAddr := s.config.BindAddr()
 	certFile, keyFile := s.config.CertFile(), s.config.KeyFile()
 
-	if len(certFile) > 0 && len(keyFile) > 0 {
-		log.Debug("listening tls", log.Data{"addr": bindAddr, "cert": certFile, "key": keyFile})
-		err := http.ListenAndServeTLS(bindAddr, certFile, keyFile, chain)
-		if err != nil {
-			log.Error(err, nil)
-			os.Exit(1)
-		}
-		return
+	server := &http.Server{
+		Addr:              bindAddr,
+		Handler:           chain,
+		ReadTimeout:       s.config.ReadTimeout(),
+		ReadHeaderTimeout: s.config.ReadHeaderTimeout(),
+		WriteTimeout:      s.config.WriteTimeout(),
+		IdleTimeout:       s.config.IdleTimeout(),
+		MaxHeaderBytes:    s.config.MaxHeaderBytes(),
 	}
 
-	log.Debug("listening", log.Data{"addr": bindAddr})
-	err := http.ListenAndServe(bindAddr, chain)
-	if err != nil {
+	errs := make(chan error, 1)
+	go func() {
+		if len(certFile) > 0 && len(keyFile) > 0 {
+			log.Debug("listening tls", log.Data{"addr": bindAddr, "cert": certFile, "key": keyFile})
+			errs <- server.ListenAndServeTLS(certFile, keyFile)
+			return
+		}
+
+		log.Debug("listening", log.Data{"addr": bindAddr})
+		errs <- server.ListenAndServe()
+	}()
+
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+	defer signal.Stop(signals)
+
+	select {
+	case err := <-errs:
 		log.Error(err, nil)
 		os.Exit(1)
+	case sig := <-signals:
+		log.Debug("shutting down", log.Data{"signal": sig.String()})
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), s.config.ShutdownTimeout())
+	defer cancel()
+
+	if err := server.Shutdown(ctx); err != nil {
+		log.Error(err, nil)
+	}
+
+	s.runShutdown(ctx)
+
+	log.Debug("shut down", nil)
+}
+
+// runShutdown calls the OnShutdown functions in reverse order of registration
+func (s *service) runShutdown(ctx context.Context) {
+	for i := len(s.shutdown) - 1; i >= 0; i-- {
+		if err := s.shutdown[i](ctx); err != nil {
+			log.Error(err, nil)
+		}
 	}
 }
 
+func (s *service) OnShutdown(f func(ctx context.Context) error) {
+	s.shutdown = append(s.shutdown, f)
+}
+
 func (s *service) middleware() []alice.Constructor {
-	middleware := append([]alice.Constructor{}, DefaultMiddleware...)
-	middleware = append(middleware, s.chain...)
-	return middleware
+	return append(DefaultMiddleware(s.config, s.router), s.chain...)
 }
 
 func (s *service) Chain(handler ...alice.Constructor) {
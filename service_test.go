@@ -0,0 +1,62 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/ian-kent/service.go/handlers/bodylimit"
+	"github.com/justinas/alice"
+)
+
+func TestOnShutdown(t *testing.T) {
+	s := &service{}
+
+	var order []int
+	for i := 1; i <= 3; i++ {
+		i := i
+		s.OnShutdown(func(ctx context.Context) error {
+			order = append(order, i)
+			if i == 2 {
+				// errors are logged and don't stop later functions
+				return errors.New("failed")
+			}
+			return nil
+		})
+	}
+
+	s.runShutdown(context.Background())
+
+	if len(order) != 3 || order[0] != 3 || order[1] != 2 || order[2] != 1 {
+		t.Errorf("expected functions to be called in reverse order, got %v", order)
+	}
+}
+
+type testConfig struct{ DefaultAPIConfig }
+
+func (testConfig) Namespace() string { return "test" }
+
+func TestMiddlewarePerService(t *testing.T) {
+	small, large := testConfig{}, testConfig{}
+	small.defaultHTTPConfig.MaxBodySize = "1KB"
+	large.defaultHTTPConfig.MaxBodySize = "1MB"
+
+	limit := func(s Service) int64 {
+		var max int64
+		h := alice.New(s.(*service).middleware()...).ThenFunc(func(w http.ResponseWriter, req *http.Request) {
+			max, _ = bodylimit.FromContext(req.Context())
+		})
+		h.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("POST", "/", nil))
+		return max
+	}
+
+	s1, s2 := API(small), API(large)
+	if l := limit(s1); l != 1<<10 {
+		t.Errorf("expected first service limit of 1KB, got %d", l)
+	}
+	if l := limit(s2); l != 1<<20 {
+		t.Errorf("expected second service limit of 1MB, got %d", l)
+	}
+}
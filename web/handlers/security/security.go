@@ -0,0 +1,226 @@
+// Package security implements a middleware which sets browser security headers
+package security
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/pat"
+	"github.com/ian-kent/service.go/handlers/proxy"
+	"github.com/ian-kent/service.go/log"
+)
+
+// NoncePlaceholder is replaced with the request nonce in the
+// Content-Security-Policy, e.g. "script-src 'self' {nonce}"
+const NoncePlaceholder = "{nonce}"
+
+// Config is the security headers configuration
+type Config struct {
+	// HSTSMaxAge is the Strict-Transport-Security max-age, zero to disable
+	HSTSMaxAge            time.Duration
+	HSTSIncludeSubdomains bool
+	HSTSPreload           bool
+
+	// ContentSecurityPolicy is the Content-Security-Policy, empty to disable
+	ContentSecurityPolicy string
+	// ReportOnly sends the policy as Content-Security-Policy-Report-Only
+	ReportOnly bool
+	// ReportURI is added to the policy as the report-uri directive
+	ReportURI string
+
+	// FrameOptions is the X-Frame-Options header, e.g. "DENY"
+	FrameOptions string
+	// ReferrerPolicy is the Referrer-Policy header
+	ReferrerPolicy string
+	// PermissionsPolicy is the Permissions-Policy header
+	PermissionsPolicy string
+	// NoSniff sets X-Content-Type-Options: nosniff
+	NoSniff bool
+}
+
+// DefaultConfig is the configuration used by DefaultHandler
+var DefaultConfig = Config{
+	HSTSMaxAge:            365 * 24 * time.Hour,
+	HSTSIncludeSubdomains: true,
+	ContentSecurityPolicy: "default-src 'self'; script-src 'self' " + NoncePlaceholder +
+		"; style-src 'self' " + NoncePlaceholder + "; object-src 'none'; base-uri 'self'; frame-ancestors 'none'",
+	FrameOptions:      "DENY",
+	ReferrerPolicy:    "strict-origin-when-cross-origin",
+	PermissionsPolicy: "camera=(), microphone=(), geolocation=()",
+	NoSniff:           true,
+}
+
+type contextKey struct{}
+
+// Nonce returns the Content-Security-Policy nonce for the request
+//
+// The nonce is available to templates as CSPNonce using render.DefaultVars
+func Nonce(req *http.Request) string {
+	n, _ := req.Context().Value(contextKey{}).(string)
+	return n
+}
+
+func newNonce() (string, error) {
+	b := make([]byte, 16)
+	if _, err := io.ReadFull(rand.Reader, b); err != nil {
+		return "", err
+	}
+	return base64.StdEncoding.EncodeToString(b), nil
+}
+
+// DefaultHandler is a security headers middleware using DefaultConfig
+func DefaultHandler(h http.Handler) http.Handler {
+	return Handler(DefaultConfig)(h)
+}
+
+// Handler returns a security headers middleware using the config
+func Handler(cfg Config) func(http.Handler) http.Handler {
+	hsts := ""
+	if cfg.HSTSMaxAge > 0 {
+		hsts = "max-age=" + strconv.Itoa(int(cfg.HSTSMaxAge/time.Second))
+		if cfg.HSTSIncludeSubdomains {
+			hsts += "; includeSubDomains"
+		}
+		if cfg.HSTSPreload {
+			hsts += "; preload"
+		}
+	}
+
+	csp := cfg.ContentSecurityPolicy
+	if len(csp) > 0 && len(cfg.ReportURI) > 0 {
+		csp = strings.TrimSuffix(strings.TrimSpace(csp), ";") + "; report-uri " + cfg.ReportURI
+	}
+	cspHeader := "Content-Security-Policy"
+	if cfg.ReportOnly {
+		cspHeader = "Content-Security-Policy-Report-Only"
+	}
+
+	return func(h http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+			hdr := w.Header()
+
+			if len(hsts) > 0 && proxy.Scheme(req) == "https" {
+				hdr.Set("Strict-Transport-Security", hsts)
+			}
+			if cfg.NoSniff {
+				hdr.Set("X-Content-Type-Options", "nosniff")
+			}
+			if len(cfg.FrameOptions) > 0 {
+				hdr.Set("X-Frame-Options", cfg.FrameOptions)
+			}
+			if len(cfg.ReferrerPolicy) > 0 {
+				hdr.Set("Referrer-Policy", cfg.ReferrerPolicy)
+			}
+			if len(cfg.PermissionsPolicy) > 0 {
+				hdr.Set("Permissions-Policy", cfg.PermissionsPolicy)
+			}
+
+			if len(csp) > 0 {
+				policy := csp
+				if strings.Contains(csp, NoncePlaceholder) {
+					nonce, err := newNonce()
+					if err != nil {
+						log.ErrorR(req, err, nil)
+						w.WriteHeader(http.StatusInternalServerError)
+						return
+					}
+					policy = strings.Replace(csp, NoncePlaceholder, "'nonce-"+nonce+"'", -1)
+					req = req.WithContext(context.WithValue(req.Context(), contextKey{}, nonce))
+				}
+				hdr.Set(cspHeader, policy)
+			}
+
+			h.ServeHTTP(w, req)
+		})
+	}
+}
+
+// MaxReportSize is the maximum size of a CSP violation report
+var MaxReportSize int64 = 64 << 10
+
+var reportPaths = struct {
+	sync.RWMutex
+	m map[string]bool
+}{m: make(map[string]bool)}
+
+// Register registers a route which logs CSP violation reports
+//
+// The path should be used as the Config.ReportURI. Browsers send
+// reports without a CSRF token, so the route must be exempt from CSRF
+// validation: render.WithCsrfHandler exempts paths registered here,
+// and other CSRF middleware can use IsReportPath.
+func Register(r *pat.Router, path string) {
+	reportPaths.Lock()
+	reportPaths.m[path] = true
+	reportPaths.Unlock()
+
+	r.Path(path).Methods("POST").HandlerFunc(ReportHandler)
+}
+
+// IsReportPath returns true if path is a CSP report route registered
+// using Register
+func IsReportPath(path string) bool {
+	reportPaths.RLock()
+	defer reportPaths.RUnlock()
+	return reportPaths.m[path]
+}
+
+// ReportHandler logs CSP violation reports sent using either the
+// report-uri (application/csp-report) or Reporting API
+// (application/reports+json) formats
+func ReportHandler(w http.ResponseWriter, req *http.Request) {
+	b, err := ioutil.ReadAll(io.LimitReader(req.Body, MaxReportSize))
+	if err != nil {
+		log.ErrorR(req, err, nil)
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	var reports []map[string]interface{}
+
+	if strings.HasPrefix(req.Header.Get("Content-Type"), "application/reports+json") {
+		var rs []struct {
+			Type string                 `json:"type"`
+			URL  string                 `json:"url"`
+			Body map[string]interface{} `json:"body"`
+		}
+		err = json.Unmarshal(b, &rs)
+		for _, r := range rs {
+			if r.Type == "csp-violation" {
+				reports = append(reports, r.Body)
+			}
+		}
+	} else {
+		var r struct {
+			Report map[string]interface{} `json:"csp-report"`
+		}
+		err = json.Unmarshal(b, &r)
+		if r.Report != nil {
+			reports = append(reports, r.Report)
+		}
+	}
+
+	if err != nil {
+		log.DebugR(req, "invalid csp report", log.Data{"error": err.Error()})
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	for _, r := range reports {
+		log.Event("csp-violation", log.Context(req), log.Data{
+			"report":     r,
+			"user_agent": req.UserAgent(),
+		})
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
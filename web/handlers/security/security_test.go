@@ -0,0 +1,84 @@
+package security
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/gorilla/pat"
+)
+
+func TestNonce(t *testing.T) {
+	var nonce string
+	h := DefaultHandler(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		nonce = Nonce(req)
+	}))
+
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, httptest.NewRequest("GET", "/", nil))
+
+	if len(nonce) == 0 {
+		t.Fatal("expected nonce")
+	}
+	csp := w.Header().Get("Content-Security-Policy")
+	if strings.Contains(csp, NoncePlaceholder) || strings.Count(csp, "'nonce-"+nonce+"'") != 2 {
+		t.Errorf("expected nonce in script-src and style-src, got %q", csp)
+	}
+
+	var next string
+	h = DefaultHandler(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		next = Nonce(req)
+	}))
+	h.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/", nil))
+	if next == nonce {
+		t.Error("expected a new nonce for each request")
+	}
+}
+
+func TestReportOnly(t *testing.T) {
+	cfg := Config{
+		ContentSecurityPolicy: "default-src 'self';",
+		ReportOnly:            true,
+		ReportURI:             "/csp-report",
+	}
+	h := Handler(cfg)(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {}))
+
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, httptest.NewRequest("GET", "/", nil))
+
+	if v := w.Header().Get("Content-Security-Policy"); len(v) > 0 {
+		t.Errorf("expected no enforced policy, got %q", v)
+	}
+	if v := w.Header().Get("Content-Security-Policy-Report-Only"); v != "default-src 'self'; report-uri /csp-report" {
+		t.Errorf("unexpected report-only policy: %q", v)
+	}
+}
+
+func TestReportHandler(t *testing.T) {
+	r := pat.New()
+	Register(r, "/csp-report")
+
+	if !IsReportPath("/csp-report") || IsReportPath("/other") {
+		t.Error("expected only the registered path to be a report path")
+	}
+
+	tests := []struct {
+		contentType, body string
+		status            int
+	}{
+		{"application/csp-report", `{"csp-report":{"document-uri":"https://example.com/","violated-directive":"script-src"}}`, http.StatusNoContent},
+		{"application/reports+json", `[{"type":"csp-violation","url":"https://example.com/","body":{"blockedURL":"inline"}}]`, http.StatusNoContent},
+		{"application/csp-report", `not json`, http.StatusBadRequest},
+	}
+
+	for i, tt := range tests {
+		req := httptest.NewRequest("POST", "/csp-report", strings.NewReader(tt.body))
+		req.Header.Set("Content-Type", tt.contentType)
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, req)
+		if w.Code != tt.status {
+			t.Errorf("test %d: expected %d, got %d", i, tt.status, w.Code)
+		}
+	}
+}
@@ -7,6 +7,7 @@ import (
 	"strings"
 
 	"github.com/gorilla/pat"
+	"github.com/ian-kent/service.go/handlers/compress"
 	"github.com/ian-kent/service.go/log"
 	"github.com/ian-kent/service.go/web/render"
 )
@@ -36,7 +37,7 @@ func Register(config render.Config, r *pat.Router) {
 
 			log.Trace("using mime type", log.Data{"type": mimeType})
 
-			r.Path(path).Methods("GET").HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+			r.Path(path).Methods("GET").Handler(compress.DefaultHandler(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
 				if b, err := config.Asset()("static" + path); err == nil {
 					w.Header().Set("Content-Type", mimeType)
 					w.Header().Set("Cache-control", "public, max-age=259200")
@@ -47,7 +48,7 @@ func Register(config render.Config, r *pat.Router) {
 				// This should never happen!
 				log.ErrorR(req, errors.New("it happened ¯\\_(ツ)_/¯"), nil)
 				r.NotFoundHandler.ServeHTTP(w, req)
-			})
+			})))
 		}
 	}
 }
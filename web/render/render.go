@@ -9,6 +9,7 @@ import (
 	"github.com/gorilla/schema"
 	"github.com/ian-kent/htmlform"
 	"github.com/ian-kent/service.go/log"
+	"github.com/ian-kent/service.go/web/handlers/security"
 	"github.com/ian-kent/service.go/web/session"
 	"github.com/justinas/nosurf"
 	"github.com/unrolled/render"
@@ -72,19 +73,23 @@ func HTML(w http.ResponseWriter, status int, name string, binding interface{}, h
 	Render.HTML(w, status, name, binding, htmlOpt...)
 }
 
-// DefaultVars adds the default vars (User and Session) to the data map
-// using the global renderer instance
+// DefaultVars adds the default vars (User, Session and CSPNonce) to the
+// data map using the global renderer instance
 func DefaultVars(req *http.Request, m Vars) map[string]interface{} {
 	return Render.DefaultVars(req, m)
 }
 
-// DefaultVars adds the default vars (User and Session) to the data map
+// DefaultVars adds the default vars (User, Session and CSPNonce) to the data map
 func (r Renderer) DefaultVars(req *http.Request, m Vars) map[string]interface{} {
 	if m == nil {
 		log.TraceR(req, "creating template data map", nil)
 		m = make(map[string]interface{})
 	}
 
+	if nonce := security.Nonce(req); len(nonce) > 0 {
+		m["CSPNonce"] = nonce
+	}
+
 	s, _ := session.Get(req)
 	if s == nil {
 		log.TraceR(req, "session not found", nil)
@@ -150,9 +155,26 @@ func Form(req *http.Request, model interface{}, errs *validator.StructErrors) ht
 	return htmlform.Create(model, Vtom(req, errs), []string{}, []string{}).WithCSRF(nosurf.FormFieldName, nosurf.Token(req))
 }
 
+// ErrorHandler returns a handler which renders the error template
+// with the given status and message
+//
+// It can be used as the failure handler for middleware, for example
+// recovery.FailureHandler
+func ErrorHandler(status int, message string) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		HTML(w, status, "error", DefaultVars(req, map[string]interface{}{"error": message}))
+	})
+}
+
 // WithCsrfHandler is a middleware wrapper providing CSRF validation
+//
+// CSP report routes registered using security.Register are exempt,
+// since browsers send reports without a CSRF token.
 func WithCsrfHandler(h http.Handler) http.Handler {
 	csrfHandler := nosurf.New(h)
+	csrfHandler.ExemptFunc(func(req *http.Request) bool {
+		return security.IsReportPath(req.URL.Path)
+	})
 	csrfHandler.SetFailureHandler(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
 		rsn := nosurf.Reason(req).Error()
 		log.DebugR(req, "failed csrf validation", log.Data{"reason": rsn})